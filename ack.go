@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/genuinetools/upmail/email"
+)
+
+const ackShortHelp = `Acknowledge the outage of a check.`
+
+const ackLongHelp = `Acknowledge the current outage of a check, which stops its escalation.
+Escalation starts over with the next outage.`
+
+type ackCommand struct {
+	endpoint string
+	comment  string
+	by       string
+}
+
+func (cmd *ackCommand) Name() string      { return "ack" }
+func (cmd *ackCommand) Args() string      { return "[OPTIONS] TITLE" }
+func (cmd *ackCommand) ShortHelp() string { return ackShortHelp }
+func (cmd *ackCommand) LongHelp() string  { return ackLongHelp }
+func (cmd *ackCommand) Hidden() bool      { return false }
+
+func (cmd *ackCommand) Register(fs *flag.FlagSet) {
+	fs.StringVar(&cmd.endpoint, "endpoint", "", "only acknowledge the check with this endpoint")
+	fs.StringVar(&cmd.comment, "comment", "", "comment to store with the acknowledgment")
+	fs.StringVar(&cmd.by, "by", os.Getenv("USER"), "who acknowledges the outage")
+}
+
+func (cmd *ackCommand) Run(ctx context.Context, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("pass the title of the check to acknowledge")
+	}
+
+	acks, err := email.LoadAcks(ackFile)
+	if err != nil {
+		return err
+	}
+	acks.Add(email.Ack{
+		Title:    args[0],
+		Endpoint: cmd.endpoint,
+		By:       cmd.by,
+		Comment:  cmd.comment,
+		Time:     time.Now(),
+	})
+	if err := acks.Save(ackFile); err != nil {
+		return err
+	}
+
+	fmt.Printf("Acknowledged %s, its escalation stops on the next check run\n", args[0])
+	return nil
+}
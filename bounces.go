@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/genuinetools/upmail/email"
+)
+
+const bouncesShortHelp = `Show recipients that cannot receive emails.`
+
+const bouncesLongHelp = `Show the recipients that are on the Mailgun bounce or complaint list or
+failed permanently, and remove fixed addresses from the bounce list.`
+
+type bouncesCommand struct {
+	since  time.Duration
+	delete string
+}
+
+func (cmd *bouncesCommand) Name() string      { return "bounces" }
+func (cmd *bouncesCommand) Args() string      { return "[OPTIONS]" }
+func (cmd *bouncesCommand) ShortHelp() string { return bouncesShortHelp }
+func (cmd *bouncesCommand) LongHelp() string  { return bouncesLongHelp }
+func (cmd *bouncesCommand) Hidden() bool      { return false }
+
+func (cmd *bouncesCommand) Register(fs *flag.FlagSet) {
+	fs.DurationVar(&cmd.since, "since", 24*time.Hour, "how far back to look for permanent failures")
+	fs.StringVar(&cmd.delete, "delete", "", "address to remove from the bounce list once it is fixed")
+}
+
+func (cmd *bouncesCommand) Run(ctx context.Context, args []string) error {
+	if len(mailgunAPIKey) < 1 || len(mailgunDomain) < 1 {
+		return fmt.Errorf("bounces requires --mailgun and --mailgun-domain")
+	}
+
+	configBytes, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	cfg, routing, err := parseConfig(configBytes)
+	if err != nil {
+		return err
+	}
+	b := newBounceMonitor(cfg, routing)
+
+	if len(cmd.delete) > 0 {
+		if err := b.DeleteBounce(cmd.delete); err != nil {
+			return err
+		}
+		fmt.Printf("Removed %s from the bounce list\n", cmd.delete)
+		return nil
+	}
+
+	suppressions, err := b.Check(time.Now().Add(-cmd.since))
+	if err != nil {
+		return err
+	}
+	if len(suppressions) == 0 {
+		fmt.Println("All recipients can receive emails")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tREASON\tSINCE\tDETAIL")
+	for _, s := range suppressions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Address, s.Reason, s.Since.Format(time.RFC3339), strings.TrimSpace(s.Detail))
+	}
+	return w.Flush()
+}
+
+// newBounceMonitor creates a bounce monitor for the recipients of routing
+// and the escalation policies, maintenance windows, calendars and schedules
+// of cfg from the Mailgun flags.
+func newBounceMonitor(cfg email.Config, routing email.Routing) *email.BounceMonitor {
+	recipients := routing.Addresses()
+	for _, policy := range cfg.Escalations {
+		for _, step := range policy.Steps {
+			recipients = append(recipients, step.Recipients...)
+		}
+	}
+	for _, w := range cfg.Maintenance {
+		recipients = append(recipients, w.Recipients...)
+	}
+	for _, c := range cfg.Calendars {
+		recipients = append(recipients, c.Recipients...)
+	}
+
+	var warn []string
+	for _, r := range strings.Split(bounceWarn, ",") {
+		if r = strings.TrimSpace(r); len(r) > 0 {
+			warn = append(warn, r)
+		}
+	}
+
+	return &email.BounceMonitor{
+		Domain:         mailgunDomain,
+		APIKey:         mailgunAPIKey,
+		APIBase:        mailgunAPIBase,
+		Recipients:     email.ExpandSchedules(recipients, cfg.Schedules),
+		Sender:         smtpSender,
+		WarnRecipients: warn,
+	}
+}
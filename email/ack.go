@@ -0,0 +1,103 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/checkup"
+)
+
+// ackRetention is how long acknowledgments are kept in the file.
+const ackRetention = 30 * 24 * time.Hour
+
+// Ack acknowledges the current outage of the checks it matches, which stops
+// their escalation.
+type Ack struct {
+	// Title is the title of the check.
+	Title string `json:"title"`
+	// Endpoint is the endpoint of the check. If empty, every check with
+	// Title matches.
+	Endpoint string `json:"endpoint,omitempty"`
+	// By is who acknowledged the outage.
+	By string `json:"by,omitempty"`
+	// Comment says why or what is being done about it.
+	Comment string `json:"comment,omitempty"`
+	// Time is when the outage was acknowledged.
+	Time time.Time `json:"time"`
+}
+
+// Acks holds the acknowledgments. They are written by "upmail ack" and read
+// by the notifier on every run.
+type Acks struct {
+	Acks []Ack `json:"acks"`
+}
+
+// LoadAcks reads the acknowledgments from file. A missing file results in
+// no acknowledgments.
+func LoadAcks(file string) (*Acks, error) {
+	a := &Acks{}
+	if file == "" {
+		return a, nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return a, nil
+		}
+		return nil, fmt.Errorf("reading acknowledgments file %s failed: %v", file, err)
+	}
+
+	if err := json.Unmarshal(b, a); err != nil {
+		return nil, fmt.Errorf("decoding acknowledgments file %s failed: %v", file, err)
+	}
+
+	return a, nil
+}
+
+// Add adds an acknowledgment and drops the ones older than ackRetention.
+func (a *Acks) Add(ack Ack) {
+	var acks []Ack
+	for _, old := range a.Acks {
+		if ack.Time.Sub(old.Time) < ackRetention {
+			acks = append(acks, old)
+		}
+	}
+	a.Acks = append(acks, ack)
+}
+
+// Save atomically writes the acknowledgments to file.
+func (a *Acks) Save(file string) error {
+	b, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding acknowledgments failed: %v", err)
+	}
+	if err := writeFileAtomic(file, b); err != nil {
+		return fmt.Errorf("writing acknowledgments file failed: %v", err)
+	}
+	return nil
+}
+
+// find returns the latest acknowledgment of r made after since.
+func (a *Acks) find(r checkup.Result, since time.Time) *Ack {
+	if a == nil {
+		return nil
+	}
+	var found *Ack
+	for i, ack := range a.Acks {
+		if !strings.EqualFold(ack.Title, r.Title) || (ack.Endpoint != "" && ack.Endpoint != r.Endpoint) {
+			continue
+		}
+		if ack.Time.Before(since) {
+			continue
+		}
+		if found == nil || ack.Time.After(found.Time) {
+			found = &a.Acks[i]
+		}
+	}
+	return found
+}
@@ -0,0 +1,142 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strings"
+)
+
+// SMTP authentication mechanisms.
+const (
+	// AuthAuto picks a mechanism from the ones the server advertises.
+	AuthAuto = "auto"
+	// AuthNone disables authentication.
+	AuthNone = "none"
+	// AuthPlain is the PLAIN mechanism of RFC 4616.
+	AuthPlain = "plain"
+	// AuthLogin is the non-standard but widespread LOGIN mechanism.
+	AuthLogin = "login"
+	// AuthCRAMMD5 is the CRAM-MD5 mechanism of RFC 2195.
+	AuthCRAMMD5 = "cram-md5"
+)
+
+// NewSMTPAuth returns the smtp.Auth for the given mechanism. It returns nil
+// if the mechanism is AuthNone or no username is given, in which case mail
+// is sent without authenticating, as is common for internal relays.
+func NewSMTPAuth(mechanism, username, password, host string) (smtp.Auth, error) {
+	mechanism = strings.ToLower(mechanism)
+	if mechanism == "" {
+		mechanism = AuthAuto
+	}
+
+	switch mechanism {
+	case AuthNone:
+		return nil, nil
+	case AuthAuto, AuthPlain, AuthLogin, AuthCRAMMD5:
+	case AuthXOAUTH2:
+		return nil, errors.New("the xoauth2 SMTP auth mechanism requires an OAuth2 configuration")
+	default:
+		return nil, fmt.Errorf("invalid SMTP auth mechanism %q, must be one of auto, plain, login, cram-md5, xoauth2 or none", mechanism)
+	}
+
+	if username == "" {
+		return nil, nil
+	}
+
+	switch mechanism {
+	case AuthPlain:
+		return smtp.PlainAuth("", username, password, host), nil
+	case AuthLogin:
+		return &loginAuth{username: username, password: password, host: host}, nil
+	case AuthCRAMMD5:
+		return smtp.CRAMMD5Auth(username, password), nil
+	}
+	return &autoAuth{username: username, password: password, host: host}, nil
+}
+
+// connAuth returns the smtp.Auth to use for a single connection. autoAuth
+// keeps the mechanism it picked for the server, so every connection gets a
+// fresh one and concurrent sends cannot mix up their mechanisms.
+func connAuth(a smtp.Auth) smtp.Auth {
+	if auto, ok := a.(*autoAuth); ok {
+		return &autoAuth{username: auto.username, password: auto.password, host: auto.host}
+	}
+	return a
+}
+
+// autoAuth picks the mechanism from the ones the server advertises. Over TLS
+// PLAIN is preferred, followed by LOGIN and CRAM-MD5; without TLS only
+// CRAM-MD5 is used so the password is never sent in the clear. It must not
+// be shared between connections, see connAuth.
+type autoAuth struct {
+	username string
+	password string
+	host     string
+
+	auth smtp.Auth
+}
+
+func (a *autoAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	advertised := map[string]bool{}
+	for _, m := range server.Auth {
+		advertised[strings.ToUpper(m)] = true
+	}
+
+	switch {
+	case server.TLS && advertised["PLAIN"]:
+		a.auth = smtp.PlainAuth("", a.username, a.password, a.host)
+	case server.TLS && advertised["LOGIN"]:
+		a.auth = &loginAuth{username: a.username, password: a.password, host: a.host}
+	case advertised["CRAM-MD5"]:
+		a.auth = smtp.CRAMMD5Auth(a.username, a.password)
+	case !server.TLS && (advertised["PLAIN"] || advertised["LOGIN"]):
+		return "", nil, errors.New("server only offers plaintext authentication over an unencrypted connection")
+	default:
+		return "", nil, fmt.Errorf("no supported authentication mechanism in %s", strings.Join(server.Auth, " "))
+	}
+
+	return a.auth.Start(server)
+}
+
+func (a *autoAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	return a.auth.Next(fromServer, more)
+}
+
+// loginAuth implements the LOGIN mechanism. Like smtp.PlainAuth it refuses
+// to send the credentials over an unencrypted connection unless the server
+// is on localhost.
+type loginAuth struct {
+	username string
+	password string
+	host     string
+}
+
+func (a *loginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+	return "LOGIN", nil, nil
+}
+
+func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	switch strings.ToLower(strings.TrimSpace(string(fromServer))) {
+	case "username:", "user name", "username":
+		return []byte(a.username), nil
+	case "password:", "password":
+		return []byte(a.password), nil
+	}
+	return nil, fmt.Errorf("unexpected LOGIN challenge %q", fromServer)
+}
+
+// isLocalhost reports whether host is the local machine.
+func isLocalhost(host string) bool {
+	return host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
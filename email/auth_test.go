@@ -0,0 +1,302 @@
+package email
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewSMTPAuth(t *testing.T) {
+	server := &smtp.ServerInfo{Name: "mail.example.com", TLS: true, Auth: []string{"LOGIN", "CRAM-MD5", "PLAIN"}}
+
+	tests := []struct {
+		mechanism string
+		username  string
+		// mech is the mechanism started with server, or empty if no
+		// authentication is used.
+		mech      string
+		wantError string
+	}{
+		{mechanism: "", username: "user", mech: "PLAIN"},
+		{mechanism: "auto", username: "user", mech: "PLAIN"},
+		{mechanism: "plain", username: "user", mech: "PLAIN"},
+		{mechanism: "Login", username: "user", mech: "LOGIN"},
+		{mechanism: "CRAM-MD5", username: "user", mech: "CRAM-MD5"},
+		{mechanism: "none", username: "user"},
+		{mechanism: "NONE", username: "user"},
+		{mechanism: "auto"},
+		{mechanism: "login"},
+		{mechanism: "xoauth2", username: "user", wantError: "requires an OAuth2 configuration"},
+		{mechanism: "gssapi", username: "user", wantError: `invalid SMTP auth mechanism "gssapi"`},
+		{mechanism: "plain,login", wantError: `invalid SMTP auth mechanism "plain,login"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mechanism+"/"+tt.username, func(t *testing.T) {
+			a, err := NewSMTPAuth(tt.mechanism, tt.username, "secret", "mail.example.com")
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("NewSMTPAuth returned %v, want an error containing %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewSMTPAuth: %v", err)
+			}
+			if tt.mech == "" {
+				if a != nil {
+					t.Fatalf("NewSMTPAuth returned %T, want no authentication", a)
+				}
+				return
+			}
+			if a == nil {
+				t.Fatal("NewSMTPAuth returned no authentication")
+			}
+			mech, _, err := connAuth(a).Start(server)
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			if mech != tt.mech {
+				t.Fatalf("Start picked %s, want %s", mech, tt.mech)
+			}
+		})
+	}
+}
+
+func TestPlaintextAuthRefused(t *testing.T) {
+	tests := []struct {
+		mechanism string
+		server    smtp.ServerInfo
+		wantError string
+	}{
+		{AuthPlain, smtp.ServerInfo{Name: "mail.example.com", Auth: []string{"PLAIN"}}, "unencrypted connection"},
+		{AuthLogin, smtp.ServerInfo{Name: "mail.example.com", Auth: []string{"LOGIN"}}, "unencrypted connection"},
+		{AuthAuto, smtp.ServerInfo{Name: "mail.example.com", Auth: []string{"PLAIN", "LOGIN"}}, "plaintext authentication over an unencrypted connection"},
+		{AuthPlain, smtp.ServerInfo{Name: "localhost", Auth: []string{"PLAIN"}}, ""},
+		{AuthLogin, smtp.ServerInfo{Name: "localhost", Auth: []string{"LOGIN"}}, ""},
+		{AuthCRAMMD5, smtp.ServerInfo{Name: "mail.example.com", Auth: []string{"CRAM-MD5"}}, ""},
+		{AuthPlain, smtp.ServerInfo{Name: "mail.example.com", TLS: true, Auth: []string{"PLAIN"}}, ""},
+		{AuthLogin, smtp.ServerInfo{Name: "mail.example.com", TLS: true, Auth: []string{"LOGIN"}}, ""},
+	}
+	for _, tt := range tests {
+		name := tt.mechanism + " to " + tt.server.Name
+		if tt.server.TLS {
+			name += " over TLS"
+		}
+		t.Run(name, func(t *testing.T) {
+			a, err := NewSMTPAuth(tt.mechanism, "user", "secret", tt.server.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mech, resp, err := connAuth(a).Start(&tt.server)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("Start returned %s %q, %v, want an error containing %q", mech, resp, err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+		})
+	}
+}
+
+func TestLoginAuth(t *testing.T) {
+	a := &loginAuth{username: "user", password: "secret", host: "mail.example.com"}
+
+	if _, _, err := a.Start(&smtp.ServerInfo{Name: "mx.example.com", TLS: true}); err == nil || err.Error() != "wrong host name" {
+		t.Fatalf("Start with the wrong host returned %v", err)
+	}
+	mech, resp, err := a.Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: true})
+	if err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if mech != "LOGIN" || resp != nil {
+		t.Fatalf("Start returned %s %q, want LOGIN without an initial response", mech, resp)
+	}
+
+	tests := []struct {
+		challenge string
+		more      bool
+		want      string
+		wantError bool
+	}{
+		{challenge: "Username:", more: true, want: "user"},
+		{challenge: "User Name", more: true, want: "user"},
+		{challenge: "username", more: true, want: "user"},
+		{challenge: "Password:", more: true, want: "secret"},
+		{challenge: " password ", more: true, want: "secret"},
+		{challenge: "Realm:", more: true, wantError: true},
+		{challenge: "", more: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.challenge, func(t *testing.T) {
+			got, err := a.Next([]byte(tt.challenge), tt.more)
+			if tt.wantError {
+				if err == nil || !strings.Contains(err.Error(), "unexpected LOGIN challenge") {
+					t.Fatalf("Next returned %q, %v, want an unexpected challenge error", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Next: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("Next returned %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSMTPTransportAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upmail-smtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert := newTestCert(t, dir, "server")
+	config, err := NewTLSConfig("", cert.certFile, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac := hmac.New(md5.New, []byte("secret"))
+	mac.Write([]byte("<1896.697170952@localhost>"))
+	cramMD5 := "CRAM-MD5 user " + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name      string
+		mechanism string
+		// advertised are the mechanisms offered by the server.
+		advertised []string
+		mode       TLSMode
+		want       string
+		wantError  string
+	}{
+		{name: "auto picks PLAIN over TLS", mechanism: AuthAuto, advertised: []string{"CRAM-MD5", "LOGIN", "PLAIN"}, want: "PLAIN user secret"},
+		{name: "auto picks LOGIN over TLS", mechanism: AuthAuto, advertised: []string{"CRAM-MD5", "LOGIN"}, want: "LOGIN user secret"},
+		{name: "auto picks CRAM-MD5 without TLS", mechanism: AuthAuto, advertised: []string{"PLAIN", "LOGIN", "CRAM-MD5"}, mode: TLSNone, want: cramMD5},
+		{name: "auto refuses plaintext without TLS", mechanism: AuthAuto, advertised: []string{"PLAIN", "LOGIN"}, mode: TLSNone, wantError: "smtp: authentication failed: server only offers plaintext authentication"},
+		{name: "plain", mechanism: AuthPlain, advertised: []string{"PLAIN"}, want: "PLAIN user secret"},
+		{name: "login", mechanism: AuthLogin, advertised: []string{"LOGIN"}, want: "LOGIN user secret"},
+		{name: "cram-md5", mechanism: AuthCRAMMD5, advertised: []string{"CRAM-MD5"}, want: cramMD5},
+		{name: "server without AUTH", mechanism: AuthAuto, wantError: "does not support authentication"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newSMTPServer(t, cert, func(s *smtpServer) {
+				s.startTLS = true
+				s.auth = tt.advertised
+			})
+			defer srv.close()
+
+			a, err := NewSMTPAuth(tt.mechanism, "user", "secret", "127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr := SMTPTransport{Server: srv.addr(), Auth: a, TLS: tt.mode, TLSConfig: config}
+			err = tr.Send(testMessage("api is down"))
+			session := srv.received(t, 1)[0]
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("Send returned %v, want an error containing %q", err, tt.wantError)
+				}
+				if session.auth != "" || session.data != "" {
+					t.Fatalf("server authenticated %q and received\n%s", session.auth, session.data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if session.auth != tt.want {
+				t.Fatalf("server authenticated %q, want %q", session.auth, tt.want)
+			}
+		})
+	}
+}
+
+func TestAutoAuthStart(t *testing.T) {
+	tests := []struct {
+		name  string
+		tls   bool
+		auth  []string
+		mech  string
+		fails bool
+	}{
+		{name: "plain over tls", tls: true, auth: []string{"LOGIN", "PLAIN", "CRAM-MD5"}, mech: "PLAIN"},
+		{name: "login over tls", tls: true, auth: []string{"LOGIN", "CRAM-MD5"}, mech: "LOGIN"},
+		{name: "cram-md5 over tls", tls: true, auth: []string{"CRAM-MD5"}, mech: "CRAM-MD5"},
+		{name: "cram-md5 without tls", auth: []string{"PLAIN", "CRAM-MD5"}, mech: "CRAM-MD5"},
+		{name: "plaintext without tls", auth: []string{"PLAIN", "LOGIN"}, fails: true},
+		{name: "unsupported", tls: true, auth: []string{"GSSAPI"}, fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, err := NewSMTPAuth(AuthAuto, "user", "secret", "mail.example.com")
+			if err != nil {
+				t.Fatal(err)
+			}
+			mech, _, err := connAuth(a).Start(&smtp.ServerInfo{Name: "mail.example.com", TLS: tt.tls, Auth: tt.auth})
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("Start picked %s, want an error", mech)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Start: %v", err)
+			}
+			if mech != tt.mech {
+				t.Fatalf("Start picked %s, want %s", mech, tt.mech)
+			}
+		})
+	}
+}
+
+func TestConnAuthIsNotShared(t *testing.T) {
+	a, err := NewSMTPAuth(AuthAuto, "user", "secret", "mail.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connAuth(a) == connAuth(a) {
+		t.Fatal("connAuth returned the same autoAuth twice")
+	}
+
+	// Connections to servers advertising different mechanisms must each
+	// continue with the mechanism they picked.
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			server := &smtp.ServerInfo{Name: "mail.example.com", TLS: true, Auth: []string{"PLAIN"}}
+			want := "PLAIN"
+			if i%2 == 0 {
+				server.Auth = []string{"CRAM-MD5"}
+				want = "CRAM-MD5"
+			}
+			c := connAuth(a)
+			mech, _, err := c.Start(server)
+			if err != nil || mech != want {
+				t.Errorf("Start picked %s (%v), want %s", mech, err, want)
+				return
+			}
+			resp, err := c.Next([]byte("<1.2@mail.example.com>"), want == "CRAM-MD5")
+			if err != nil {
+				t.Errorf("Next: %v", err)
+			}
+			if want == "CRAM-MD5" && len(resp) == 0 {
+				t.Error("CRAM-MD5 sent an empty response")
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,358 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mailgun "github.com/mailgun/mailgun-go"
+	"github.com/sirupsen/logrus"
+)
+
+// Reasons why Mailgun does not deliver to a recipient.
+const (
+	SuppressionBounce    = "bounce"
+	SuppressionComplaint = "complaint"
+	SuppressionFailed    = "failed"
+)
+
+// bounceEventPages limits how many pages of events are scanned per check.
+const bounceEventPages = 10
+
+// suppressionPageSize is how many entries of a suppression list are
+// fetched at once, and suppressionPages limits how many pages are fetched.
+const (
+	suppressionPageSize = 1000
+	suppressionPages    = 100
+)
+
+// Suppression is a recipient that Mailgun does not deliver to, or that
+// failed permanently.
+type Suppression struct {
+	// Address is the address of the recipient.
+	Address string
+	// Reason is one of SuppressionBounce, SuppressionComplaint or
+	// SuppressionFailed.
+	Reason string
+	// Detail is the error Mailgun reported, if any.
+	Detail string
+	// Since is when Mailgun recorded the bounce, complaint or failure.
+	Since time.Time
+}
+
+// BounceMonitor checks whether any recipient is on the Mailgun bounce or
+// complaint list or failed permanently, and warns about it through
+// alternate recipients so that a dead on-call address is noticed before an
+// outage is missed.
+type BounceMonitor struct {
+	// Domain is the Mailgun domain.
+	Domain string
+	// APIKey is the Mailgun API key.
+	APIKey string
+	// APIBase is the base URL of the Mailgun API. If empty, the US region
+	// is used.
+	APIBase string
+	// Recipients are the addresses to watch.
+	Recipients []string
+	// Sender is the address warnings are sent from.
+	Sender string
+	// WarnRecipients receive the warnings. If empty, warnings are only
+	// logged.
+	WarnRecipients []string
+	// WarnTransport sends the warnings.
+	WarnTransport Transport
+
+	mu     sync.Mutex
+	warned map[string]Suppression
+}
+
+// Run checks the recipients every interval until stop is closed.
+func (b *BounceMonitor) Run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	since := time.Now().Add(-interval)
+	for {
+		now := time.Now()
+		if err := b.CheckAndWarn(since); err != nil {
+			logrus.Warnf("checking recipients for bounces failed: %v", err)
+		} else {
+			since = now
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CheckAndWarn checks the recipients and warns about every suppression that
+// has not been warned about yet.
+func (b *BounceMonitor) CheckAndWarn(since time.Time) error {
+	suppressions, err := b.Check(since)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.warned == nil {
+		b.warned = map[string]Suppression{}
+	}
+	current := map[string]bool{}
+	var fresh []Suppression
+	for _, s := range suppressions {
+		key := strings.ToLower(s.Address) + " " + s.Reason
+		current[key] = true
+		if _, ok := b.warned[key]; !ok {
+			fresh = append(fresh, s)
+		}
+	}
+	for key, s := range b.warned {
+		if current[key] {
+			continue
+		}
+		// Failures are only reported while they are recent, the lists
+		// keep an address until it is removed.
+		if s.Reason != SuppressionFailed {
+			logrus.Infof("recipient %s is no longer on the Mailgun %s list", s.Address, s.Reason)
+		}
+		delete(b.warned, key)
+	}
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	for _, s := range fresh {
+		logrus.Errorf("recipient %s cannot receive emails (%s since %s): %s", s.Address, s.Reason, s.Since.Format(time.RFC3339), s.Detail)
+	}
+	if err := b.warn(fresh); err != nil {
+		return err
+	}
+	for _, s := range fresh {
+		b.warned[strings.ToLower(s.Address)+" "+s.Reason] = s
+	}
+	return nil
+}
+
+// Check returns the recipients that are on the bounce or complaint list,
+// or failed permanently after since.
+func (b *BounceMonitor) Check(since time.Time) ([]Suppression, error) {
+	watched := map[string]string{}
+	for _, r := range b.Recipients {
+		addrs, err := mail.ParseAddressList(r)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %v", r, err)
+		}
+		for _, a := range addrs {
+			watched[strings.ToLower(a.Address)] = a.Address
+		}
+	}
+
+	var suppressions []Suppression
+
+	bounces, err := b.listSuppressions("bounces")
+	if err != nil {
+		return nil, fmt.Errorf("getting Mailgun bounces failed: %v", err)
+	}
+	for _, bounce := range bounces {
+		if addr, ok := watched[strings.ToLower(bounce.Address)]; ok {
+			t, _ := parseMailgunTime(bounce.CreatedAt)
+			suppressions = append(suppressions, Suppression{
+				Address: addr,
+				Reason:  SuppressionBounce,
+				Detail:  bounce.Error,
+				Since:   t,
+			})
+		}
+	}
+
+	complaints, err := b.listSuppressions("complaints")
+	if err != nil {
+		return nil, fmt.Errorf("getting Mailgun complaints failed: %v", err)
+	}
+	for _, complaint := range complaints {
+		if addr, ok := watched[strings.ToLower(complaint.Address)]; ok {
+			t, _ := parseMailgunTime(complaint.CreatedAt)
+			suppressions = append(suppressions, Suppression{
+				Address: addr,
+				Reason:  SuppressionComplaint,
+				Detail:  fmt.Sprintf("marked %d emails as spam", complaint.Count),
+				Since:   t,
+			})
+		}
+	}
+
+	mg := b.client()
+	it := mg.ListEvents(&mailgun.EventsOptions{
+		Begin:          since,
+		ForceAscending: true,
+		Limit:          300,
+		Filter: map[string]string{
+			"event":    "failed",
+			"severity": "permanent",
+		},
+	})
+	failed := map[string]bool{}
+	var events []mailgun.Event
+	for page := 0; page < bounceEventPages && it.Next(&events); page++ {
+		for _, e := range events {
+			rcpt, _ := e["recipient"].(string)
+			addr, ok := watched[strings.ToLower(rcpt)]
+			if !ok || failed[addr] {
+				continue
+			}
+			failed[addr] = true
+			t, _ := e.ParseTimeStamp()
+			suppressions = append(suppressions, Suppression{
+				Address: addr,
+				Reason:  SuppressionFailed,
+				Detail:  eventDetail(e),
+				Since:   t,
+			})
+		}
+	}
+	if err := it.Err(); err != nil {
+		return nil, fmt.Errorf("getting Mailgun events failed: %v", err)
+	}
+
+	sort.SliceStable(suppressions, func(i, j int) bool {
+		return suppressions[i].Address < suppressions[j].Address
+	})
+	return suppressions, nil
+}
+
+// suppressionItem is an entry of the Mailgun bounce or complaint list.
+type suppressionItem struct {
+	Address   string `json:"address"`
+	Error     string `json:"error"`
+	Count     int    `json:"count"`
+	CreatedAt string `json:"created_at"`
+}
+
+// listSuppressions returns every entry of the Mailgun suppression list,
+// such as "bounces" or "complaints". The client library only fetches the
+// first page, so the paging links are followed here until a page is empty.
+func (b *BounceMonitor) listSuppressions(list string) ([]suppressionItem, error) {
+	base := b.APIBase
+	if base == "" {
+		base = mailgun.ApiBase
+	}
+	next := fmt.Sprintf("%s/%s/%s?limit=%d", strings.TrimSuffix(base, "/"), b.Domain, list, suppressionPageSize)
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	var items []suppressionItem
+	for page := 0; page < suppressionPages && next != ""; page++ {
+		req, err := http.NewRequest("GET", next, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth("api", b.APIKey)
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+
+		var result struct {
+			Items  []suppressionItem `json:"items"`
+			Paging mailgun.Paging    `json:"paging"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("decoding %s failed: %v", list, err)
+		}
+		if len(result.Items) == 0 {
+			break
+		}
+		items = append(items, result.Items...)
+		if result.Paging.Next == next {
+			break
+		}
+		next = result.Paging.Next
+	}
+	return items, nil
+}
+
+// DeleteBounce removes address from the bounce list, for example after the
+// mailbox was fixed.
+func (b *BounceMonitor) DeleteBounce(address string) error {
+	if err := b.client().DeleteBounce(address); err != nil {
+		return fmt.Errorf("deleting Mailgun bounce of %s failed: %v", address, err)
+	}
+	return nil
+}
+
+// warn sends a warning about the suppressions to the alternate recipients.
+func (b *BounceMonitor) warn(suppressions []Suppression) error {
+	if len(b.WarnRecipients) == 0 || b.WarnTransport == nil {
+		return nil
+	}
+
+	var text strings.Builder
+	fmt.Fprintf(&text, "The following recipients of upmail alerts cannot receive emails:\n\n")
+	for _, s := range suppressions {
+		fmt.Fprintf(&text, "  %s: %s since %s", s.Address, s.Reason, s.Since.Format(time.RFC3339))
+		if s.Detail != "" {
+			fmt.Fprintf(&text, ": %s", s.Detail)
+		}
+		text.WriteString("\n")
+	}
+	text.WriteString("\nAlerts for the checks routed to them are not delivered. Once an address is\n" +
+		"fixed, remove it from the bounce list with:\n\n    upmail bounces --delete <address>\n")
+
+	subject := fmt.Sprintf("[UPMAIL]: %d recipients cannot receive alerts", len(suppressions))
+	if len(suppressions) == 1 {
+		subject = fmt.Sprintf("[UPMAIL]: %s cannot receive alerts", suppressions[0].Address)
+	}
+
+	m := NewMessage(b.Sender, b.WarnRecipients, subject, text.String(), "")
+	m.Tags = []string{"bounce-warning"}
+	if err := b.WarnTransport.Send(m); err != nil {
+		return fmt.Errorf("sending bounce warning failed: %v", err)
+	}
+	return nil
+}
+
+func (b *BounceMonitor) client() mailgun.Mailgun {
+	mg := mailgun.NewMailgun(b.Domain, b.APIKey, "")
+	if b.APIBase != "" {
+		mg.SetAPIBase(b.APIBase)
+	}
+	return mg
+}
+
+// eventDetail returns the delivery status message of a failed event.
+func eventDetail(e mailgun.Event) string {
+	status, ok := e["delivery-status"].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	for _, key := range []string{"message", "description"} {
+		if s, ok := status[key].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// parseMailgunTime parses the RFC 2822 timestamps of the Mailgun API.
+func parseMailgunTime(s string) (time.Time, error) {
+	return time.Parse("Mon, 2 Jan 2006 15:04:05 MST", s)
+}
@@ -0,0 +1,279 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bounceServer is a fake Mailgun API serving the bounce and complaint lists
+// two entries per page, and the permanent failures.
+type bounceServer struct {
+	*httptest.Server
+
+	mu          sync.Mutex
+	lists       map[string][]map[string]interface{}
+	failed      []map[string]interface{}
+	deleted     []string
+	listFetches int
+}
+
+func newBounceServer() *bounceServer {
+	s := &bounceServer{lists: map[string][]map[string]interface{}{}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+func (s *bounceServer) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	if user, key, _ := r.BasicAuth(); user != "api" || key != "key-test" {
+		http.Error(w, "Forbidden", http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/v3/example.com/")
+	switch {
+	case r.Method == "DELETE" && strings.HasPrefix(path, "bounces/"):
+		addr := strings.TrimPrefix(path, "bounces/")
+		var kept []map[string]interface{}
+		for _, b := range s.lists["bounces"] {
+			if b["address"] != addr {
+				kept = append(kept, b)
+			}
+		}
+		if len(kept) == len(s.lists["bounces"]) {
+			http.Error(w, `{"message":"Address not found in bounces table"}`, http.StatusNotFound)
+			return
+		}
+		s.lists["bounces"] = kept
+		s.deleted = append(s.deleted, addr)
+		json.NewEncoder(w).Encode(map[string]string{"message": "Bounced address has been removed"})
+
+	case path == "bounces" || path == "complaints":
+		s.listFetches++
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		items := s.lists[path]
+		start, end := page*2, page*2+2
+		if start > len(items) {
+			start = len(items)
+		}
+		if end > len(items) {
+			end = len(items)
+		}
+		next := fmt.Sprintf("%s/v3/example.com/%s?page=%d", s.URL, path, page+1)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"items":  append([]map[string]interface{}{}, items[start:end]...),
+			"paging": map[string]string{"next": next},
+		})
+
+	case path == "events":
+		var events []map[string]interface{}
+		if r.URL.Query().Get("page") == "" {
+			events = s.failed
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"items":  append([]map[string]interface{}{}, events...),
+			"paging": map[string]string{"next": s.URL + "/v3/example.com/events?page=2"},
+		})
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *bounceServer) setList(list string, items ...map[string]interface{}) {
+	s.mu.Lock()
+	s.lists[list] = items
+	s.mu.Unlock()
+}
+
+func (s *bounceServer) monitor(warn Transport) *BounceMonitor {
+	return &BounceMonitor{
+		Domain:         "example.com",
+		APIKey:         "key-test",
+		APIBase:        s.URL + "/v3",
+		Recipients:     []string{"Ops <ops@example.com>", "dev@example.com, db@example.com"},
+		Sender:         "upmail@example.com",
+		WarnRecipients: []string{"lead@example.com"},
+		WarnTransport:  warn,
+	}
+}
+
+func bounce(addr string) map[string]interface{} {
+	return map[string]interface{}{
+		"address":    addr,
+		"code":       "550",
+		"error":      "No such mailbox",
+		"created_at": "Fri, 16 Oct 2026 08:00:00 UTC",
+	}
+}
+
+func TestBounceMonitorCheck(t *testing.T) {
+	srv := newBounceServer()
+	defer srv.Close()
+
+	// The watched bounce is on the second page of the list.
+	srv.setList("bounces", bounce("a@example.com"), bounce("b@example.com"), bounce("c@example.com"), bounce("OPS@example.com"), bounce("d@example.com"))
+	srv.setList("complaints", map[string]interface{}{
+		"address":    "dev@example.com",
+		"count":      2,
+		"created_at": "Thu, 15 Oct 2026 10:00:00 UTC",
+	})
+	srv.failed = []map[string]interface{}{
+		{
+			"event":           "failed",
+			"recipient":       "db@example.com",
+			"timestamp":       float64(time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC).Unix()),
+			"delivery-status": map[string]interface{}{"message": "mailbox disabled"},
+		},
+		{
+			"event":     "failed",
+			"recipient": "other@example.com",
+			"timestamp": float64(time.Date(2026, 10, 17, 9, 0, 0, 0, time.UTC).Unix()),
+		},
+	}
+
+	suppressions, err := srv.monitor(nil).Check(time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+
+	var got []string
+	for _, s := range suppressions {
+		got = append(got, fmt.Sprintf("%s %s %s %s", s.Address, s.Reason, s.Since.UTC().Format("2006-01-02 15:04"), s.Detail))
+	}
+	want := []string{
+		"db@example.com failed 2026-10-17 09:00 mailbox disabled",
+		"dev@example.com complaint 2026-10-15 10:00 marked 2 emails as spam",
+		"ops@example.com bounce 2026-10-16 08:00 No such mailbox",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("suppressions are\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// Three pages of bounces and one of complaints, each followed by an
+	// empty page.
+	if srv.listFetches != 6 {
+		t.Fatalf("fetched %d pages of suppression lists, want 6", srv.listFetches)
+	}
+}
+
+func TestBounceMonitorCheckError(t *testing.T) {
+	srv := newBounceServer()
+	defer srv.Close()
+
+	b := srv.monitor(nil)
+	b.APIKey = "wrong"
+	_, err := b.Check(time.Now())
+	if err == nil || !strings.Contains(err.Error(), "getting Mailgun bounces failed") {
+		t.Fatalf("Check returned %v, want a bounces error", err)
+	}
+}
+
+func TestBounceMonitorCheckAndWarn(t *testing.T) {
+	srv := newBounceServer()
+	defer srv.Close()
+
+	tr := &fakeTransport{}
+	b := srv.monitor(tr)
+	since := time.Now().Add(-time.Hour)
+
+	steps := []struct {
+		name    string
+		bounces []map[string]interface{}
+		want    []string
+	}{
+		{
+			name: "nothing suppressed",
+		},
+		{
+			name:    "new bounce",
+			bounces: []map[string]interface{}{bounce("ops@example.com")},
+			want:    []string{"[UPMAIL]: ops@example.com cannot receive alerts"},
+		},
+		{
+			name:    "bounce already warned about",
+			bounces: []map[string]interface{}{bounce("ops@example.com")},
+		},
+		{
+			name:    "second bounce",
+			bounces: []map[string]interface{}{bounce("ops@example.com"), bounce("dev@example.com"), bounce("db@example.com")},
+			want:    []string{"[UPMAIL]: 2 recipients cannot receive alerts"},
+		},
+		{
+			name: "bounces removed",
+		},
+		{
+			name:    "bounce again after it was removed",
+			bounces: []map[string]interface{}{bounce("ops@example.com")},
+			want:    []string{"[UPMAIL]: ops@example.com cannot receive alerts"},
+		},
+	}
+	for _, step := range steps {
+		before := len(tr.subjects())
+		srv.setList("bounces", step.bounces...)
+		if err := b.CheckAndWarn(since); err != nil {
+			t.Fatalf("%s: CheckAndWarn: %v", step.name, err)
+		}
+		got := tr.subjects()[before:]
+		if strings.Join(got, "\n") != strings.Join(step.want, "\n") {
+			t.Fatalf("%s: sent %q, want %q", step.name, got, step.want)
+		}
+	}
+}
+
+func TestBounceMonitorWarnFails(t *testing.T) {
+	srv := newBounceServer()
+	defer srv.Close()
+	srv.setList("bounces", bounce("ops@example.com"))
+
+	tr := &fakeTransport{down: true}
+	b := srv.monitor(tr)
+	if err := b.CheckAndWarn(time.Now()); err == nil {
+		t.Fatal("CheckAndWarn succeeded while the warning could not be sent")
+	}
+
+	// The bounce is warned about again once the warning can be sent.
+	tr.setDown(false)
+	if err := b.CheckAndWarn(time.Now()); err != nil {
+		t.Fatalf("CheckAndWarn: %v", err)
+	}
+	if got := tr.subjects(); len(got) != 1 {
+		t.Fatalf("sent %q, want one warning", got)
+	}
+}
+
+func TestBounceMonitorDeleteBounce(t *testing.T) {
+	srv := newBounceServer()
+	defer srv.Close()
+	srv.setList("bounces", bounce("ops@example.com"), bounce("dev@example.com"))
+
+	b := srv.monitor(nil)
+	if err := b.DeleteBounce("ops@example.com"); err != nil {
+		t.Fatalf("DeleteBounce: %v", err)
+	}
+	if len(srv.deleted) != 1 || srv.deleted[0] != "ops@example.com" {
+		t.Fatalf("deleted %q, want ops@example.com", srv.deleted)
+	}
+
+	suppressions, err := b.Check(time.Now())
+	if err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if len(suppressions) != 1 || suppressions[0].Address != "dev@example.com" {
+		t.Fatalf("suppressions are %+v, want only dev@example.com", suppressions)
+	}
+
+	err = b.DeleteBounce("ops@example.com")
+	if err == nil || !strings.Contains(err.Error(), "deleting Mailgun bounce of ops@example.com failed") {
+		t.Fatalf("DeleteBounce of an unknown address returned %v", err)
+	}
+}
@@ -0,0 +1,313 @@
+package email
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sourcegraph/checkup"
+)
+
+// DefaultCalendarRefresh is how often calendars are fetched again by
+// default.
+const DefaultCalendarRefresh = 15 * time.Minute
+
+// calendarLookback is how long ended occurrences of calendar events are
+// kept as windows, so the end of their maintenance can still be notified.
+const calendarLookback = 24 * time.Hour
+
+// Calendar imports maintenance windows from an iCalendar (.ics) file or URL.
+// Every event that matches Categories and Summary becomes a maintenance
+// window for the checks named in its description, see eventChecks.
+type Calendar struct {
+	// URL is the http(s) or webcal URL or the path of the calendar.
+	URL string `json:"url"`
+	// Categories select the events with any of these categories. Empty
+	// means every category.
+	Categories []string `json:"categories,omitempty"`
+	// Summary matches the summary of the events.
+	Summary Pattern `json:"summary,omitempty"`
+	// Refresh is how often the calendar is fetched again. Zero means
+	// DefaultCalendarRefresh.
+	Refresh Duration `json:"refresh,omitempty"`
+	// TimeZone is the IANA time zone of times without one. Empty means
+	// the X-WR-TIMEZONE of the calendar or UTC.
+	TimeZone string `json:"time_zone,omitempty"`
+	// Notify sends a notice when the maintenance of an event starts and
+	// ends.
+	Notify bool `json:"notify,omitempty"`
+	// Recipients get the notices. Empty means the recipients the matching
+	// checks are routed to when they are down.
+	Recipients []string `json:"recipients,omitempty"`
+
+	mu     sync.Mutex
+	events []*icsEvent
+}
+
+// Validate reports whether the calendar settings are usable.
+func (c *Calendar) Validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("calendar without a url")
+	}
+	if _, err := time.LoadLocation(c.TimeZone); err != nil {
+		return fmt.Errorf("calendar %s: invalid time zone %q: %v", c.URL, c.TimeZone, err)
+	}
+	return nil
+}
+
+// Run fetches the calendar every Refresh until stop is closed. Failed
+// fetches keep the events of the last successful one.
+func (c *Calendar) Run(stop <-chan struct{}) {
+	refresh := time.Duration(c.Refresh)
+	if refresh <= 0 {
+		refresh = DefaultCalendarRefresh
+	}
+	ticker := time.NewTicker(refresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		if err := c.Fetch(); err != nil {
+			logrus.Warnf("fetching calendar failed, keeping the previous events: %v", err)
+		}
+	}
+}
+
+// Fetch reads the calendar and replaces its events.
+func (c *Calendar) Fetch() error {
+	body, err := c.open()
+	if err != nil {
+		return fmt.Errorf("opening calendar %s failed: %v", c.URL, err)
+	}
+	defer body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(body, 16<<20))
+	if err != nil {
+		return fmt.Errorf("reading calendar %s failed: %v", c.URL, err)
+	}
+
+	loc, err := time.LoadLocation(c.TimeZone)
+	if err != nil {
+		return err
+	}
+	if c.TimeZone == "" {
+		loc = calendarTimeZone(string(b))
+	}
+
+	events, err := parseICS(strings.NewReader(string(b)), loc)
+	if err != nil {
+		return fmt.Errorf("parsing calendar %s failed: %v", c.URL, err)
+	}
+
+	// Modified occurrences of recurring events replace the occurrence of
+	// the series.
+	series := map[string]*icsEvent{}
+	for _, ev := range events {
+		if ev.rrule != nil {
+			series[ev.uid] = ev
+		}
+	}
+	var selected []*icsEvent
+	for _, ev := range events {
+		if !ev.recurrenceID.IsZero() {
+			if s, ok := series[ev.uid]; ok {
+				s.exdates[ev.recurrenceID.Unix()] = true
+			}
+		}
+		if !c.match(ev) {
+			continue
+		}
+		if len(eventChecks(ev.description)) == 0 {
+			logrus.Warnf("ignoring calendar event %q of %s: its description has no \"checks:\" line naming the checks under maintenance", ev.summary, c.URL)
+			continue
+		}
+		selected = append(selected, ev)
+	}
+
+	c.mu.Lock()
+	c.events = selected
+	c.mu.Unlock()
+
+	logrus.Infof("Loaded %d maintenance events of %d from calendar %s", len(selected), len(events), c.URL)
+	return nil
+}
+
+// open opens the calendar at its URL or path.
+func (c *Calendar) open() (io.ReadCloser, error) {
+	url := c.URL
+	if strings.HasPrefix(url, "webcal://") {
+		url = "https://" + strings.TrimPrefix(url, "webcal://")
+	}
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return os.Open(strings.TrimPrefix(url, "file://"))
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// match reports whether ev is a maintenance event of the calendar.
+func (c *Calendar) match(ev *icsEvent) bool {
+	if !c.Summary.Match(ev.summary) {
+		return false
+	}
+	if len(c.Categories) == 0 {
+		return true
+	}
+	for _, want := range c.Categories {
+		for _, got := range ev.categories {
+			if strings.EqualFold(strings.TrimSpace(got), want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Windows returns a maintenance window for every occurrence of the events
+// that is active at now or ended less than calendarLookback ago.
+func (c *Calendar) Windows(now time.Time) []MaintenanceWindow {
+	c.mu.Lock()
+	events := c.events
+	c.mu.Unlock()
+
+	var windows []MaintenanceWindow
+	for _, ev := range events {
+		titles := eventChecks(ev.description)
+		if len(titles) == 0 {
+			continue
+		}
+
+		ev.occurrences(now, func(start time.Time) bool {
+			end := start.Add(ev.end.Sub(ev.start))
+			if ev.allDay {
+				// All-day events keep their number of days across
+				// daylight saving time changes.
+				days := int(ev.end.Sub(ev.start).Hours()/24 + 0.5)
+				end = start.AddDate(0, 0, days)
+			}
+			if end.After(now.Add(-calendarLookback)) {
+				windows = append(windows, MaintenanceWindow{
+					Name:       fmt.Sprintf("%s (%s)", ev.summary, start.Format("2006-01-02 15:04 MST")),
+					Start:      start,
+					End:        end,
+					Comment:    ev.description,
+					Notify:     c.Notify,
+					Recipients: c.Recipients,
+					titles:     titles,
+				})
+			}
+			return true
+		})
+	}
+	return windows
+}
+
+// eventChecks returns the check title patterns named in the description of
+// an event. They follow a "checks:" line, either on the line itself
+// separated by commas or as a bulleted list on the lines below it. Without
+// such a line the event names no checks.
+func eventChecks(description string) []Pattern {
+	var names []string
+	lines := strings.Split(description, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		j := strings.Index(line, ":")
+		if j < 0 || !strings.EqualFold(strings.TrimSpace(line[:j]), "checks") {
+			continue
+		}
+		if rest := strings.TrimSpace(line[j+1:]); rest != "" {
+			names = strings.Split(rest, ",")
+			break
+		}
+		for _, item := range lines[i+1:] {
+			item = strings.TrimSpace(item)
+			name, ok := trimBullet(item)
+			if !ok {
+				break
+			}
+			names = append(names, name)
+		}
+		break
+	}
+
+	var patterns []Pattern
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		p, err := ParsePattern(name)
+		if err != nil {
+			logrus.Warnf("ignoring check %q of calendar event: %v", name, err)
+			continue
+		}
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// trimBullet returns the item of a bulleted list line.
+func trimBullet(line string) (string, bool) {
+	for _, bullet := range []string{"- ", "* ", "• "} {
+		if strings.HasPrefix(line, bullet) {
+			return strings.TrimSpace(strings.TrimPrefix(line, bullet)), true
+		}
+	}
+	return "", false
+}
+
+// calendarTimeZone returns the X-WR-TIMEZONE of a calendar, or UTC.
+func calendarTimeZone(ics string) *time.Location {
+	for _, line := range strings.Split(ics, "\n") {
+		if strings.HasPrefix(strings.ToUpper(line), "X-WR-TIMEZONE:") {
+			if loc, err := time.LoadLocation(strings.TrimSpace(line[len("X-WR-TIMEZONE:"):])); err == nil {
+				return loc
+			}
+		}
+	}
+	return time.UTC
+}
+
+// maintenanceWindows returns the maintenance windows of the config followed
+// by those of the calendars.
+func (n *Notifier) maintenanceWindows(now time.Time) []MaintenanceWindow {
+	windows := n.Maintenance
+	for _, c := range n.Calendars {
+		windows = append(windows[:len(windows):len(windows)], c.Windows(now)...)
+	}
+	return windows
+}
+
+// matchesTitles reports whether r matches any of titles, or whether titles
+// is empty.
+func matchesTitles(titles []Pattern, r checkup.Result) bool {
+	if len(titles) == 0 {
+		return true
+	}
+	for _, t := range titles {
+		if t.Match(r.Title) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,294 @@
+package email
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEventChecks(t *testing.T) {
+	tests := []struct {
+		name        string
+		description string
+		want        []string
+	}{
+		{name: "empty"},
+		{name: "prose without a checks line", description: "Upgrading the cluster.\napi\nweb-*\n"},
+		{name: "list without a checks line", description: "- api\n- web"},
+		{name: "checks line", description: "Upgrading the cluster.\nChecks: api-*, ~web-[0-9]+ ,db\nTicket OPS-1", want: []string{"api-*", "~web-[0-9]+", "db"}},
+		{name: "list below a checks line", description: "Upgrading the cluster.\n\nchecks:\n- api\n* web\n• db\n-  *-cache\n\n- not a check", want: []string{"api", "web", "db", "*-cache"}},
+		{name: "list ends at the first other line", description: "checks:\n- api\nsee OPS-1\n- web", want: []string{"api"}},
+		{name: "checks line without checks", description: "checks:\nnothing yet"},
+		{name: "first checks line wins", description: "checks: api\nchecks: web", want: []string{"api"}},
+		{name: "invalid regexp is skipped", description: "checks: ~api-(, web", want: []string{"web"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, p := range eventChecks(tt.description) {
+				got = append(got, p.String())
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Fatalf("checks are %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// calendarServer serves a calendar over HTTP. Its status and body can be
+// changed between fetches.
+type calendarServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	status   int
+	body     string
+	requests int
+}
+
+func newCalendarServer(body string) *calendarServer {
+	s := &calendarServer{status: http.StatusOK, body: body}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.requests++
+		w.WriteHeader(s.status)
+		io.WriteString(w, s.body)
+	}))
+	return s
+}
+
+func (s *calendarServer) serve(status int, body string) {
+	s.mu.Lock()
+	s.status, s.body = status, body
+	s.mu.Unlock()
+}
+
+func (s *calendarServer) fetched() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// maintenanceCalendar has events in and out of the maintenance category,
+// a recurring event with a moved occurrence and an all-day event.
+var maintenanceCalendar = ics(
+	"X-WR-TIMEZONE:Europe/Berlin",
+	"BEGIN:VEVENT", "UID:db", "SUMMARY:DB upgrade", "CATEGORIES:Maintenance",
+	"DTSTART:20261020T200000", "DTEND:20261020T220000",
+	"DESCRIPTION:Upgrading to 16.\\nchecks: db-*", "END:VEVENT",
+	"BEGIN:VEVENT", "UID:lunch", "SUMMARY:Upgrade lunch", "CATEGORIES:Social",
+	"DTSTART:20261020T120000", "DTEND:20261020T130000",
+	"DESCRIPTION:checks: api", "END:VEVENT",
+	"BEGIN:VEVENT", "UID:move", "SUMMARY:Office move", "CATEGORIES:MAINTENANCE",
+	"DTSTART:20261020T080000", "DTEND:20261020T180000",
+	"DESCRIPTION:checks: web", "END:VEVENT",
+	"BEGIN:VEVENT", "UID:deploy", "SUMMARY:Weekly deploy", "CATEGORIES:Ops,Maintenance",
+	"DTSTART:20261013T060000", "DTEND:20261013T070000", "RRULE:FREQ=WEEKLY;BYDAY=TU",
+	"DESCRIPTION:checks:\\n- api\\n- web", "END:VEVENT",
+	"BEGIN:VEVENT", "UID:deploy", "SUMMARY:Weekly deploy (moved)", "CATEGORIES:Maintenance",
+	"RECURRENCE-ID:20261020T060000",
+	"DTSTART:20261020T230000", "DTEND:20261021T000000",
+	"DESCRIPTION:checks:\\n- api\\n- web", "END:VEVENT",
+	"BEGIN:VEVENT", "UID:dc", "SUMMARY:Datacenter upgrade", "CATEGORIES:maintenance ",
+	"DTSTART;VALUE=DATE:20261020", "DTEND;VALUE=DATE:20261022",
+	"DESCRIPTION:checks: ~.*", "END:VEVENT",
+	"BEGIN:VEVENT", "UID:prose", "SUMMARY:Upgrade planning", "CATEGORIES:Maintenance",
+	"DTSTART:20261021T090000", "DTEND:20261021T100000",
+	"DESCRIPTION:api\\nweb", "END:VEVENT",
+)
+
+// windowNames returns the names of windows, with the checks of checks each
+// window matches.
+func windowNames(windows []MaintenanceWindow, checks ...string) []string {
+	sort.Slice(windows, func(i, j int) bool { return windows[i].Start.Before(windows[j].Start) })
+	var names []string
+	for _, w := range windows {
+		var matched []string
+		for _, title := range checks {
+			if matchesTitles(w.titles, testResult(title, "down")) {
+				matched = append(matched, title)
+			}
+		}
+		names = append(names, fmt.Sprintf("%s until %s: %s", w.Name, w.End.Format("01-02 15:04"), strings.Join(matched, ",")))
+	}
+	return names
+}
+
+func TestCalendarWindows(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	srv := newCalendarServer(maintenanceCalendar)
+	defer srv.Close()
+
+	tests := []struct {
+		name       string
+		categories []string
+		summary    string
+		now        time.Time
+		want       []string
+	}{
+		{
+			name:       "category and summary",
+			categories: []string{"maintenance"},
+			summary:    "~(?i).*(upgrade|deploy).*",
+			now:        time.Date(2026, 10, 21, 12, 0, 0, 0, berlin),
+			want: []string{
+				"Datacenter upgrade (2026-10-20 00:00 CEST) until 10-22 00:00: api,web,db-1",
+				"DB upgrade (2026-10-20 20:00 CEST) until 10-20 22:00: db-1",
+				"Weekly deploy (moved) (2026-10-20 23:00 CEST) until 10-21 00:00: api,web",
+			},
+		},
+		{
+			name:    "any category",
+			summary: "~(?i).*lunch.*",
+			now:     time.Date(2026, 10, 20, 12, 30, 0, 0, berlin),
+			want:    []string{"Upgrade lunch (2026-10-20 12:00 CEST) until 10-20 13:00: api"},
+		},
+		{
+			name:       "any summary",
+			categories: []string{"Social", "Ops"},
+			now:        time.Date(2026, 10, 20, 12, 30, 0, 0, berlin),
+			want: []string{
+				"Upgrade lunch (2026-10-20 12:00 CEST) until 10-20 13:00: api",
+			},
+		},
+		{
+			name:       "recurring event",
+			categories: []string{"ops"},
+			now:        time.Date(2026, 10, 27, 6, 30, 0, 0, berlin),
+			want: []string{
+				"Weekly deploy (2026-10-27 06:00 CET) until 10-27 07:00: api,web",
+			},
+		},
+		{
+			name:       "ended more than a day ago",
+			categories: []string{"maintenance"},
+			summary:    "DB upgrade",
+			now:        time.Date(2026, 10, 21, 22, 0, 0, 0, berlin),
+		},
+		{
+			name:       "not started yet",
+			categories: []string{"maintenance"},
+			summary:    "DB upgrade",
+			now:        time.Date(2026, 10, 20, 19, 0, 0, 0, berlin),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &Calendar{URL: srv.URL, Categories: tt.categories, Summary: mustParsePattern(t, tt.summary)}
+			if err := c.Fetch(); err != nil {
+				t.Fatalf("Fetch: %v", err)
+			}
+			got := windowNames(c.Windows(tt.now), "api", "web", "db-1")
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("windows are\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestCalendarFetchKeepsEventsOnError(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	now := time.Date(2026, 10, 20, 21, 0, 0, 0, berlin)
+	srv := newCalendarServer(maintenanceCalendar)
+	defer srv.Close()
+
+	c := &Calendar{URL: srv.URL, Summary: mustParsePattern(t, "DB upgrade"), Refresh: Duration(time.Millisecond)}
+	if err := c.Fetch(); err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	want := "DB upgrade (2026-10-20 20:00 CEST) until 10-20 22:00: db-1"
+
+	for _, tt := range []struct {
+		status int
+		body   string
+		err    string
+	}{
+		{http.StatusInternalServerError, "oops", "unexpected status 500 Internal Server Error"},
+		{http.StatusOK, ics("BEGIN:VEVENT", "UID:1", "END:VEVENT"), "has no DTSTART"},
+	} {
+		srv.serve(tt.status, tt.body)
+		if err := c.Fetch(); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Fatalf("Fetch returned %v, want an error containing %q", err, tt.err)
+		}
+		if got := windowNames(c.Windows(now), "db-1"); strings.Join(got, "\n") != want {
+			t.Fatalf("windows after a failed fetch are %q, want %q", got, want)
+		}
+	}
+
+	// Run keeps fetching after errors and picks up the fixed calendar.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.Run(stop)
+		close(done)
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	fetched := srv.fetched()
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.fetched() < fetched+3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Run fetched %d times, want at least 3", srv.fetched()-fetched)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got := windowNames(c.Windows(now), "db-1"); strings.Join(got, "\n") != want {
+		t.Fatalf("windows while fetching fails are %q, want %q", got, want)
+	}
+
+	srv.serve(http.StatusOK, strings.Replace(maintenanceCalendar, "DTEND:20261020T220000", "DTEND:20261020T230000", 1))
+	want = "DB upgrade (2026-10-20 20:00 CEST) until 10-20 23:00: db-1"
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		got := windowNames(c.Windows(now), "db-1")
+		if strings.Join(got, "\n") == want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("windows after the calendar was fixed are %q, want %q", got, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCalendarFetchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upmail-calendar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "changes.ics")
+	if err := ioutil.WriteFile(file, []byte(maintenanceCalendar), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, url := range []string{file, "file://" + file} {
+		c := &Calendar{URL: url, Summary: mustParsePattern(t, "DB upgrade"), TimeZone: "UTC"}
+		if err := c.Fetch(); err != nil {
+			t.Fatalf("Fetch %s: %v", url, err)
+		}
+		// time_zone overrides the zone of the calendar.
+		got := windowNames(c.Windows(time.Date(2026, 10, 20, 21, 0, 0, 0, time.UTC)), "db-1")
+		if want := "DB upgrade (2026-10-20 20:00 UTC) until 10-20 22:00: db-1"; strings.Join(got, "\n") != want {
+			t.Fatalf("windows of %s are %q, want %q", url, got, want)
+		}
+	}
+
+	c := &Calendar{URL: filepath.Join(dir, "missing.ics")}
+	if err := c.Fetch(); err == nil || !strings.Contains(err.Error(), "opening calendar") {
+		t.Fatalf("Fetch of a missing file returned %v", err)
+	}
+}
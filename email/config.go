@@ -0,0 +1,127 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Config holds the settings of the notifier that are read from the "upmail"
+// key of the checkup config file.
+type Config struct {
+	// Routing maps checks to recipients.
+	Routing Routing `json:"routing"`
+	// Escalations are the escalation policies routes refer to by name.
+	Escalations map[string]EscalationPolicy `json:"escalations,omitempty"`
+	// Schedules are the on-call schedules recipients refer to with
+	// SchedulePrefix.
+	Schedules map[string]Schedule `json:"schedules,omitempty"`
+	// Maintenance are the maintenance windows during which the checks
+	// they match are not emailed about.
+	Maintenance []MaintenanceWindow `json:"maintenance,omitempty"`
+	// Calendars import maintenance windows from iCalendar files.
+	Calendars []*Calendar `json:"calendars,omitempty"`
+	// Thresholds override the global alert and recovery thresholds for
+	// the checks they match.
+	Thresholds []Threshold `json:"thresholds,omitempty"`
+	// OAuth2 holds the OAuth2 client credentials for the xoauth2 SMTP auth
+	// mechanism.
+	OAuth2 *OAuth2Config `json:"oauth2,omitempty"`
+	// MailgunHeaders are custom headers added to every email sent through
+	// Mailgun.
+	MailgunHeaders map[string]string `json:"mailgun_headers,omitempty"`
+}
+
+// ParseConfig reads the "upmail" key of a checkup config file. A config
+// without that key results in an empty Config.
+func ParseConfig(b []byte) (Config, error) {
+	var file struct {
+		Upmail Config `json:"upmail"`
+	}
+	if err := json.Unmarshal(b, &file); err != nil {
+		return Config{}, fmt.Errorf("parsing upmail config failed: %v", err)
+	}
+
+	for _, route := range file.Upmail.Routing.Routes {
+		if route.Escalation == "" {
+			continue
+		}
+		if _, ok := file.Upmail.Escalations[route.Escalation]; !ok {
+			return Config{}, fmt.Errorf("route refers to unknown escalation policy %q", route.Escalation)
+		}
+	}
+
+	for name, s := range file.Upmail.Schedules {
+		if err := s.Validate(); err != nil {
+			return Config{}, fmt.Errorf("schedule %s: %v", name, err)
+		}
+	}
+	names := map[string]bool{}
+	for _, w := range file.Upmail.Maintenance {
+		if err := w.Validate(); err != nil {
+			return Config{}, err
+		}
+		if names[w.Name] {
+			return Config{}, fmt.Errorf("duplicate maintenance window %s", w.Name)
+		}
+		names[w.Name] = true
+	}
+	for _, c := range file.Upmail.Calendars {
+		if err := c.Validate(); err != nil {
+			return Config{}, err
+		}
+	}
+	for _, rcpt := range file.Upmail.recipients() {
+		if name, ok := scheduleName(rcpt); ok {
+			if _, ok := file.Upmail.Schedules[name]; !ok {
+				return Config{}, fmt.Errorf("recipient %s refers to unknown schedule %q", rcpt, name)
+			}
+		}
+	}
+
+	return file.Upmail, nil
+}
+
+// recipients returns every recipient of the routes and escalation policies
+// of c, with schedule references left as they are.
+func (c Config) recipients() []string {
+	rcpts := append([]string(nil), c.Routing.Default...)
+	for _, route := range c.Routing.Routes {
+		rcpts = append(rcpts, route.Recipients...)
+	}
+	for _, policy := range c.Escalations {
+		for _, step := range policy.Steps {
+			rcpts = append(rcpts, step.Recipients...)
+		}
+	}
+	for _, w := range c.Maintenance {
+		rcpts = append(rcpts, w.Recipients...)
+	}
+	for _, cal := range c.Calendars {
+		rcpts = append(rcpts, cal.Recipients...)
+	}
+	return rcpts
+}
+
+// Duration is a time.Duration that is written as a string such as "15m" in
+// the config file.
+type Duration time.Duration
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q: %v", s, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -0,0 +1,187 @@
+package email
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/checkup"
+)
+
+// DigestDelivery records the recipients that got a status change of a
+// check in a digest.
+type DigestDelivery struct {
+	// Status is the status the check changed to.
+	Status checkup.StatusText `json:"status"`
+	// Recipients are the recipients that got the change.
+	Recipients []string `json:"recipients"`
+}
+
+// sendDigests sends a single email per group of recipients listing every
+// unhealthy result of a check run that is routed to them, along with the
+// checks that recovered in it. Recipients only get a digest if at least one
+// of their checks changed status. A change is only committed once every
+// recipient got it; until then the recipients that already got it are not
+// sent it again.
+func (n *Notifier) sendDigests(results []checkup.Result, pending []notification, now time.Time) error {
+	// Collect the checks routed to every recipient.
+	byRecipient := map[string][]string{}
+	// changes maps every recipient to the keys of the changes it still
+	// needs to get.
+	changes := map[string]map[string]bool{}
+	for _, p := range pending {
+		delivered := n.digested(p)
+		for _, rcpt := range n.recipients(p) {
+			if delivered[rcpt] {
+				// Still listed with the other unhealthy checks.
+				if p.kind == kindAlert {
+					byRecipient[rcpt] = append(byRecipient[rcpt], p.key)
+				}
+				continue
+			}
+			byRecipient[rcpt] = append(byRecipient[rcpt], p.key)
+			if changes[rcpt] == nil {
+				changes[rcpt] = map[string]bool{}
+			}
+			changes[rcpt][p.key] = true
+		}
+	}
+	for _, r := range results {
+		if r.Status() == checkup.Healthy {
+			continue
+		}
+		key := StateKey(r)
+		if isPending(pending, key) {
+			continue
+		}
+		// Checks below their alert threshold are not reported yet.
+		if cs, ok := n.state.Checks[key]; !ok || cs.Status == "" || cs.Status == checkup.Healthy {
+			continue
+		}
+		if _, ok := n.muted(r, now); ok {
+			continue
+		}
+		for _, rcpt := range n.Routing.Recipients(r, r.Status()) {
+			byRecipient[rcpt] = append(byRecipient[rcpt], key)
+		}
+	}
+
+	// Recipients that get the same set of checks share one email.
+	groups := map[string][]string{}
+	for rcpt, keys := range byRecipient {
+		if len(changes[rcpt]) == 0 {
+			continue
+		}
+		sort.Strings(keys)
+		id := strings.Join(keys, "\x00")
+		groups[id] = append(groups[id], rcpt)
+	}
+
+	failed := map[string]bool{}
+	sent := map[string][]string{}
+	var errs checkup.Errors
+	for id, rcpts := range groups {
+		keys := map[string]bool{}
+		for _, key := range strings.Split(id, "\x00") {
+			keys[key] = true
+		}
+
+		err := n.sendDigest(results, pending, keys, rcpts, now)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("digest to %s: %v", strings.Join(rcpts, ", "), err))
+		}
+		for _, rcpt := range rcpts {
+			for key := range changes[rcpt] {
+				if err != nil {
+					failed[key] = true
+				} else {
+					sent[key] = append(sent[key], rcpt)
+				}
+			}
+		}
+	}
+
+	for _, p := range pending {
+		if !failed[p.key] {
+			n.state.Checks[p.key] = p.next
+			continue
+		}
+
+		// Checks whose digest could not be sent to everyone keep their
+		// old state so they are reported again on the next run, but only
+		// to the recipients that did not get them yet.
+		cs := n.state.Checks[p.key]
+		delivered := n.digested(p)
+		for _, rcpt := range sent[p.key] {
+			delivered[rcpt] = true
+		}
+		d := &DigestDelivery{Status: p.next.Status}
+		for rcpt := range delivered {
+			d.Recipients = append(d.Recipients, rcpt)
+		}
+		sort.Strings(d.Recipients)
+		cs.Digested = d
+	}
+	if !errs.Empty() {
+		return errs
+	}
+
+	return nil
+}
+
+// digested returns the recipients that already got the status change of p
+// in a digest.
+func (n *Notifier) digested(p notification) map[string]bool {
+	delivered := map[string]bool{}
+	cs, ok := n.state.Checks[p.key]
+	if !ok || cs.Digested == nil || cs.Digested.Status != p.next.Status {
+		return delivered
+	}
+	for _, rcpt := range cs.Digested.Recipients {
+		delivered[rcpt] = true
+	}
+	return delivered
+}
+
+// sendDigest sends the digest covering the checks in keys to rcpts.
+func (n *Notifier) sendDigest(results []checkup.Result, pending []notification, keys map[string]bool, rcpts []string, now time.Time) error {
+	data := newTemplateData(TemplateDigest, now)
+
+	prev := map[string]*CheckState{}
+	for _, p := range pending {
+		if !keys[p.key] {
+			continue
+		}
+		prev[p.key] = p.prev
+		if p.kind == kindRecovery {
+			data.Resolved = append(data.Resolved, newCheckData(p.result, p.prev, now))
+		}
+	}
+
+	for _, r := range results {
+		key := StateKey(r)
+		if r.Status() == checkup.Healthy || !keys[key] {
+			continue
+		}
+		cs, ok := prev[key]
+		if !ok {
+			cs = n.state.Checks[key]
+		}
+		data.Unhealthy = append(data.Unhealthy, newCheckData(r, cs, now))
+	}
+
+	sort.Strings(rcpts)
+	return n.sendTemplate(data, rcpts)
+}
+
+// isPending reports whether the check identified by key has a pending
+// notification.
+func isPending(pending []notification, key string) bool {
+	for _, p := range pending {
+		if p.key == key {
+			return true
+		}
+	}
+	return false
+}
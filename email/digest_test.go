@@ -0,0 +1,217 @@
+package email
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/checkup"
+)
+
+// digestSubject lists the checks of a digest in its subject.
+const digestSubject = `{{range .Unhealthy}}{{.Result.Title}}={{.Status}} {{end}}{{range .Resolved}}{{.Result.Title}}=resolved {{end}}`
+
+// digestTemplates returns the default templates with digestSubject.
+func digestTemplates(t *testing.T) *Templates {
+	dir, err := ioutil.TempDir("", "upmail-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, TemplateDigest+".subject.tmpl"), []byte(digestSubject), 0600); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := LoadTemplates(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return templates
+}
+
+func TestSendDigests(t *testing.T) {
+	templates := digestTemplates(t)
+
+	tr := &fakeTransport{}
+	n := &Notifier{
+		Transports: []Transport{tr},
+		Templates:  templates,
+		Grouped:    true,
+		AlertAfter: 1,
+		Routing: Routing{Routes: []Route{
+			{Title: mustParsePattern(t, "api*"), Recipients: []string{"api@example.com"}},
+			{Recipients: []string{"ops@example.com", "lead@example.com"}},
+		}},
+		Thresholds: []Threshold{{Title: mustParsePattern(t, "db"), AlertAfter: 2}},
+	}
+
+	steps := []struct {
+		name string
+		// run maps the titles to their status in the check run.
+		run  map[string]string
+		down bool
+		want []string
+	}{
+		{
+			name: "all healthy",
+			run:  map[string]string{"api": "up", "web": "up", "db": "up"},
+		},
+		{
+			name: "one digest per group of recipients",
+			run:  map[string]string{"api": "down", "web": "down", "db": "up"},
+			want: []string{
+				"api@example.com: api=down",
+				"lead@example.com,ops@example.com: api=down web=down",
+			},
+		},
+		{
+			name: "unchanged checks send nothing",
+			run:  map[string]string{"api": "down", "web": "down", "db": "up"},
+		},
+		{
+			name: "check below its threshold is not listed",
+			run:  map[string]string{"api": "down", "web": "up", "db": "down"},
+			want: []string{
+				"lead@example.com,ops@example.com: api=down web=resolved",
+			},
+		},
+		{
+			name: "check reaching its threshold",
+			run:  map[string]string{"api": "down", "web": "up", "db": "down"},
+			want: []string{
+				"lead@example.com,ops@example.com: api=down db=down",
+			},
+		},
+		{
+			name: "status change of a check",
+			run:  map[string]string{"api": "degraded", "web": "up", "db": "down"},
+			want: []string{
+				"api@example.com: api=degraded",
+				"lead@example.com,ops@example.com: api=degraded db=down",
+			},
+		},
+		{
+			name: "failed digest is not recorded",
+			run:  map[string]string{"api": "up", "web": "up", "db": "down"},
+			down: true,
+		},
+		{
+			name: "failed digest is sent again",
+			run:  map[string]string{"api": "up", "web": "up", "db": "down"},
+			want: []string{
+				"api@example.com: api=resolved",
+				"lead@example.com,ops@example.com: db=down api=resolved",
+			},
+		},
+	}
+	for _, step := range steps {
+		var results []checkup.Result
+		for _, title := range []string{"api", "web", "db"} {
+			results = append(results, testResult(title, step.run[title]))
+		}
+
+		before := len(tr.delivered())
+		tr.setDown(step.down)
+		err := n.Notify(results)
+		if step.down != (err != nil) {
+			t.Fatalf("%s: Notify returned %v", step.name, err)
+		}
+
+		got := tr.delivered()[before:]
+		sort.Strings(got)
+		if strings.Join(got, "\n") != strings.Join(step.want, "\n") {
+			t.Fatalf("%s: sent\n%s\nwant\n%s", step.name, strings.Join(got, "\n"), strings.Join(step.want, "\n"))
+		}
+	}
+}
+
+// refusingTransport fails the messages to refuse while it is set.
+type refusingTransport struct {
+	*fakeTransport
+	refuse string
+}
+
+func (t *refusingTransport) Send(m *Message) error {
+	for _, rcpt := range m.To {
+		if rcpt == t.refuse {
+			return errors.New("mailbox unavailable")
+		}
+	}
+	return t.fakeTransport.Send(m)
+}
+
+func TestSendDigestsPartialFailure(t *testing.T) {
+	templates := digestTemplates(t)
+
+	steps := []struct {
+		name   string
+		run    map[string]string
+		refuse string
+		want   []string
+	}{
+		{
+			name:   "digest to one group fails",
+			run:    map[string]string{"api": "down", "web": "down"},
+			refuse: "ops@example.com",
+			want:   []string{"api@example.com: api=down"},
+		},
+		{
+			name:   "failed group fails again",
+			run:    map[string]string{"api": "down", "web": "down"},
+			refuse: "ops@example.com",
+		},
+		{
+			name: "only the failed group gets it again",
+			run:  map[string]string{"api": "down", "web": "down"},
+			want: []string{"ops@example.com: api=down web=down"},
+		},
+		{
+			name: "nothing left to send",
+			run:  map[string]string{"api": "down", "web": "down"},
+		},
+		{
+			name:   "recovery fails for one group",
+			run:    map[string]string{"api": "up", "web": "down"},
+			refuse: "ops@example.com",
+			want:   []string{"api@example.com: api=resolved"},
+		},
+		{
+			name: "change delivered before a new change is sent to everyone",
+			run:  map[string]string{"api": "degraded", "web": "down"},
+			want: []string{
+				"api@example.com: api=degraded",
+				"ops@example.com: api=degraded web=down",
+			},
+		},
+	}
+
+	tr := &refusingTransport{fakeTransport: &fakeTransport{}}
+	n := &Notifier{
+		Transports: []Transport{tr},
+		Templates:  templates,
+		Grouped:    true,
+		Routing: Routing{Routes: []Route{
+			{Title: mustParsePattern(t, "api"), Recipients: []string{"api@example.com"}},
+			{Recipients: []string{"ops@example.com"}},
+		}},
+	}
+	for _, step := range steps {
+		results := []checkup.Result{testResult("api", step.run["api"]), testResult("web", step.run["web"])}
+
+		before := len(tr.delivered())
+		tr.refuse = step.refuse
+		err := n.Notify(results)
+		if (step.refuse != "") != (err != nil) {
+			t.Fatalf("%s: Notify returned %v", step.name, err)
+		}
+
+		got := tr.delivered()[before:]
+		sort.Strings(got)
+		if strings.Join(got, "\n") != strings.Join(step.want, "\n") {
+			t.Fatalf("%s: sent\n%s\nwant\n%s", step.name, strings.Join(got, "\n"), strings.Join(step.want, "\n"))
+		}
+	}
+}
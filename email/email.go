@@ -2,77 +2,505 @@ package email
 
 import (
 	"fmt"
-	"net/smtp"
+	"sync"
 	"time"
 
-	mailgun "github.com/mailgun/mailgun-go"
 	"github.com/sirupsen/logrus"
 	"github.com/sourcegraph/checkup"
 )
 
 // Notifier sends an email notification when something is wrong.
 type Notifier struct {
-	// MailgunAPIKey stores the API key for Mailgun if configured.
-	MailgunAPIKey string
-	// MailgunDomain stores the domain for Mailgun if configured.
-	MailgunDomain string
-	// Recipient is the email address to send the notification to.
-	Recipient string
-	// Server is the email server.
-	Server string
+	// Routing decides which email addresses the notifications about a
+	// check are sent to.
+	Routing Routing
 	// Sender is the email address to send the notification from.
 	Sender string
-	// Auth holds the authentication details for the email server.
-	Auth smtp.Auth
+	// Transports are tried in order until one delivers a message.
+	Transports []Transport
+	// StateFile is where the last known status of every check is persisted.
+	// If empty, the state is only kept in memory.
+	StateFile string
+	// Templates are the templates used to render the emails. If nil, the
+	// embedded defaults are used.
+	Templates *Templates
+	// Outbox queues the messages that could not be delivered for retries.
+	// If nil, failed messages are reported to checkup and retried with the
+	// next check run.
+	Outbox *Outbox
+	// Grouped sends a single digest email per check run covering every
+	// unhealthy result instead of one email per changed check.
+	Grouped bool
+	// AlertAfter is the number of consecutive unhealthy results of a check
+	// before an alert is sent. Values below 1 mean 1.
+	AlertAfter int
+	// RecoverAfter is the number of consecutive healthy results of a check
+	// before a recovery is sent. Values below 1 mean 1.
+	RecoverAfter int
+	// Thresholds override AlertAfter and RecoverAfter for the checks they
+	// match.
+	Thresholds []Threshold
+	// FlapWindow is the number of recent results flap detection looks at.
+	// Values below 2 disable flap detection.
+	FlapWindow int
+	// FlapHigh is the percentage of status changes within FlapWindow at
+	// which a check starts flapping. Zero means DefaultFlapHigh.
+	FlapHigh float64
+	// FlapLow is the percentage of status changes within FlapWindow below
+	// which a flapping check is stable again. Zero means DefaultFlapLow.
+	FlapLow float64
+	// Reminders are the intervals at which reminders are sent while a
+	// check stays in an unhealthy status. Statuses without an interval get
+	// no reminders.
+	Reminders map[checkup.StatusText]time.Duration
+	// Escalations are the escalation policies routes can refer to by
+	// name.
+	Escalations map[string]EscalationPolicy
+	// AckFile is the file "upmail ack" writes acknowledgments to.
+	AckFile string
+	// Schedules are the on-call schedules recipients can refer to with
+	// SchedulePrefix.
+	Schedules map[string]Schedule
+	// Maintenance are the maintenance windows during which the checks
+	// they match are not emailed about.
+	Maintenance []MaintenanceWindow
+	// Calendars import more maintenance windows from iCalendar files.
+	Calendars []*Calendar
+	// SilenceFile is the file "upmail silence" manages the silences in.
+	SilenceFile string
+
+	mu    sync.Mutex
+	state *State
+	// windows are the maintenance windows of the current run.
+	windows []MaintenanceWindow
+	// silences are the silences of the current run.
+	silences *Silences
+	// acks are the acknowledgments last read from AckFile.
+	acks *Acks
 }
 
-// Notify checks the health status of the result and sends an email if
-// something is not healthy.
-func (n Notifier) Notify(results []checkup.Result) error {
-	for _, r := range results {
-		if !r.Healthy {
-			logrus.Debugf("%s is %s: sending email", r.Title, r.Status())
-			if err := n.sendEmail(r); err != nil {
-				return err
+// Notify compares the health status of every result with the last known
+// status of its check and sends an email when a check becomes unhealthy,
+// changes from one unhealthy status to another or recovers. In grouped mode
+// a single digest email covers the whole check run.
+func (n *Notifier) Notify(results []checkup.Result) (err error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.state == nil {
+		n.state, err = LoadState(n.StateFile)
+		if err != nil {
+			return err
+		}
+	}
+	defer func() {
+		if serr := n.state.Save(n.StateFile); serr != nil && err == nil {
+			err = serr
+		}
+	}()
+
+	now := time.Now()
+	n.windows = n.maintenanceWindows(now)
+	if silences, err := LoadSilences(n.SilenceFile); err != nil {
+		logrus.Warnf("keeping the previous silences: %v", err)
+	} else {
+		n.silences = silences
+	}
+	pending := n.suppress(n.evaluate(results, now), now)
+
+	var errs checkup.Errors
+	if n.Grouped {
+		// Flapping checks and reminders are reported on their own, the
+		// digests cover the status changes.
+		var changes, others []notification
+		for _, p := range pending {
+			if p.kind == kindAlert || p.kind == kindRecovery {
+				changes = append(changes, p)
+			} else {
+				others = append(others, p)
+			}
+		}
+		if len(changes) > 0 {
+			logrus.Debugf("sending digest emails for %d changed checks", len(changes))
+			if err := n.sendDigests(results, changes, now); err != nil {
+				errs = append(errs, err)
 			}
-		} else {
-			logrus.Debugf("%s is %s", r.Title, r.Status())
 		}
+		pending = others
+	}
+
+	for _, p := range pending {
+		var err error
+		switch p.kind {
+		case kindAlert:
+			err = n.sendAlert(p, now)
+		case kindRecovery:
+			err = n.sendRecovery(p, now)
+		case kindFlapping, kindStable:
+			err = n.sendFlapping(p, now)
+		case kindReminder:
+			err = n.sendReminder(p, now)
+		}
+		if err != nil {
+			// Leave the state untouched so the email is retried on the
+			// next run.
+			errs = append(errs, fmt.Errorf("%s: %v", p.result.Title, err))
+			continue
+		}
+		n.state.Checks[p.key] = p.next
+	}
+
+	if err := n.escalate(results, now); err != nil {
+		errs = append(errs, err)
+	}
+	if err := n.notifyMaintenance(results, now); err != nil {
+		errs = append(errs, err)
+	}
+	n.state.prune(results, now)
+	if !errs.Empty() {
+		return errs
 	}
 
 	return nil
 }
 
-func (n Notifier) sendEmail(result checkup.Result) error {
-	if n.MailgunAPIKey != "" && n.MailgunDomain != "" {
-		mailgunClient := mailgun.NewMailgun(n.MailgunDomain, n.MailgunAPIKey, "")
+// muted returns why notifications about r are muted at now by a maintenance
+// window or a silence, if they are.
+func (n *Notifier) muted(r checkup.Result, now time.Time) (string, bool) {
+	if w, ok := n.maintenance(r, now); ok {
+		return "maintenance " + w.Name, true
+	}
+	if s := n.silences.find(r, now); s != nil {
+		return "silence " + s.ID, true
+	}
+	return "", false
+}
 
-		msg, _, err := mailgunClient.Send(mailgunClient.NewMessage(
-			/* From */ fmt.Sprintf("%s <%s>", n.Sender, n.Sender),
-			/* Subject */ fmt.Sprintf("[UPMAIL]: %s %s", result.Title, result.Status()),
-			/* Body */ fmt.Sprintf("Time: %s\n\n%s", time.Now().Format(time.UnixDate), result.String()),
-			/* To */ n.Recipient,
-		))
-		if err != nil {
-			return fmt.Errorf("sending Mailgun message failed: response: %#v error: %v", msg, err)
+// suppress drops the notifications of muted checks. Their state is left
+// untouched, so once they are no longer muted the next run emails whatever
+// changed in the meantime, such as an alert for a check that is still down.
+func (n *Notifier) suppress(pending []notification, now time.Time) []notification {
+	var kept []notification
+	for _, p := range pending {
+		if reason, ok := n.muted(p.result, now); ok {
+			logrus.Infof("%s is %s: not sending email, muted by %s", p.result.Title, p.result.Status(), reason)
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+// kind is the kind of a notification.
+type kind int
+
+const (
+	kindAlert kind = iota
+	kindRecovery
+	kindFlapping
+	kindStable
+	kindReminder
+)
+
+// notification is a pending state change of a single check that may need an
+// email.
+type notification struct {
+	kind   kind
+	key    string
+	result checkup.Result
+	prev   *CheckState
+	next   *CheckState
+}
+
+// evaluate compares results against the persisted state. The consecutive
+// healthy and unhealthy results of every check are counted, and a status
+// change is only notified once it lasted for the threshold of the check.
+// Checks whose notified status did not change are left alone; state changes
+// that do not need an email are applied directly and the others are
+// returned so they are only recorded once the email went out.
+func (n *Notifier) evaluate(results []checkup.Result, now time.Time) []notification {
+	var pending []notification
+	for _, r := range results {
+		status := r.Status()
+		key := StateKey(r)
+
+		cs, ok := n.state.Checks[key]
+		if !ok {
+			// Checks seen for the first time have no notified status
+			// until they reach their threshold.
+			cs = &CheckState{
+				Title:    r.Title,
+				Endpoint: r.Endpoint,
+				Since:    now,
+			}
+			n.state.Checks[key] = cs
+		}
+		if status == checkup.Healthy {
+			cs.Successes++
+			cs.Failures = 0
+			if cs.OutageStart.IsZero() {
+				cs.FailedRuns = 0
+			}
+		} else {
+			cs.Failures++
+			cs.FailedRuns++
+			cs.Successes = 0
+		}
+
+		// A digest delivery of a change that is no longer pending is
+		// stale.
+		if cs.Digested != nil && cs.Digested.Status != status {
+			cs.Digested = nil
+		}
+
+		var prev *CheckState
+		if ok {
+			prev = cs
+		}
+
+		if n.FlapWindow > 1 {
+			cs.History = append(cs.History, status)
+			if len(cs.History) > n.FlapWindow {
+				cs.History = append([]checkup.StatusText(nil), cs.History[len(cs.History)-n.FlapWindow:]...)
+			}
+			if p, handled := n.evaluateFlapping(r, key, cs, prev, now); handled {
+				if p != nil {
+					pending = append(pending, *p)
+				}
+				continue
+			}
+		}
+
+		if cs.Status == status {
+			if p, ok := n.evaluateReminder(r, key, cs, now); ok {
+				pending = append(pending, *p)
+				continue
+			}
+			logrus.Debugf("%s is still %s", r.Title, status)
+			continue
+		}
+
+		p := notification{
+			key:    key,
+			result: r,
+			prev:   prev,
+			next: &CheckState{
+				Title:      r.Title,
+				Endpoint:   r.Endpoint,
+				Status:     status,
+				Since:      now,
+				Failures:   cs.Failures,
+				Successes:  cs.Successes,
+				FailedRuns: cs.FailedRuns,
+				History:    cs.History,
+			},
 		}
-		logrus.Infof("Mailgun send message succeeded: %#v", msg)
+
+		alertAfter, recoverAfter := n.thresholds(r)
+		switch {
+		case status != checkup.Healthy:
+			if cs.Failures < alertAfter {
+				logrus.Debugf("%s is %s (%d of %d results): not alerting yet", r.Title, status, cs.Failures, alertAfter)
+				continue
+			}
+			p.kind = kindAlert
+			p.next.OutageStart = now
+			if !cs.OutageStart.IsZero() {
+				p.next.OutageStart = cs.OutageStart
+				p.next.Escalation = cs.Escalation
+			}
+			logrus.Debugf("%s is %s: sending email", r.Title, status)
+		case !cs.OutageStart.IsZero():
+			if cs.Successes < recoverAfter {
+				logrus.Debugf("%s is %s (%d of %d results): not recovering yet", r.Title, status, cs.Successes, recoverAfter)
+				continue
+			}
+			p.kind = kindRecovery
+			p.next.FailedRuns = 0
+			logrus.Debugf("%s recovered after %s: sending email", r.Title, now.Sub(cs.OutageStart))
+		default:
+			logrus.Debugf("%s is %s", r.Title, status)
+			n.state.Checks[key] = p.next
+			continue
+		}
+
+		p.next.Notified = now
+		pending = append(pending, p)
+	}
+
+	return pending
+}
+
+// recipients returns the recipients of a notification. Healthy checks are
+// routed like the unhealthy status they were last notified with so that
+// recoveries reach everyone who got the alert. Everyone the outage was
+// escalated to is notified as well.
+func (n *Notifier) recipients(p notification) []string {
+	status := p.result.Status()
+	if status == checkup.Healthy && p.prev != nil && p.prev.Status != "" {
+		status = p.prev.Status
+	}
+	rcpts := n.Routing.Recipients(p.result, status)
+	if escalated := n.escalated(p.prev); len(escalated) > 0 {
+		rcpts = uniqueAddresses(append(rcpts, escalated...))
+	}
+	return rcpts
+}
+
+// sendAlert sends an email about a check that became unhealthy.
+func (n *Notifier) sendAlert(p notification, now time.Time) error {
+	data := newTemplateData(TemplateAlert, now)
+	data.CheckData = newCheckData(p.result, p.prev, now)
+	return n.sendTemplate(data, n.recipients(p))
+}
+
+// sendRecovery sends an email about a check that became healthy again after
+// the outage recorded in p.prev.
+func (n *Notifier) sendRecovery(p notification, now time.Time) error {
+	data := newTemplateData(TemplateRecovery, now)
+	data.CheckData = newCheckData(p.result, p.prev, now)
+	return n.sendTemplate(data, n.recipients(p))
+}
+
+// sendTemplate renders the templates for data and sends the result to the
+// recipients.
+func (n *Notifier) sendTemplate(data TemplateData, recipients []string) error {
+	recipients = n.resolveRecipients(recipients, data.Time)
+	if len(recipients) == 0 {
+		logrus.Warnf("no recipients for %s email about %q, dropping it", data.Kind, data.Result.Title)
 		return nil
 	}
 
-	// create the template
-	body := fmt.Sprintf(`From: %s
-To: %s
-Subject: [UPMAIL]: %s %s
-%s
+	if n.Templates == nil {
+		n.Templates = DefaultTemplates()
+	}
+
+	c, err := n.Templates.render(data)
+	if err != nil {
+		return err
+	}
+
+	m := NewMessage(n.Sender, recipients, c.subject, c.text, c.html)
+	m.Tags, m.Variables = data.metadata()
+	return n.deliver(m)
+}
 
-Time: %s
-`, n.Sender, n.Recipient, result.Title, result.Status(), result.String(), time.Now().Format(time.UnixDate))
+// deliver sends m. If that fails and an outbox is configured, m is queued
+// for a retry instead of failing. While older messages are queued, m is sent
+// after them once they are due, and otherwise queued behind them.
+func (n *Notifier) deliver(m *Message) error {
+	if n.Outbox != nil && n.Outbox.Len() > 0 {
+		// Older messages go first, so that a recovery cannot overtake
+		// the alert it resolves. Only retry them once their backoff has
+		// passed, so that an outage does not hit the transport with every
+		// new message.
+		n.retry(n.Outbox.Due(time.Now()))
+		if depth := n.Outbox.Len(); depth > 0 {
+			err := fmt.Errorf("queued behind %d earlier messages", depth)
+			if qerr := n.Outbox.Add(m, err, time.Now()); qerr != nil {
+				logrus.Errorf("queueing message %s failed: %v", m.MessageID, qerr)
+				return err
+			}
+			logrus.Warnf("%s, queued %q (outbox depth: %d)", err, m.Subject, n.Outbox.Len())
+			return nil
+		}
+	}
 
-	// send the email
-	if err := smtp.SendMail(n.Server, n.Auth, n.Sender, []string{n.Recipient}, []byte(body)); err != nil {
-		return fmt.Errorf("send mail failed: %v", err)
+	err := n.transport().Send(m)
+	if err == nil || n.Outbox == nil {
+		return err
 	}
 
+	if qerr := n.Outbox.Add(m, err, time.Now()); qerr != nil {
+		logrus.Errorf("queueing message %s failed: %v", m.MessageID, qerr)
+		return err
+	}
+	logrus.Warnf("sending %q failed, queued it for a retry (outbox depth: %d): %v", m.Subject, n.Outbox.Len(), err)
+
 	return nil
 }
+
+// RetryOutbox retries the messages in the outbox that are due every
+// interval until stop is closed. Retries hold the lock of the notifier, so
+// they never run concurrently with a check run or FlushOutbox.
+func (n *Notifier) RetryOutbox(interval time.Duration, stop <-chan struct{}) {
+	if n.Outbox == nil {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			n.mu.Lock()
+			select {
+			case <-stop:
+				// FlushOutbox takes over on shutdown.
+				n.mu.Unlock()
+				return
+			default:
+			}
+			n.retry(n.Outbox.Due(now))
+			n.mu.Unlock()
+		}
+	}
+}
+
+// FlushOutbox makes a last delivery attempt for every queued message, for
+// example on shutdown. It waits for a retry or check run in progress, and
+// once stop was closed RetryOutbox does not start another retry. Messages
+// that still fail stay in the outbox and are retried on the next start.
+func (n *Notifier) FlushOutbox() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.Outbox == nil || n.Outbox.Len() == 0 {
+		return
+	}
+
+	logrus.Infof("flushing outbox (depth: %d)", n.Outbox.Len())
+	n.retry(n.Outbox.All())
+	if depth := n.Outbox.Len(); depth > 0 {
+		logrus.Warnf("%d messages remain in the outbox %s", depth, n.Outbox.Dir)
+	}
+}
+
+// retry attempts to deliver the queued messages with the given IDs in
+// order. It stops at the first message that fails again, so that the
+// messages behind it keep their order. n.mu must be held.
+func (n *Notifier) retry(ids []string) {
+	for _, id := range ids {
+		m := n.Outbox.Message(id)
+		if m == nil {
+			continue
+		}
+
+		now := time.Now()
+		if err := n.transport().Send(m); err != nil {
+			dropped, qerr := n.Outbox.Failed(id, err, now)
+			if qerr != nil {
+				logrus.Errorf("updating outbox failed: %v", qerr)
+			}
+			if dropped {
+				logrus.Errorf("giving up on %q after %s (outbox depth: %d): %v", m.Subject, n.Outbox.maxAge(), n.Outbox.Len(), err)
+				continue
+			}
+			logrus.Warnf("retrying %q failed (outbox depth: %d): %v", m.Subject, n.Outbox.Len(), err)
+			return
+		}
+
+		if err := n.Outbox.Delivered(id); err != nil {
+			logrus.Errorf("updating outbox failed: %v", err)
+		}
+		logrus.Infof("delivered queued message %q (outbox depth: %d)", m.Subject, n.Outbox.Len())
+	}
+}
+
+// transport returns the transport chain of the notifier.
+func (n *Notifier) transport() Transport {
+	return Chain(n.Transports)
+}
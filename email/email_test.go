@@ -0,0 +1,112 @@
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/checkup"
+)
+
+func TestNotifyRecovery(t *testing.T) {
+	tests := []struct {
+		name   string
+		status string
+	}{
+		{"down", "down"},
+		{"degraded", "degraded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &fakeTransport{}
+			n := &Notifier{
+				Transports: []Transport{tr},
+				Routing:    Routing{Default: []string{"ops@example.com"}},
+			}
+
+			if err := n.Notify([]checkup.Result{testResult("api", tt.status)}); err != nil {
+				t.Fatalf("Notify: %v", err)
+			}
+			if got := tr.subjects(); len(got) != 1 {
+				t.Fatalf("sent %q, want an alert", got)
+			}
+
+			// Pretend the outage started 90 minutes ago.
+			start := time.Now().Add(-90 * time.Minute)
+			n.state.Checks[StateKey(testResult("api", "up"))].OutageStart = start
+
+			r := testResult("api", "up")
+			r.ThresholdRTT = 25 * time.Millisecond
+			r.Times = checkup.Attempts{
+				{RTT: 30 * time.Millisecond},
+				{RTT: 10 * time.Millisecond},
+				{RTT: 20 * time.Millisecond},
+				{RTT: 40 * time.Millisecond},
+			}
+			if err := n.Notify([]checkup.Result{r}); err != nil {
+				t.Fatalf("Notify: %v", err)
+			}
+
+			msgs := tr.messages()
+			if len(msgs) != 2 {
+				t.Fatalf("sent %q, want an alert and a recovery", tr.subjects())
+			}
+			m := msgs[1]
+			if m.Subject != "[UPMAIL]: api resolved" {
+				t.Fatalf("subject is %q, want the recovery", m.Subject)
+			}
+			for _, want := range []string{
+				"== api - https://api.example.com is healthy again",
+				"Outage started: " + start.Format(time.UnixDate),
+				"Outage duration: 1h30m0s",
+				"Previous status: " + tt.status,
+				"Threshold: 25ms",
+				"Max: 40ms",
+				"Min: 10ms",
+				"Median: 25ms",
+				"Mean: 25ms",
+			} {
+				if !strings.Contains(m.Text, want) {
+					t.Errorf("text does not contain %q:\n%s", want, m.Text)
+				}
+			}
+			for _, want := range []string{
+				"for <b>1h30m0s</b> since " + start.Format(time.UnixDate),
+				"<td>40ms</td>",
+				"<td>10ms</td>",
+			} {
+				if !strings.Contains(m.HTML, want) {
+					t.Errorf("HTML does not contain %q:\n%s", want, m.HTML)
+				}
+			}
+
+			// The recovery is only sent once.
+			if err := n.Notify([]checkup.Result{r}); err != nil {
+				t.Fatalf("Notify: %v", err)
+			}
+			if got := tr.subjects(); len(got) != 2 {
+				t.Fatalf("sent %q, want no further email", got)
+			}
+		})
+	}
+}
+
+func TestNotifyNoRecoveryWithoutOutage(t *testing.T) {
+	tr := &fakeTransport{}
+	n := &Notifier{
+		Transports: []Transport{tr},
+		Routing:    Routing{Default: []string{"ops@example.com"}},
+		AlertAfter: 3,
+	}
+
+	// A check that never reached the alert threshold did not have an
+	// outage to recover from.
+	for _, status := range []string{"up", "down", "down", "up", "up"} {
+		if err := n.Notify([]checkup.Result{testResult("api", status)}); err != nil {
+			t.Fatalf("Notify: %v", err)
+		}
+	}
+	if got := tr.subjects(); len(got) != 0 {
+		t.Fatalf("sent %q, want nothing", got)
+	}
+}
@@ -0,0 +1,138 @@
+package email
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sourcegraph/checkup"
+)
+
+// EscalationPolicy notifies more and more recipients while an alert is not
+// acknowledged.
+type EscalationPolicy struct {
+	// Steps are notified in order once their delay passed.
+	Steps []EscalationStep `json:"steps"`
+}
+
+// EscalationStep is a step of an escalation policy.
+type EscalationStep struct {
+	// After is how long after the alert the step is notified.
+	After Duration `json:"after"`
+	// Recipients are the email addresses the step notifies.
+	Recipients []string `json:"recipients"`
+}
+
+// Escalation is the persisted escalation state of an outage.
+type Escalation struct {
+	// Policy is the name of the escalation policy.
+	Policy string `json:"policy"`
+	// Start is when the outage was alerted, the delays of the steps are
+	// relative to it.
+	Start time.Time `json:"start"`
+	// Steps is the number of steps notified so far.
+	Steps int `json:"steps"`
+	// Acknowledged is when the outage was acknowledged. It is zero while
+	// the outage is not acknowledged.
+	Acknowledged time.Time `json:"acknowledged,omitempty"`
+	// AcknowledgedBy is who acknowledged the outage.
+	AcknowledgedBy string `json:"acknowledged_by,omitempty"`
+}
+
+// escalate notifies the escalation steps that are due for every unhealthy
+// check whose route has an escalation policy, until the outage recovers or
+// is acknowledged.
+func (n *Notifier) escalate(results []checkup.Result, now time.Time) error {
+	if len(n.Escalations) == 0 {
+		return nil
+	}
+
+	if acks, err := LoadAcks(n.AckFile); err != nil {
+		logrus.Warnf("keeping the previous acknowledgments: %v", err)
+	} else {
+		n.acks = acks
+	}
+
+	var errs checkup.Errors
+	for _, r := range results {
+		cs, ok := n.state.Checks[StateKey(r)]
+		if !ok || cs.Status == "" || cs.Status == checkup.Healthy || cs.OutageStart.IsZero() || cs.Flapping {
+			continue
+		}
+		if _, ok := n.muted(r, now); ok {
+			continue
+		}
+
+		if cs.Escalation == nil {
+			policy := n.Routing.Escalation(r, cs.Status)
+			if policy == "" {
+				continue
+			}
+			cs.Escalation = &Escalation{
+				Policy: policy,
+				Start:  cs.OutageStart,
+			}
+		}
+
+		e := cs.Escalation
+		if e.Acknowledged.IsZero() {
+			if ack := n.acks.find(r, e.Start); ack != nil {
+				e.Acknowledged = ack.Time
+				e.AcknowledgedBy = ack.By
+				logrus.Infof("%s was acknowledged by %s, stopping escalation %s", r.Title, ack.By, e.Policy)
+			}
+		}
+		if !e.Acknowledged.IsZero() {
+			continue
+		}
+
+		policy, ok := n.Escalations[e.Policy]
+		if !ok {
+			logrus.Warnf("%s refers to unknown escalation policy %q", r.Title, e.Policy)
+			continue
+		}
+		for e.Steps < len(policy.Steps) && now.Sub(e.Start) >= time.Duration(policy.Steps[e.Steps].After) {
+			if err := n.sendEscalation(r, cs, policy, now); err != nil {
+				// The step is retried on the next run.
+				errs = append(errs, fmt.Errorf("%s: escalation step %d: %v", r.Title, e.Steps+1, err))
+				break
+			}
+			e.Steps++
+		}
+	}
+	if !errs.Empty() {
+		return errs
+	}
+
+	return nil
+}
+
+// sendEscalation sends the next step of the escalation of cs.
+func (n *Notifier) sendEscalation(r checkup.Result, cs *CheckState, policy EscalationPolicy, now time.Time) error {
+	data := newTemplateData(TemplateEscalation, now)
+	data.CheckData = newCheckData(r, cs, now)
+	data.EscalationPolicy = cs.Escalation.Policy
+	data.EscalationStep = cs.Escalation.Steps + 1
+	data.EscalationSteps = len(policy.Steps)
+
+	logrus.Debugf("%s is not acknowledged after %s: sending escalation step %d of %s", r.Title, now.Sub(cs.Escalation.Start), data.EscalationStep, cs.Escalation.Policy)
+	return n.sendTemplate(data, uniqueAddresses(policy.Steps[cs.Escalation.Steps].Recipients))
+}
+
+// escalated returns the recipients of the escalation steps of cs notified
+// so far.
+func (n *Notifier) escalated(cs *CheckState) []string {
+	if cs == nil || cs.Escalation == nil {
+		return nil
+	}
+	policy, ok := n.Escalations[cs.Escalation.Policy]
+	if !ok {
+		return nil
+	}
+
+	var rcpts []string
+	for i := 0; i < cs.Escalation.Steps && i < len(policy.Steps); i++ {
+		rcpts = append(rcpts, policy.Steps[i].Recipients...)
+	}
+	return rcpts
+}
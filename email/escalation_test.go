@@ -0,0 +1,206 @@
+package email
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/checkup"
+)
+
+func TestEscalateKeepsAcksWhenFileIsUnreadable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upmail-acks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	ackFile := filepath.Join(dir, "acks.json")
+	acks := &Acks{Acks: []Ack{{Title: "api", By: "alice", Time: start.Add(time.Minute)}}}
+	if err := acks.Save(ackFile); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &fakeTransport{}
+	n := &Notifier{
+		Transports: []Transport{tr},
+		AckFile:    ackFile,
+		Escalations: map[string]EscalationPolicy{
+			"ops": {Steps: []EscalationStep{{After: Duration(5 * time.Minute), Recipients: []string{"lead@example.com"}}}},
+		},
+		state: &State{Checks: map[string]*CheckState{}},
+	}
+
+	// The first run reads the acknowledgment while api is still healthy.
+	if err := n.escalate(nil, start.Add(2*time.Minute)); err != nil {
+		t.Fatalf("escalate: %v", err)
+	}
+
+	// The file breaks before api goes down.
+	if err := ioutil.WriteFile(ackFile, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	r := testResult("api", "down")
+	n.state.Checks[StateKey(r)] = &CheckState{
+		Title:       r.Title,
+		Endpoint:    r.Endpoint,
+		Status:      checkup.Down,
+		OutageStart: start,
+		Escalation:  &Escalation{Policy: "ops", Start: start},
+	}
+	if err := n.escalate([]checkup.Result{r}, start.Add(10*time.Minute)); err != nil {
+		t.Fatalf("escalate failed on an unreadable acknowledgments file: %v", err)
+	}
+
+	e := n.state.Checks[StateKey(r)].Escalation
+	if e.AcknowledgedBy != "alice" {
+		t.Fatalf("outage was not acknowledged with the previous acknowledgments: %+v", e)
+	}
+	if got := tr.subjects(); len(got) != 0 {
+		t.Fatalf("sent %q for an acknowledged outage", got)
+	}
+}
+
+func TestEscalate(t *testing.T) {
+	const (
+		oncall = "oncall@example.com: "
+		lead   = "lead@example.com: "
+		both   = "cto@example.com,lead@example.com: "
+	)
+
+	type run struct {
+		// at is the time of the run since the outage started.
+		at     time.Duration
+		status string
+		// ack acknowledges the outage at the given time since it started
+		// before the run.
+		ack  *time.Duration
+		want []string
+	}
+	ackAt := func(d time.Duration) *time.Duration { return &d }
+
+	tests := []struct {
+		name string
+		runs []run
+	}{
+		{
+			name: "steps fire once after their delay",
+			runs: []run{
+				{at: 0, status: "down", want: []string{oncall + "[UPMAIL]: api down not acknowledged after 0s"}},
+				{at: 10 * time.Minute, status: "down"},
+				{at: 15 * time.Minute, status: "down", want: []string{lead + "[UPMAIL]: api down not acknowledged after 15m0s"}},
+				{at: 30 * time.Minute, status: "down"},
+				{at: 59 * time.Minute, status: "down"},
+				{at: time.Hour, status: "degraded", want: []string{both + "[UPMAIL]: api degraded not acknowledged after 1h0m0s"}},
+				{at: 2 * time.Hour, status: "down"},
+				{at: 24 * time.Hour, status: "down"},
+			},
+		},
+		{
+			name: "late run fires every due step",
+			runs: []run{
+				{at: 0, status: "down", want: []string{oncall + "[UPMAIL]: api down not acknowledged after 0s"}},
+				{at: 2 * time.Hour, status: "down", want: []string{
+					lead + "[UPMAIL]: api down not acknowledged after 2h0m0s",
+					both + "[UPMAIL]: api down not acknowledged after 2h0m0s",
+				}},
+				{at: 3 * time.Hour, status: "down"},
+			},
+		},
+		{
+			name: "recovery stops the escalation",
+			runs: []run{
+				{at: 0, status: "down", want: []string{oncall + "[UPMAIL]: api down not acknowledged after 0s"}},
+				{at: 10 * time.Minute, status: "up"},
+				{at: 15 * time.Minute, status: "up"},
+				{at: 2 * time.Hour, status: "up"},
+				// A new outage starts a new escalation.
+				{at: 3 * time.Hour, status: "down", want: []string{oncall + "[UPMAIL]: api down not acknowledged after 0s"}},
+				{at: 3*time.Hour + 15*time.Minute, status: "down", want: []string{lead + "[UPMAIL]: api down not acknowledged after 15m0s"}},
+			},
+		},
+		{
+			name: "acknowledgment stops the escalation",
+			runs: []run{
+				{at: 0, status: "down", want: []string{oncall + "[UPMAIL]: api down not acknowledged after 0s"}},
+				{at: 10 * time.Minute, status: "down", ack: ackAt(5 * time.Minute)},
+				{at: 15 * time.Minute, status: "down"},
+				{at: 2 * time.Hour, status: "down"},
+			},
+		},
+		{
+			name: "acknowledgment of an earlier outage is ignored",
+			runs: []run{
+				{at: 0, status: "down", ack: ackAt(-time.Hour), want: []string{oncall + "[UPMAIL]: api down not acknowledged after 0s"}},
+				{at: 15 * time.Minute, status: "down", want: []string{lead + "[UPMAIL]: api down not acknowledged after 15m0s"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "upmail-escalation")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			stateFile := filepath.Join(dir, "upmail.state.json")
+			ackFile := filepath.Join(dir, "acks.json")
+
+			tr := &fakeTransport{}
+			start := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+			sent := 0
+			for i, run := range tt.runs {
+				now := start.Add(run.at)
+				if run.ack != nil {
+					acks := &Acks{Acks: []Ack{{Title: "api", By: "alice", Time: start.Add(*run.ack)}}}
+					if err := acks.Save(ackFile); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				// Every run starts from the persisted state, like a
+				// restarted upmail would.
+				state, err := LoadState(stateFile)
+				if err != nil {
+					t.Fatal(err)
+				}
+				n := &Notifier{
+					Transports: []Transport{tr},
+					Routing: Routing{Routes: []Route{
+						{Title: mustParsePattern(t, "api"), Recipients: []string{"ops@example.com"}, Escalation: "ops"},
+					}},
+					Escalations: map[string]EscalationPolicy{
+						"ops": {Steps: []EscalationStep{
+							{After: 0, Recipients: []string{"oncall@example.com"}},
+							{After: Duration(15 * time.Minute), Recipients: []string{"lead@example.com"}},
+							{After: Duration(time.Hour), Recipients: []string{"lead@example.com", "cto@example.com"}},
+						}},
+					},
+					AckFile: ackFile,
+					state:   state,
+				}
+
+				results := []checkup.Result{testResult("api", run.status)}
+				for _, p := range n.evaluate(results, now) {
+					n.state.Checks[p.key] = p.next
+				}
+				if err := n.escalate(results, now); err != nil {
+					t.Fatalf("run %d: escalate: %v", i, err)
+				}
+				if err := n.state.Save(stateFile); err != nil {
+					t.Fatal(err)
+				}
+
+				got := tr.delivered()[sent:]
+				sent += len(got)
+				if strings.Join(got, "\n") != strings.Join(run.want, "\n") {
+					t.Fatalf("run %d (%s, %s): sent\n%s\nwant\n%s", i, run.at, run.status, strings.Join(got, "\n"), strings.Join(run.want, "\n"))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package email
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sourcegraph/checkup"
+)
+
+// Default flap detection thresholds, the same as the defaults of Nagios.
+const (
+	DefaultFlapHigh = 50.0
+	DefaultFlapLow  = 25.0
+)
+
+// flapPercent returns the weighted percentage of status changes in history.
+// Like in Nagios, recent changes weigh more: the weights increase linearly
+// from 0.8 for the oldest to 1.2 for the most recent change.
+func flapPercent(history []checkup.StatusText) float64 {
+	if len(history) < 2 {
+		return 0
+	}
+
+	changes := len(history) - 1
+	total := 0.0
+	for i := 1; i < len(history); i++ {
+		if history[i] == history[i-1] {
+			continue
+		}
+		weight := 0.8
+		if changes > 1 {
+			weight += 0.4 * float64(i-1) / float64(changes-1)
+		}
+		total += weight
+	}
+
+	return total / float64(changes) * 100
+}
+
+// evaluateFlapping detects whether the check cs starts or stops flapping.
+// It reports whether the result was handled, in which case p holds the
+// notification to send, if any. While a check is flapping its status changes
+// are suppressed.
+func (n *Notifier) evaluateFlapping(r checkup.Result, key string, cs, prev *CheckState, now time.Time) (*notification, bool) {
+	high, low := n.FlapHigh, n.FlapLow
+	if high <= 0 {
+		high = DefaultFlapHigh
+	}
+	if low <= 0 {
+		low = DefaultFlapLow
+	}
+
+	percent := flapPercent(cs.History)
+	status := r.Status()
+
+	next := *cs
+	next.History = append([]checkup.StatusText(nil), cs.History...)
+	p := &notification{
+		key:    key,
+		result: r,
+		prev:   prev,
+		next:   &next,
+	}
+
+	switch {
+	case !cs.Flapping && len(cs.History) >= n.FlapWindow && percent >= high:
+		p.kind = kindFlapping
+		next.Flapping = true
+		next.Notified = now
+		logrus.Debugf("%s is flapping (%.0f%% state changes): sending email", r.Title, percent)
+		return p, true
+	case cs.Flapping && percent < low:
+		p.kind = kindStable
+		next.Flapping = false
+		next.Status = status
+		next.Since = now
+		next.Notified = now
+		if status == checkup.Healthy {
+			next.OutageStart = time.Time{}
+			next.Escalation = nil
+		} else if next.OutageStart.IsZero() {
+			next.OutageStart = now
+		}
+		logrus.Debugf("%s stopped flapping (%.0f%% state changes) and is %s: sending email", r.Title, percent, status)
+		return p, true
+	case cs.Flapping:
+		logrus.Debugf("%s is flapping (%.0f%% state changes), it is %s", r.Title, percent, status)
+		return nil, true
+	}
+
+	return nil, false
+}
+
+// sendFlapping sends an email about a check that started or stopped
+// flapping.
+func (n *Notifier) sendFlapping(p notification, now time.Time) error {
+	name := TemplateFlapping
+	if p.kind == kindStable {
+		name = TemplateStable
+	}
+
+	data := newTemplateData(name, now)
+	data.CheckData = newCheckData(p.result, p.prev, now)
+	data.History = p.next.History
+	data.FlapPercent = flapPercent(p.next.History)
+	return n.sendTemplate(data, n.recipients(p))
+}
@@ -0,0 +1,164 @@
+package email
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/checkup"
+)
+
+func TestFlapPercent(t *testing.T) {
+	const (
+		h = checkup.Healthy
+		d = checkup.Down
+		g = checkup.Degraded
+	)
+	tests := []struct {
+		name    string
+		history []checkup.StatusText
+		want    float64
+	}{
+		{name: "empty", want: 0},
+		{name: "single result", history: []checkup.StatusText{d}, want: 0},
+		{name: "stable", history: []checkup.StatusText{h, h, h, h}, want: 0},
+		{name: "one change", history: []checkup.StatusText{h, d}, want: 80},
+		{name: "every result changes", history: []checkup.StatusText{h, d, h, d, h}, want: 100},
+		{name: "recent change weighs more", history: []checkup.StatusText{h, h, h, d}, want: 40},
+		{name: "old change weighs less", history: []checkup.StatusText{d, h, h, h}, want: 80.0 / 3},
+		{name: "down to degraded is a change", history: []checkup.StatusText{d, g, d}, want: 100},
+		{name: "two early changes", history: []checkup.StatusText{h, d, h, h, h}, want: (0.8 + 0.8 + 0.4/3) / 4 * 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := flapPercent(tt.history); math.Abs(got-tt.want) > 1e-9 {
+				t.Fatalf("flapPercent is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotifyFlapping(t *testing.T) {
+	type run struct {
+		status string
+		// want is the subject of the email sent, if any.
+		want string
+	}
+	tests := []struct {
+		name string
+		runs []run
+		// flapping and stable are lines the FLAPPING and stable emails
+		// must contain.
+		flapping []string
+		stable   []string
+	}{
+		{
+			name: "stable while down",
+			runs: []run{
+				{"up", ""},
+				{"down", "[UPMAIL]: api down"},
+				{"up", "[UPMAIL]: api resolved"},
+				{"down", "[UPMAIL]: api down"},
+				{"up", "[UPMAIL]: api FLAPPING"},
+				{"down", ""},
+				{"up", ""},
+				{"down", ""},
+				// Below FlapHigh but not below FlapLow yet.
+				{"down", ""},
+				{"down", ""},
+				{"down", "[UPMAIL]: api stopped flapping, down"},
+				{"down", ""},
+				{"up", "[UPMAIL]: api resolved"},
+			},
+			flapping: []string{
+				"== api - https://api.example.com is flapping",
+				"Its status changed in 100% of the last 5 checks:\n  healthy down healthy down healthy \n",
+			},
+			stable: []string{
+				"== api - https://api.example.com stopped flapping and is down",
+				"Its status changed in 20% of the last 5 checks:\n  healthy down down down down \n",
+				"== api - https://api.example.com\n",
+				"Assessment: down",
+			},
+		},
+		{
+			name: "stable while healthy",
+			runs: []run{
+				{"up", ""},
+				{"down", "[UPMAIL]: api down"},
+				{"up", "[UPMAIL]: api resolved"},
+				{"down", "[UPMAIL]: api down"},
+				{"up", "[UPMAIL]: api FLAPPING"},
+				{"down", ""},
+				{"up", ""},
+				{"up", ""},
+				{"up", ""},
+				{"up", "[UPMAIL]: api stopped flapping, healthy"},
+				{"up", ""},
+				{"down", "[UPMAIL]: api down"},
+			},
+			flapping: []string{
+				"Its status changed in 100% of the last 5 checks:\n  healthy down healthy down healthy \n",
+			},
+			stable: []string{
+				"== api - https://api.example.com stopped flapping and is healthy",
+				"Its status changed in 20% of the last 5 checks:\n  down healthy healthy healthy healthy \n",
+				"Assessment: healthy",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := &fakeTransport{}
+			n := &Notifier{
+				Transports: []Transport{tr},
+				Routing:    Routing{Default: []string{"ops@example.com"}},
+				FlapWindow: 5,
+				FlapHigh:   50,
+				FlapLow:    25,
+			}
+
+			var want []string
+			for i, run := range tt.runs {
+				if err := n.Notify([]checkup.Result{testResult("api", run.status)}); err != nil {
+					t.Fatalf("run %d: Notify: %v", i, err)
+				}
+				if run.want != "" {
+					want = append(want, run.want)
+				}
+				if got := tr.subjects(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+					t.Fatalf("run %d (%s): sent\n%s\nwant\n%s", i, run.status, strings.Join(got, "\n"), strings.Join(want, "\n"))
+				}
+			}
+
+			var flapping, stable []*Message
+			for _, m := range tr.messages() {
+				switch {
+				case strings.HasSuffix(m.Subject, "FLAPPING"):
+					flapping = append(flapping, m)
+				case strings.Contains(m.Subject, "stopped flapping"):
+					stable = append(stable, m)
+				}
+			}
+			if len(flapping) != 1 || len(stable) != 1 {
+				t.Fatalf("sent %d FLAPPING and %d stable emails, want one of each", len(flapping), len(stable))
+			}
+			for _, c := range []struct {
+				m    *Message
+				want []string
+			}{
+				{flapping[0], tt.flapping},
+				{stable[0], tt.stable},
+			} {
+				for _, want := range c.want {
+					if !strings.Contains(c.m.Text, want) {
+						t.Errorf("%q does not contain %q:\n%s", c.m.Subject, want, c.m.Text)
+					}
+				}
+				if got := strings.Join(c.m.To, ","); got != "ops@example.com" {
+					t.Errorf("%q was sent to %s", c.m.Subject, got)
+				}
+			}
+		})
+	}
+}
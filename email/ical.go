@@ -0,0 +1,667 @@
+package email
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// icsProp is a property of an iCalendar component, such as
+// DTSTART;TZID=Europe/Berlin:20240304T200000.
+type icsProp struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// icsEvent is a VEVENT of an iCalendar file.
+type icsEvent struct {
+	uid         string
+	summary     string
+	description string
+	categories  []string
+	start       time.Time
+	end         time.Time
+	allDay      bool
+	rrule       *rrule
+	exdates     map[int64]bool
+	// recurrenceID is the start of the occurrence of the recurring event
+	// with the same uid that this event replaces.
+	recurrenceID time.Time
+}
+
+// parseICS reads the events of an iCalendar file (RFC 5545). Times without
+// a time zone are read in loc.
+func parseICS(r io.Reader, loc *time.Location) ([]*icsEvent, error) {
+	lines, err := unfoldICS(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Time zones that are not known by name are built from their
+	// VTIMEZONE definition.
+	zones := map[string]*time.Location{}
+	var (
+		stack   []string
+		tz      *vtimezone
+		props   []icsProp
+		events  []*icsEvent
+		lineNum int
+	)
+	for _, line := range lines {
+		lineNum++
+		p, err := parseICSProp(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+
+		switch p.name {
+		case "BEGIN", "END":
+			p.value = strings.ToUpper(strings.TrimSpace(p.value))
+		}
+		switch p.name {
+		case "BEGIN":
+			stack = append(stack, p.value)
+			switch p.value {
+			case "VEVENT":
+				props = nil
+			case "VTIMEZONE":
+				tz = &vtimezone{}
+			case "STANDARD", "DAYLIGHT":
+				if tz != nil {
+					tz.observances = append(tz.observances, &observance{daylight: p.value == "DAYLIGHT"})
+				}
+			}
+			continue
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1] != p.value {
+				return nil, fmt.Errorf("line %d: unexpected END:%s", lineNum, p.value)
+			}
+			stack = stack[:len(stack)-1]
+			switch p.value {
+			case "VEVENT":
+				ev, err := newICSEvent(props, loc, zones)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineNum, err)
+				}
+				if ev != nil {
+					events = append(events, ev)
+				}
+			case "VTIMEZONE":
+				// Events in a zone whose definition is unusable fail
+				// with an unknown time zone.
+				if _, ok := zones[tz.tzid]; !ok && tz.tzid != "" {
+					if z, err := tz.location(); err == nil {
+						zones[tz.tzid] = z
+					}
+				}
+				tz = nil
+			}
+			continue
+		}
+
+		if len(stack) == 0 {
+			continue
+		}
+		switch stack[len(stack)-1] {
+		case "VEVENT":
+			props = append(props, p)
+		case "VTIMEZONE":
+			if p.name == "TZID" {
+				tz.tzid = p.value
+			}
+		case "STANDARD", "DAYLIGHT":
+			if tz == nil {
+				continue
+			}
+			o := tz.observances[len(tz.observances)-1]
+			switch p.name {
+			case "DTSTART":
+				o.start = strings.TrimSpace(p.value)
+			case "TZOFFSETTO":
+				o.offsetTo = strings.TrimSpace(p.value)
+			case "TZNAME":
+				o.name = strings.TrimSpace(p.value)
+			case "RRULE":
+				o.rule = p.value
+			}
+		}
+	}
+
+	return events, nil
+}
+
+// unfoldICS splits r into content lines, joining the folded ones.
+func unfoldICS(r io.Reader) ([]string, error) {
+	var lines []string
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("reading calendar failed: %v", err)
+	}
+	return lines, nil
+}
+
+// parseICSProp parses a content line.
+func parseICSProp(line string) (icsProp, error) {
+	p := icsProp{params: map[string]string{}}
+
+	// The value starts at the first colon outside of a quoted parameter
+	// value.
+	colon, quoted := -1, false
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		} else if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return p, fmt.Errorf("invalid content line %q", line)
+	}
+	p.value = line[colon+1:]
+
+	parts := strings.Split(line[:colon], ";")
+	p.name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) == 2 {
+			p.params[strings.ToUpper(kv[0])] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return p, nil
+}
+
+// newICSEvent builds an event from the properties of a VEVENT. Cancelled
+// events result in nil.
+func newICSEvent(props []icsProp, loc *time.Location, zones map[string]*time.Location) (*icsEvent, error) {
+	ev := &icsEvent{exdates: map[int64]bool{}}
+	var (
+		duration    time.Duration
+		hasDuration bool
+		rule        string
+	)
+	for _, p := range props {
+		var err error
+		switch p.name {
+		case "UID":
+			ev.uid = p.value
+		case "SUMMARY":
+			ev.summary = unescapeICSText(p.value)
+		case "DESCRIPTION":
+			ev.description = unescapeICSText(p.value)
+		case "CATEGORIES":
+			for _, c := range splitICSList(p.value) {
+				ev.categories = append(ev.categories, unescapeICSText(c))
+			}
+		case "STATUS":
+			if strings.EqualFold(p.value, "CANCELLED") {
+				return nil, nil
+			}
+		case "DTSTART":
+			ev.start, ev.allDay, err = parseICSTime(p, loc, zones)
+		case "DTEND":
+			ev.end, _, err = parseICSTime(p, loc, zones)
+		case "DURATION":
+			duration, err = parseICSDuration(p.value)
+			hasDuration = true
+		case "RRULE":
+			rule = p.value
+		case "EXDATE":
+			for _, v := range splitICSList(p.value) {
+				var t time.Time
+				t, _, err = parseICSTime(icsProp{name: p.name, params: p.params, value: v}, loc, zones)
+				if err != nil {
+					break
+				}
+				ev.exdates[t.Unix()] = true
+			}
+		case "RECURRENCE-ID":
+			ev.recurrenceID, _, err = parseICSTime(p, loc, zones)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("event %q: %s: %v", ev.summary, p.name, err)
+		}
+	}
+
+	if ev.start.IsZero() {
+		return nil, fmt.Errorf("event %q has no DTSTART", ev.summary)
+	}
+	switch {
+	case !ev.end.IsZero():
+	case hasDuration:
+		ev.end = ev.start.Add(duration)
+	case ev.allDay:
+		ev.end = ev.start.AddDate(0, 0, 1)
+	default:
+		ev.end = ev.start
+	}
+
+	if rule != "" {
+		rr, err := parseRRule(rule, loc, zones)
+		if err != nil {
+			return nil, fmt.Errorf("event %q: RRULE: %v", ev.summary, err)
+		}
+		ev.rrule = rr
+	}
+
+	return ev, nil
+}
+
+// parseICSTime parses a DATE or DATE-TIME value. UTC times end with "Z",
+// others are in the zone of their TZID parameter or in loc.
+func parseICSTime(p icsProp, loc *time.Location, zones map[string]*time.Location) (time.Time, bool, error) {
+	if tzid, ok := p.params["TZID"]; ok {
+		if z, err := time.LoadLocation(tzid); err == nil {
+			loc = z
+		} else if z, ok := zones[tzid]; ok {
+			loc = z
+		} else {
+			return time.Time{}, false, fmt.Errorf("unknown time zone %q", tzid)
+		}
+	}
+
+	v := strings.TrimSpace(p.value)
+	if p.params["VALUE"] == "DATE" || len(v) == 8 {
+		t, err := time.ParseInLocation("20060102", v, loc)
+		return t, true, err
+	}
+	if strings.HasSuffix(v, "Z") {
+		t, err := time.Parse("20060102T150405Z", v)
+		return t, false, err
+	}
+	t, err := time.ParseInLocation("20060102T150405", v, loc)
+	return t, false, err
+}
+
+// parseICSDuration parses a duration such as P1DT2H30M or P1W.
+func parseICSDuration(s string) (time.Duration, error) {
+	v := strings.TrimSpace(s)
+	neg := strings.HasPrefix(v, "-")
+	v = strings.TrimLeft(v, "+-")
+	if !strings.HasPrefix(v, "P") {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	v = v[1:]
+
+	var (
+		d      time.Duration
+		inTime bool
+		num    string
+	)
+	for _, c := range v {
+		switch {
+		case c >= '0' && c <= '9':
+			num += string(c)
+			continue
+		case c == 'T':
+			inTime = true
+			continue
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		num = ""
+		switch {
+		case c == 'W' && !inTime:
+			d += time.Duration(n) * 7 * 24 * time.Hour
+		case c == 'D' && !inTime:
+			d += time.Duration(n) * 24 * time.Hour
+		case c == 'H' && inTime:
+			d += time.Duration(n) * time.Hour
+		case c == 'M' && inTime:
+			d += time.Duration(n) * time.Minute
+		case c == 'S' && inTime:
+			d += time.Duration(n) * time.Second
+		default:
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+	}
+	if num != "" {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	if neg {
+		d = -d
+	}
+	return d, nil
+}
+
+// parseUTCOffset parses an offset such as +0100 into seconds.
+func parseUTCOffset(s string) (int, error) {
+	if len(s) != 5 && len(s) != 7 {
+		return 0, fmt.Errorf("invalid UTC offset %q", s)
+	}
+	h, err := strconv.Atoi(s[1:3])
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.Atoi(s[3:5])
+	if err != nil {
+		return 0, err
+	}
+	offset := h*3600 + m*60
+	if s[0] == '-' {
+		offset = -offset
+	}
+	return offset, nil
+}
+
+// splitICSList splits a comma separated value, keeping escaped commas.
+func splitICSList(s string) []string {
+	var (
+		items []string
+		cur   strings.Builder
+	)
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s):
+			cur.WriteByte(s[i])
+			cur.WriteByte(s[i+1])
+			i++
+		case s[i] == ',':
+			items = append(items, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(s[i])
+		}
+	}
+	return append(items, cur.String())
+}
+
+// unescapeICSText unescapes a TEXT value.
+func unescapeICSText(s string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(s)
+}
+
+// rrule is a recurrence rule. Only the parts needed for maintenance
+// calendars are supported: FREQ, INTERVAL, COUNT, UNTIL, BYDAY, BYMONTHDAY
+// and BYMONTH.
+type rrule struct {
+	freq       string
+	interval   int
+	count      int
+	until      time.Time
+	byDay      []weekdayNum
+	byMonthDay []int
+	byMonth    []time.Month
+}
+
+// weekdayNum is a BYDAY entry such as TU or -1FR.
+type weekdayNum struct {
+	n   int
+	day time.Weekday
+}
+
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// parseRRule parses the value of an RRULE property.
+func parseRRule(s string, loc *time.Location, zones map[string]*time.Location) (*rrule, error) {
+	rr := &rrule{interval: 1}
+	for _, part := range strings.Split(s, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid rule part %q", part)
+		}
+		key, value := strings.ToUpper(kv[0]), strings.ToUpper(kv[1])
+
+		var err error
+		switch key {
+		case "FREQ":
+			switch value {
+			case "DAILY", "WEEKLY", "MONTHLY", "YEARLY":
+				rr.freq = value
+			default:
+				return nil, fmt.Errorf("unsupported frequency %s", value)
+			}
+		case "INTERVAL":
+			rr.interval, err = strconv.Atoi(value)
+			if err == nil && rr.interval < 1 {
+				err = fmt.Errorf("invalid interval %d", rr.interval)
+			}
+		case "COUNT":
+			rr.count, err = strconv.Atoi(value)
+		case "UNTIL":
+			rr.until, _, err = parseICSTime(icsProp{params: map[string]string{}, value: value}, loc, zones)
+			if err == nil && len(value) == 8 {
+				// A date includes the whole day.
+				rr.until = rr.until.AddDate(0, 0, 1).Add(-time.Second)
+			}
+		case "BYDAY":
+			for _, d := range strings.Split(value, ",") {
+				if len(d) < 2 {
+					return nil, fmt.Errorf("invalid weekday %q", d)
+				}
+				day, ok := icsWeekdays[d[len(d)-2:]]
+				if !ok {
+					return nil, fmt.Errorf("invalid weekday %q", d)
+				}
+				wn := weekdayNum{day: day}
+				if num := d[:len(d)-2]; num != "" {
+					if wn.n, err = strconv.Atoi(num); err != nil {
+						return nil, fmt.Errorf("invalid weekday %q", d)
+					}
+				}
+				rr.byDay = append(rr.byDay, wn)
+			}
+		case "BYMONTHDAY":
+			for _, d := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(d)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return nil, fmt.Errorf("invalid month day %q", d)
+				}
+				rr.byMonthDay = append(rr.byMonthDay, n)
+			}
+		case "BYMONTH":
+			for _, m := range strings.Split(value, ",") {
+				n, err := strconv.Atoi(m)
+				if err != nil || n < 1 || n > 12 {
+					return nil, fmt.Errorf("invalid month %q", m)
+				}
+				rr.byMonth = append(rr.byMonth, time.Month(n))
+			}
+		case "WKST":
+			// Weeks start on Monday, which is the default.
+		default:
+			return nil, fmt.Errorf("unsupported rule part %s", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	if rr.freq == "" {
+		return nil, fmt.Errorf("missing FREQ")
+	}
+	return rr, nil
+}
+
+// maxRRulePeriods bounds the number of periods a rule is expanded for, so a
+// rule that matches nothing does not loop forever.
+const maxRRulePeriods = 100000
+
+// occurrences calls fn with the start of every occurrence of ev, in order,
+// until fn returns false or the occurrences start after limit.
+func (ev *icsEvent) occurrences(limit time.Time, fn func(start time.Time) bool) {
+	emit := func(t time.Time) bool {
+		if ev.exdates[t.Unix()] {
+			return true
+		}
+		return fn(t)
+	}
+
+	if ev.rrule == nil {
+		if !ev.start.After(limit) {
+			emit(ev.start)
+		}
+		return
+	}
+
+	rr, start := ev.rrule, ev.start
+	n := 0
+	for period := 0; period < maxRRulePeriods; period++ {
+		candidates, past := rr.period(start, period)
+		if past.After(limit) {
+			return
+		}
+		for _, t := range candidates {
+			if t.Before(start) {
+				continue
+			}
+			if t.After(limit) || (!rr.until.IsZero() && t.After(rr.until)) || (rr.count > 0 && n >= rr.count) {
+				return
+			}
+			n++
+			if !emit(t) {
+				return
+			}
+		}
+	}
+}
+
+// period returns the sorted candidate occurrences of the period-th period of
+// the rule starting at start, along with the beginning of the period.
+func (rr *rrule) period(start time.Time, period int) ([]time.Time, time.Time) {
+	y, m, d := start.Date()
+	hh, mm, ss := start.Clock()
+	loc := start.Location()
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, hh, mm, ss, 0, loc)
+	}
+	step := period * rr.interval
+
+	var candidates []time.Time
+	var begin time.Time
+	switch rr.freq {
+	case "DAILY":
+		begin = at(y, m, d+step)
+		if rr.matchDay(begin) && rr.matchMonth(begin.Month()) {
+			candidates = append(candidates, begin)
+		}
+	case "WEEKLY":
+		// Weeks start on Monday.
+		monday := d - (int(start.Weekday())+6)%7
+		begin = at(y, m, monday+7*step)
+		if len(rr.byDay) == 0 {
+			candidates = append(candidates, at(y, m, d+7*step))
+		}
+		for _, wd := range rr.byDay {
+			t := at(begin.Year(), begin.Month(), begin.Day()+(int(wd.day)+6)%7)
+			if rr.matchMonth(t.Month()) {
+				candidates = append(candidates, t)
+			}
+		}
+	case "MONTHLY":
+		begin = at(y, m+time.Month(step), 1)
+		if rr.matchMonth(begin.Month()) {
+			candidates = rr.monthDays(begin, d)
+		}
+	case "YEARLY":
+		begin = at(y+step, 1, 1)
+		months := rr.byMonth
+		if len(months) == 0 {
+			months = []time.Month{m}
+		}
+		for _, month := range months {
+			candidates = append(candidates, rr.monthDays(at(begin.Year(), month, 1), d)...)
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+	return candidates, begin
+}
+
+// monthDays returns the candidates in the month starting at first. Without
+// BYMONTHDAY or BYDAY the month day of the event start is used.
+func (rr *rrule) monthDays(first time.Time, day int) []time.Time {
+	y, m := first.Year(), first.Month()
+	hh, mm, ss := first.Clock()
+	loc := first.Location()
+	days := time.Date(y, m+1, 0, 0, 0, 0, 0, loc).Day()
+	at := func(d int) time.Time { return time.Date(y, m, d, hh, mm, ss, 0, loc) }
+
+	var candidates []time.Time
+	switch {
+	case len(rr.byMonthDay) > 0:
+		for _, md := range rr.byMonthDay {
+			if md < 0 {
+				md = days + md + 1
+			}
+			if md >= 1 && md <= days && rr.matchDay(at(md)) {
+				candidates = append(candidates, at(md))
+			}
+		}
+	case len(rr.byDay) > 0:
+		for _, wd := range rr.byDay {
+			var matching []time.Time
+			for d := 1; d <= days; d++ {
+				if t := at(d); t.Weekday() == wd.day {
+					matching = append(matching, t)
+				}
+			}
+			switch {
+			case wd.n == 0:
+				candidates = append(candidates, matching...)
+			case wd.n > 0 && wd.n <= len(matching):
+				candidates = append(candidates, matching[wd.n-1])
+			case wd.n < 0 && -wd.n <= len(matching):
+				candidates = append(candidates, matching[len(matching)+wd.n])
+			}
+		}
+	default:
+		if day <= days {
+			candidates = append(candidates, at(day))
+		}
+	}
+	return candidates
+}
+
+// matchDay reports whether t falls on one of the BYDAY weekdays, for rules
+// where BYDAY limits the occurrences.
+func (rr *rrule) matchDay(t time.Time) bool {
+	if len(rr.byDay) == 0 {
+		return true
+	}
+	for _, wd := range rr.byDay {
+		if wd.day == t.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMonth reports whether m is one of the BYMONTH months.
+func (rr *rrule) matchMonth(m time.Month) bool {
+	if len(rr.byMonth) == 0 {
+		return true
+	}
+	for _, bm := range rr.byMonth {
+		if bm == m {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,427 @@
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// ics wraps VEVENT lines into a calendar with CRLF line endings.
+func ics(lines ...string) string {
+	all := append([]string{"BEGIN:VCALENDAR", "VERSION:2.0"}, lines...)
+	all = append(all, "END:VCALENDAR", "")
+	return strings.Join(all, "\r\n")
+}
+
+// westEurope is the VTIMEZONE Outlook exports for Central European Time.
+var westEurope = []string{
+	"BEGIN:VTIMEZONE", "TZID:W. Europe Standard Time",
+	"BEGIN:STANDARD", "DTSTART:16010101T030000", "TZOFFSETFROM:+0200", "TZOFFSETTO:+0100",
+	"RRULE:FREQ=YEARLY;BYDAY=-1SU;BYMONTH=10", "END:STANDARD",
+	"BEGIN:DAYLIGHT", "DTSTART:16010101T020000", "TZOFFSETFROM:+0100", "TZOFFSETTO:+0200",
+	"RRULE:FREQ=YEARLY;BYDAY=-1SU;BYMONTH=3", "END:DAYLIGHT",
+	"END:VTIMEZONE",
+}
+
+func TestParseICS(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+
+	tests := []struct {
+		name     string
+		ics      string
+		err      string
+		events   int
+		summary  string
+		desc     string
+		cats     []string
+		start    time.Time
+		end      time.Time
+		allDay   bool
+		recurs   bool
+		exdates  int
+		recurID  time.Time
+		startLoc string
+	}{
+		{
+			name: "utc with dtend",
+			ics: ics("BEGIN:VEVENT", "UID:1", "SUMMARY:DB upgrade",
+				"DTSTART:20261020T200000Z", "DTEND:20261020T220000Z", "END:VEVENT"),
+			events:  1,
+			summary: "DB upgrade",
+			start:   time.Date(2026, 10, 20, 20, 0, 0, 0, time.UTC),
+			end:     time.Date(2026, 10, 20, 22, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "tzid with duration",
+			ics: ics("BEGIN:VEVENT", "UID:1", "SUMMARY:Patch",
+				"DTSTART;TZID=Europe/Berlin:20261020T200000", "DURATION:PT1H30M", "END:VEVENT"),
+			events:   1,
+			summary:  "Patch",
+			start:    time.Date(2026, 10, 20, 20, 0, 0, 0, berlin),
+			end:      time.Date(2026, 10, 20, 21, 30, 0, 0, berlin),
+			startLoc: "Europe/Berlin",
+		},
+		{
+			name: "floating time in the calendar zone",
+			ics: ics("BEGIN:VEVENT", "UID:1", "SUMMARY:Patch",
+				"DTSTART:20261020T200000", "DTEND:20261020T210000", "END:VEVENT"),
+			events:   1,
+			summary:  "Patch",
+			start:    time.Date(2026, 10, 20, 20, 0, 0, 0, berlin),
+			end:      time.Date(2026, 10, 20, 21, 0, 0, 0, berlin),
+			startLoc: "Europe/Berlin",
+		},
+		{
+			name: "all-day event without dtend",
+			ics: ics("BEGIN:VEVENT", "UID:1", "SUMMARY:Move",
+				"DTSTART;VALUE=DATE:20261024", "END:VEVENT"),
+			events:  1,
+			summary: "Move",
+			start:   time.Date(2026, 10, 24, 0, 0, 0, 0, berlin),
+			end:     time.Date(2026, 10, 25, 0, 0, 0, 0, berlin),
+			allDay:  true,
+		},
+		{
+			name: "folded and escaped text",
+			ics: ics("BEGIN:VEVENT", "UID:1", "SUMMARY:Network\\, DNS",
+				"DESCRIPTION:checks: api-*\\,", " web\\nsee ticket",
+				"CATEGORIES:Maintenance,Ops\\,Infra",
+				"DTSTART:20261020T200000Z", "END:VEVENT"),
+			events:  1,
+			summary: "Network, DNS",
+			desc:    "checks: api-*,web\nsee ticket",
+			cats:    []string{"Maintenance", "Ops,Infra"},
+			start:   time.Date(2026, 10, 20, 20, 0, 0, 0, time.UTC),
+			end:     time.Date(2026, 10, 20, 20, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "recurring with exdates",
+			ics: ics("BEGIN:VEVENT", "UID:1", "SUMMARY:Weekly",
+				"DTSTART:20261020T200000Z", "DTEND:20261020T210000Z",
+				"RRULE:FREQ=WEEKLY;BYDAY=TU",
+				"EXDATE:20261027T200000Z,20261103T200000Z", "END:VEVENT"),
+			events:  1,
+			summary: "Weekly",
+			start:   time.Date(2026, 10, 20, 20, 0, 0, 0, time.UTC),
+			end:     time.Date(2026, 10, 20, 21, 0, 0, 0, time.UTC),
+			recurs:  true,
+			exdates: 2,
+		},
+		{
+			name: "moved occurrence",
+			ics: ics("BEGIN:VEVENT", "UID:1", "SUMMARY:Weekly",
+				"RECURRENCE-ID:20261027T200000Z",
+				"DTSTART:20261028T010000Z", "DTEND:20261028T020000Z", "END:VEVENT"),
+			events:  1,
+			summary: "Weekly",
+			start:   time.Date(2026, 10, 28, 1, 0, 0, 0, time.UTC),
+			end:     time.Date(2026, 10, 28, 2, 0, 0, 0, time.UTC),
+			recurID: time.Date(2026, 10, 27, 20, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "vtimezone in standard time",
+			ics: ics(append(westEurope,
+				"BEGIN:VEVENT", "UID:1", "SUMMARY:Windows",
+				`DTSTART;TZID="W. Europe Standard Time":20261110T200000`,
+				`DTEND;TZID="W. Europe Standard Time":20261110T210000`, "END:VEVENT")...),
+			events:  1,
+			summary: "Windows",
+			start:   time.Date(2026, 11, 10, 19, 0, 0, 0, time.UTC),
+			end:     time.Date(2026, 11, 10, 20, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "vtimezone in daylight saving time",
+			ics: ics(append(westEurope,
+				"BEGIN:VEVENT", "UID:1", "SUMMARY:Windows",
+				`DTSTART;TZID="W. Europe Standard Time":20260710T200000`,
+				`DTEND;TZID="W. Europe Standard Time":20260710T210000`, "END:VEVENT")...),
+			events:  1,
+			summary: "Windows",
+			start:   time.Date(2026, 7, 10, 18, 0, 0, 0, time.UTC),
+			end:     time.Date(2026, 7, 10, 19, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "vtimezone across the end of daylight saving time",
+			ics: ics(append(westEurope,
+				"BEGIN:VEVENT", "UID:1", "SUMMARY:Windows",
+				`DTSTART;TZID="W. Europe Standard Time":20261025T013000`,
+				`DTEND;TZID="W. Europe Standard Time":20261025T043000`, "END:VEVENT")...),
+			events:  1,
+			summary: "Windows",
+			start:   time.Date(2026, 10, 24, 23, 30, 0, 0, time.UTC),
+			end:     time.Date(2026, 10, 25, 3, 30, 0, 0, time.UTC),
+		},
+		{
+			name: "vtimezone in the southern hemisphere",
+			ics: ics("BEGIN:VTIMEZONE", "TZID:AUS Eastern Standard Time",
+				"BEGIN:STANDARD", "DTSTART:16010101T030000", "TZOFFSETFROM:+1100", "TZOFFSETTO:+1000",
+				"RRULE:FREQ=YEARLY;BYDAY=1SU;BYMONTH=4", "END:STANDARD",
+				"BEGIN:DAYLIGHT", "DTSTART:16010101T020000", "TZOFFSETFROM:+1000", "TZOFFSETTO:+1100",
+				"RRULE:FREQ=YEARLY;BYDAY=1SU;BYMONTH=10", "END:DAYLIGHT",
+				"END:VTIMEZONE",
+				"BEGIN:VEVENT", "UID:1", "SUMMARY:Sydney",
+				"DTSTART;TZID=AUS Eastern Standard Time:20260110T200000",
+				"DTEND;TZID=AUS Eastern Standard Time:20260710T200000", "END:VEVENT"),
+			events:  1,
+			summary: "Sydney",
+			start:   time.Date(2026, 1, 10, 9, 0, 0, 0, time.UTC),
+			end:     time.Date(2026, 7, 10, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "vtimezone with the latest of several rules",
+			ics: ics("BEGIN:VTIMEZONE", "TZID:US/Eastern-Custom",
+				"BEGIN:STANDARD", "DTSTART:19671029T020000", "TZOFFSETFROM:-0400", "TZOFFSETTO:-0500",
+				"RRULE:FREQ=YEARLY;BYMONTH=10;BYMONTHDAY=25,26,27,28,29,30,31;BYDAY=SU;UNTIL=20061029T060000Z", "TZNAME:EST", "END:STANDARD",
+				"BEGIN:DAYLIGHT", "DTSTART:19870405T020000", "TZOFFSETFROM:-0500", "TZOFFSETTO:-0400",
+				"RRULE:FREQ=YEARLY;BYMONTH=4;BYDAY=1SU;UNTIL=20060402T070000Z", "TZNAME:EDT", "END:DAYLIGHT",
+				"BEGIN:STANDARD", "DTSTART:20071104T020000", "TZOFFSETFROM:-0400", "TZOFFSETTO:-0500",
+				"RRULE:FREQ=YEARLY;BYMONTH=11;BYMONTHDAY=1,2,3,4,5,6,7;BYDAY=SU", "TZNAME:EST", "END:STANDARD",
+				"BEGIN:DAYLIGHT", "DTSTART:20070311T020000", "TZOFFSETFROM:-0500", "TZOFFSETTO:-0400",
+				"RRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=2SU", "TZNAME:EDT", "END:DAYLIGHT",
+				"END:VTIMEZONE",
+				"BEGIN:VEVENT", "UID:1", "SUMMARY:New York",
+				// Daylight saving time started on March 8 and ends on
+				// November 1.
+				"DTSTART;TZID=US/Eastern-Custom:20261031T200000",
+				"DTEND;TZID=US/Eastern-Custom:20261101T200000", "END:VEVENT"),
+			events:  1,
+			summary: "New York",
+			start:   time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC),
+			end:     time.Date(2026, 11, 2, 1, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "vtimezone without daylight saving time",
+			ics: ics("BEGIN:VTIMEZONE", "TZID:India Standard Time",
+				"BEGIN:STANDARD", "DTSTART:16010101T000000", "TZOFFSETFROM:+0530", "TZOFFSETTO:+0530", "END:STANDARD",
+				"END:VTIMEZONE",
+				"BEGIN:VEVENT", "UID:1", "SUMMARY:Mumbai",
+				"DTSTART;TZID=India Standard Time:20260710T200000", "END:VEVENT"),
+			events:  1,
+			summary: "Mumbai",
+			start:   time.Date(2026, 7, 10, 14, 30, 0, 0, time.UTC),
+			end:     time.Date(2026, 7, 10, 14, 30, 0, 0, time.UTC),
+		},
+		{
+			name: "vtimezone without rules falls back to the standard offset",
+			ics: ics("BEGIN:VTIMEZONE", "TZID:Custom",
+				"BEGIN:STANDARD", "TZOFFSETFROM:+0200", "TZOFFSETTO:+0100", "END:STANDARD",
+				"BEGIN:DAYLIGHT", "TZOFFSETFROM:+0100", "TZOFFSETTO:+0200", "END:DAYLIGHT",
+				"END:VTIMEZONE",
+				"BEGIN:VEVENT", "UID:1", "SUMMARY:Custom",
+				"DTSTART;TZID=Custom:20260710T200000", "END:VEVENT"),
+			events:  1,
+			summary: "Custom",
+			start:   time.Date(2026, 7, 10, 19, 0, 0, 0, time.UTC),
+			end:     time.Date(2026, 7, 10, 19, 0, 0, 0, time.UTC),
+		},
+		{
+			name: "cancelled event",
+			ics: ics("BEGIN:VEVENT", "UID:1", "SUMMARY:Off", "STATUS:CANCELLED",
+				"DTSTART:20261020T200000Z", "END:VEVENT"),
+		},
+		{
+			name: "missing dtstart",
+			ics:  ics("BEGIN:VEVENT", "UID:1", "SUMMARY:Broken", "END:VEVENT"),
+			err:  "has no DTSTART",
+		},
+		{
+			name: "unknown time zone",
+			ics: ics("BEGIN:VEVENT", "UID:1", "SUMMARY:Broken",
+				"DTSTART;TZID=Nowhere/Special:20261020T200000", "END:VEVENT"),
+			err: `unknown time zone "Nowhere/Special"`,
+		},
+		{
+			name: "unsupported rule",
+			ics: ics("BEGIN:VEVENT", "UID:1", "SUMMARY:Broken",
+				"DTSTART:20261020T200000Z", "RRULE:FREQ=HOURLY", "END:VEVENT"),
+			err: "unsupported frequency HOURLY",
+		},
+		{
+			name: "unbalanced end",
+			ics:  ics("BEGIN:VEVENT", "UID:1", "END:VTODO"),
+			err:  "unexpected END:VTODO",
+		},
+		{
+			name: "invalid line",
+			ics:  ics("BEGIN:VEVENT", "no colon here", "END:VEVENT"),
+			err:  "invalid content line",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := parseICS(strings.NewReader(tt.ics), berlin)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("parseICS returned %v, want an error containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseICS: %v", err)
+			}
+			if len(events) != tt.events {
+				t.Fatalf("got %d events, want %d", len(events), tt.events)
+			}
+			if tt.events == 0 {
+				return
+			}
+
+			ev := events[0]
+			if ev.summary != tt.summary {
+				t.Errorf("summary is %q, want %q", ev.summary, tt.summary)
+			}
+			if ev.description != tt.desc {
+				t.Errorf("description is %q, want %q", ev.description, tt.desc)
+			}
+			if strings.Join(ev.categories, "|") != strings.Join(tt.cats, "|") {
+				t.Errorf("categories are %q, want %q", ev.categories, tt.cats)
+			}
+			if !ev.start.Equal(tt.start) || !ev.end.Equal(tt.end) {
+				t.Errorf("event is %s - %s, want %s - %s", ev.start, ev.end, tt.start, tt.end)
+			}
+			if ev.allDay != tt.allDay {
+				t.Errorf("allDay is %t, want %t", ev.allDay, tt.allDay)
+			}
+			if (ev.rrule != nil) != tt.recurs {
+				t.Errorf("recurring is %t, want %t", ev.rrule != nil, tt.recurs)
+			}
+			if len(ev.exdates) != tt.exdates {
+				t.Errorf("got %d exdates, want %d", len(ev.exdates), tt.exdates)
+			}
+			if !ev.recurrenceID.Equal(tt.recurID) {
+				t.Errorf("recurrence ID is %s, want %s", ev.recurrenceID, tt.recurID)
+			}
+			if tt.startLoc != "" && ev.start.Location().String() != tt.startLoc {
+				t.Errorf("start is in %s, want %s", ev.start.Location(), tt.startLoc)
+			}
+		})
+	}
+}
+
+func TestOccurrences(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	date := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, berlin)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	tests := []struct {
+		name    string
+		start   string
+		rule    string
+		exdates []string
+		limit   string
+		max     int
+		want    []string
+	}{
+		{
+			name:  "single event",
+			start: "2026-10-20 20:00",
+			limit: "2026-12-31 00:00",
+			want:  []string{"2026-10-20 20:00"},
+		},
+		{
+			name:  "single event after the limit",
+			start: "2026-10-20 20:00",
+			limit: "2026-10-20 19:00",
+		},
+		{
+			name:  "daily with interval and count",
+			start: "2026-10-20 20:00",
+			rule:  "FREQ=DAILY;INTERVAL=2;COUNT=3",
+			limit: "2026-12-31 00:00",
+			want:  []string{"2026-10-20 20:00", "2026-10-22 20:00", "2026-10-24 20:00"},
+		},
+		{
+			name:    "weekly on two days with an exdate",
+			start:   "2026-10-20 20:00",
+			rule:    "FREQ=WEEKLY;BYDAY=TU,TH",
+			exdates: []string{"2026-10-27 20:00"},
+			limit:   "2026-10-30 00:00",
+			want:    []string{"2026-10-20 20:00", "2026-10-22 20:00", "2026-10-29 20:00"},
+		},
+		{
+			name:  "weekly keeps the local time across dst",
+			start: "2026-10-21 22:00",
+			rule:  "FREQ=WEEKLY",
+			limit: "2026-11-05 00:00",
+			want:  []string{"2026-10-21 22:00", "2026-10-28 22:00", "2026-11-04 22:00"},
+		},
+		{
+			name:  "weekly until",
+			start: "2026-10-20 20:00",
+			rule:  "FREQ=WEEKLY;UNTIL=20261103",
+			limit: "2026-12-31 00:00",
+			want:  []string{"2026-10-20 20:00", "2026-10-27 20:00", "2026-11-03 20:00"},
+		},
+		{
+			name:  "monthly on the last friday",
+			start: "2026-10-30 22:00",
+			rule:  "FREQ=MONTHLY;BYDAY=-1FR",
+			limit: "2027-01-31 00:00",
+			want:  []string{"2026-10-30 22:00", "2026-11-27 22:00", "2026-12-25 22:00", "2027-01-29 22:00"},
+		},
+		{
+			name:  "monthly on the 31st skips short months",
+			start: "2026-10-31 01:00",
+			rule:  "FREQ=MONTHLY",
+			limit: "2027-01-31 02:00",
+			want:  []string{"2026-10-31 01:00", "2026-12-31 01:00", "2027-01-31 01:00"},
+		},
+		{
+			name:  "monthly on the last day",
+			start: "2026-10-31 01:00",
+			rule:  "FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=3",
+			limit: "2027-12-31 00:00",
+			want:  []string{"2026-10-31 01:00", "2026-11-30 01:00", "2026-12-31 01:00"},
+		},
+		{
+			name:  "yearly in two months",
+			start: "2026-03-15 08:00",
+			rule:  "FREQ=YEARLY;BYMONTH=3,9",
+			limit: "2027-12-31 00:00",
+			want:  []string{"2026-03-15 08:00", "2026-09-15 08:00", "2027-03-15 08:00", "2027-09-15 08:00"},
+		},
+		{
+			name:  "fn stops the expansion",
+			start: "2026-10-20 20:00",
+			rule:  "FREQ=DAILY",
+			limit: "2027-12-31 00:00",
+			max:   2,
+			want:  []string{"2026-10-20 20:00", "2026-10-21 20:00"},
+		},
+		{
+			name:  "rule that never matches",
+			start: "2026-10-20 20:00",
+			rule:  "FREQ=MONTHLY;BYMONTHDAY=31;BYMONTH=2",
+			limit: "2030-01-01 00:00",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ev := &icsEvent{start: date(tt.start), exdates: map[int64]bool{}}
+			if tt.rule != "" {
+				rr, err := parseRRule(tt.rule, berlin, nil)
+				if err != nil {
+					t.Fatalf("parseRRule: %v", err)
+				}
+				ev.rrule = rr
+			}
+			for _, ex := range tt.exdates {
+				ev.exdates[date(ex).Unix()] = true
+			}
+
+			var got []string
+			ev.occurrences(date(tt.limit), func(start time.Time) bool {
+				got = append(got, start.In(berlin).Format("2006-01-02 15:04"))
+				return tt.max == 0 || len(got) < tt.max
+			})
+			if strings.Join(got, ", ") != strings.Join(tt.want, ", ") {
+				t.Fatalf("occurrences are %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
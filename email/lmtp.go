@@ -0,0 +1,118 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// LMTPTransport delivers messages over LMTP (RFC 2033) to a Unix socket,
+// such as the one of a local Postfix, Dovecot or Cyrus.
+type LMTPTransport struct {
+	// Socket is the path of the Unix socket of the LMTP server.
+	Socket string
+}
+
+// Name returns "lmtp".
+func (t LMTPTransport) Name() string {
+	return "lmtp"
+}
+
+// Send delivers m over LMTP. Unlike SMTP, LMTP replies after the message
+// data once per recipient; every rejected recipient is reported in the
+// returned error.
+func (t LMTPTransport) Send(m *Message) error {
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	from, err := m.Sender()
+	if err != nil {
+		return err
+	}
+	to, err := m.Recipients()
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("unix", t.Socket, smtpTimeout)
+	if err != nil {
+		return fmt.Errorf("lmtp: connecting to %s failed: %v", t.Socket, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * smtpTimeout))
+
+	c := textproto.NewConn(conn)
+	if _, _, err := c.ReadResponse(220); err != nil {
+		return fmt.Errorf("lmtp: greeting from %s failed: %v", t.Socket, err)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "localhost"
+	}
+	if err := lmtpCmd(c, 250, "LHLO %s", hostname); err != nil {
+		return fmt.Errorf("lmtp: LHLO failed: %v", err)
+	}
+	if err := lmtpCmd(c, 250, "MAIL FROM:<%s>", from); err != nil {
+		return fmt.Errorf("lmtp: MAIL FROM failed: %v", err)
+	}
+
+	var accepted, errs []string
+	for _, rcpt := range to {
+		if err := lmtpCmd(c, 25, "RCPT TO:<%s>", rcpt); err != nil {
+			errs = append(errs, fmt.Sprintf("RCPT TO %s failed: %v", rcpt, err))
+			continue
+		}
+		accepted = append(accepted, rcpt)
+	}
+	if len(accepted) < 1 {
+		lmtpCmd(c, 221, "QUIT")
+		return fmt.Errorf("lmtp: %s", strings.Join(errs, "; "))
+	}
+
+	if err := lmtpCmd(c, 354, "DATA"); err != nil {
+		return fmt.Errorf("lmtp: DATA failed: %v", err)
+	}
+	w := c.DotWriter()
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("lmtp: writing message failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("lmtp: writing message failed: %v", err)
+	}
+
+	// One reply follows for every accepted recipient, in order.
+	for _, rcpt := range accepted {
+		if _, _, err := c.ReadResponse(25); err != nil {
+			if _, ok := err.(*textproto.Error); !ok {
+				return fmt.Errorf("lmtp: reading reply for %s failed: %v", rcpt, err)
+			}
+			errs = append(errs, fmt.Sprintf("delivery to %s failed: %v", rcpt, err))
+		}
+	}
+
+	lmtpCmd(c, 221, "QUIT")
+
+	if len(errs) > 0 {
+		return errors.New("lmtp: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// lmtpCmd sends a command and reads its reply, which must start with
+// expectCode.
+func lmtpCmd(c *textproto.Conn, expectCode int, format string, args ...interface{}) error {
+	id, err := c.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+	_, _, err = c.ReadResponse(expectCode)
+	return err
+}
@@ -0,0 +1,200 @@
+package email
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lmtpServer is a fake LMTP server on a Unix socket. It answers RCPT TO and
+// the per-recipient replies after DATA from the given maps, and accepts
+// everything else.
+type lmtpServer struct {
+	rcptReplies map[string]string
+	dataReplies map[string]string
+
+	ln  net.Listener
+	dir string
+
+	mu       sync.Mutex
+	commands []string
+	data     string
+}
+
+func newLMTPServer(t *testing.T, rcptReplies, dataReplies map[string]string) *lmtpServer {
+	dir, err := ioutil.TempDir("", "upmail-lmtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("unix", filepath.Join(dir, "lmtp.sock"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	s := &lmtpServer{rcptReplies: rcptReplies, dataReplies: dataReplies, ln: ln, dir: dir}
+	go s.serve()
+	return s
+}
+
+func (s *lmtpServer) socket() string {
+	return s.ln.Addr().String()
+}
+
+func (s *lmtpServer) close() {
+	s.ln.Close()
+	os.RemoveAll(s.dir)
+}
+
+func (s *lmtpServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.handle(textproto.NewConn(conn))
+		conn.Close()
+	}
+}
+
+func (s *lmtpServer) handle(c *textproto.Conn) {
+	c.PrintfLine("220 localhost LMTP ready")
+
+	var rcpts []string
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.commands = append(s.commands, line)
+		s.mu.Unlock()
+
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "LHLO"):
+			c.PrintfLine("250-localhost")
+			c.PrintfLine("250 PIPELINING")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			rcpt := strings.Trim(line[len("RCPT TO:"):], "<>")
+			if reply, ok := s.rcptReplies[rcpt]; ok {
+				c.PrintfLine("%s", reply)
+				continue
+			}
+			rcpts = append(rcpts, rcpt)
+			c.PrintfLine("250 2.1.5 OK")
+		case cmd == "DATA":
+			c.PrintfLine("354 Start mail input")
+			b, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.data = string(b)
+			s.mu.Unlock()
+			for _, rcpt := range rcpts {
+				if reply, ok := s.dataReplies[rcpt]; ok {
+					c.PrintfLine("%s", reply)
+					continue
+				}
+				c.PrintfLine("250 2.0.0 <%s> delivered", rcpt)
+			}
+		case cmd == "QUIT":
+			c.PrintfLine("221 Bye")
+			return
+		default:
+			c.PrintfLine("250 OK")
+		}
+	}
+}
+
+func (s *lmtpServer) received() ([]string, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...), s.data
+}
+
+func TestLMTPTransport(t *testing.T) {
+	tests := []struct {
+		name        string
+		rcptReplies map[string]string
+		dataReplies map[string]string
+		wantErr     []string
+		wantData    bool
+	}{
+		{
+			name:     "every recipient accepted",
+			wantData: true,
+		},
+		{
+			name:        "one recipient rejected after data",
+			dataReplies: map[string]string{"dev@example.com": "552 5.2.2 <dev@example.com> mailbox full"},
+			wantErr:     []string{"delivery to dev@example.com failed", "mailbox full"},
+			wantData:    true,
+		},
+		{
+			name:        "one recipient rejected at rcpt",
+			rcptReplies: map[string]string{"ops@example.com": "550 5.1.1 <ops@example.com> unknown user"},
+			wantErr:     []string{"RCPT TO ops@example.com failed", "unknown user"},
+			wantData:    true,
+		},
+		{
+			name: "every recipient rejected at rcpt",
+			rcptReplies: map[string]string{
+				"ops@example.com": "550 5.1.1 <ops@example.com> unknown user",
+				"dev@example.com": "550 5.1.1 <dev@example.com> unknown user",
+			},
+			wantErr: []string{"RCPT TO ops@example.com failed", "RCPT TO dev@example.com failed"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newLMTPServer(t, tt.rcptReplies, tt.dataReplies)
+			defer srv.close()
+
+			m := NewMessage("upmail@example.com", []string{"ops@example.com", "dev@example.com"}, "api is down", "body", "")
+			err := LMTPTransport{Socket: srv.socket()}.Send(m)
+			if len(tt.wantErr) == 0 && err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+			if len(tt.wantErr) > 0 {
+				if err == nil {
+					t.Fatal("Send succeeded, want an error")
+				}
+				for _, want := range tt.wantErr {
+					if !strings.Contains(err.Error(), want) {
+						t.Errorf("error %q does not contain %q", err, want)
+					}
+				}
+			}
+
+			commands, data := srv.received()
+			want := fmt.Sprintf("LHLO %s", hostname())
+			if len(commands) == 0 || commands[0] != want {
+				t.Fatalf("commands are %q, want %q first", commands, want)
+			}
+			if last := commands[len(commands)-1]; last != "QUIT" {
+				t.Fatalf("last command is %q, want QUIT", last)
+			}
+			if tt.wantData != (data != "") {
+				t.Fatalf("server received data %q, want data: %v", data, tt.wantData)
+			}
+			if tt.wantData && !strings.Contains(data, "Subject: api is down\n") {
+				t.Fatalf("data has no subject:\n%s", data)
+			}
+		})
+	}
+}
+
+func TestLMTPTransportNoSocket(t *testing.T) {
+	err := LMTPTransport{Socket: filepath.Join(os.TempDir(), "upmail-no-such-lmtp.sock")}.Send(testMessage("api is down"))
+	if err == nil || !strings.Contains(err.Error(), "connecting to") {
+		t.Fatalf("Send returned %v, want a connection error", err)
+	}
+}
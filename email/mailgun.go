@@ -0,0 +1,180 @@
+package email
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	mailgun "github.com/mailgun/mailgun-go"
+	"github.com/sirupsen/logrus"
+)
+
+// MailgunAPIBaseEU is the API base of domains in the Mailgun EU region.
+const MailgunAPIBaseEU = "https://api.eu.mailgun.net/v3"
+
+// mailgunMaxTags is the number of tags Mailgun accepts per message.
+const mailgunMaxTags = 3
+
+// MailgunTransport delivers messages through the Mailgun API.
+type MailgunTransport struct {
+	// Domain is the Mailgun domain.
+	Domain string
+	// APIKey is the Mailgun API key.
+	APIKey string
+	// APIBase is the base URL of the Mailgun API. If empty, the US region
+	// is used; domains in the EU region need MailgunAPIBaseEU.
+	APIBase string
+	// TestMode makes Mailgun accept messages without delivering them.
+	TestMode bool
+	// Template is the name of a template stored in Mailgun. If set, Mailgun
+	// renders the body from it with the variables of the message instead
+	// of sending the body rendered by upmail.
+	Template string
+	// Headers are added to every message.
+	Headers map[string]string
+}
+
+// Name returns "mailgun".
+func (t MailgunTransport) Name() string {
+	return "mailgun"
+}
+
+// Send delivers m through Mailgun, tagged with the tags of m. Without a
+// sender, the message is sent from upmail at the Mailgun domain.
+func (t MailgunTransport) Send(m *Message) error {
+	msg := *m
+	if msg.From == "" {
+		msg.From = "upmail@" + t.Domain
+	}
+	msg.Header = map[string]string{}
+	for k, v := range m.Header {
+		msg.Header[k] = v
+	}
+	for k, v := range t.Headers {
+		msg.SetHeader(k, v)
+	}
+
+	if t.Template != "" {
+		return t.sendTemplate(&msg)
+	}
+
+	b, err := msg.Bytes()
+	if err != nil {
+		return err
+	}
+	to, err := msg.Recipients()
+	if err != nil {
+		return err
+	}
+
+	mailgunClient := mailgun.NewMailgun(t.Domain, t.APIKey, "")
+	if t.APIBase != "" {
+		mailgunClient.SetAPIBase(t.APIBase)
+	}
+
+	message := mailgunClient.NewMIMEMessage(ioutil.NopCloser(bytes.NewReader(b)), to...)
+	for _, tag := range mailgunTags(&msg) {
+		message.AddTag(tag)
+	}
+	if t.TestMode {
+		message.EnableTestMode()
+	}
+
+	resp, id, err := mailgunClient.Send(message)
+	if err != nil {
+		return fmt.Errorf("sending Mailgun message failed: response: %#v error: %v", resp, err)
+	}
+	logrus.Infof("Mailgun send message succeeded: %s %s", id, resp)
+
+	return nil
+}
+
+// sendTemplate sends m rendered from the stored template. mailgun-go
+// predates stored templates, so the message is posted to the API directly.
+func (t MailgunTransport) sendTemplate(m *Message) error {
+	vars, err := json.Marshal(m.Variables)
+	if err != nil {
+		return fmt.Errorf("encoding Mailgun template variables failed: %v", err)
+	}
+
+	form := url.Values{}
+	form.Set("from", m.From)
+	for _, to := range m.To {
+		form.Add("to", to)
+	}
+	form.Set("subject", sanitizeHeader(m.Subject))
+	form.Set("template", t.Template)
+	form.Set("h:X-Mailgun-Variables", string(vars))
+	for k, v := range m.Header {
+		form.Set("h:"+sanitizeHeaderKey(k), sanitizeHeader(v))
+	}
+	for _, tag := range mailgunTags(m) {
+		form.Add("o:tag", tag)
+	}
+	if t.TestMode {
+		form.Set("o:testmode", "yes")
+	}
+
+	base := t.APIBase
+	if base == "" {
+		base = mailgun.ApiBase
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(base, "/")+"/"+t.Domain+"/messages", strings.NewReader(form.Encode()))
+	if err != nil {
+		return fmt.Errorf("creating Mailgun request failed: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("api", t.APIKey)
+
+	client := &http.Client{Timeout: smtpTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending Mailgun template message failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("reading Mailgun template response failed: %s: %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("sending Mailgun template message failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		ID      string `json:"id"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return fmt.Errorf("decoding Mailgun template response %q failed: %v", body, err)
+	}
+	logrus.Infof("Mailgun send template message succeeded: %s %s", result.ID, result.Message)
+
+	return nil
+}
+
+// mailgunTags returns the tags of m as accepted by Mailgun: printable ASCII, at
+// most 128 characters and no more than mailgunMaxTags of them.
+func mailgunTags(m *Message) []string {
+	var tags []string
+	for _, tag := range m.Tags {
+		if len(tags) == mailgunMaxTags {
+			break
+		}
+		tag = strings.Map(func(r rune) rune {
+			if r < ' ' || r > '~' {
+				return '_'
+			}
+			return r
+		}, tag)
+		if len(tag) > 128 {
+			tag = tag[:128]
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
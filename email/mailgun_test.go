@@ -0,0 +1,226 @@
+package email
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// mailgunRequest is what the fake Mailgun API received.
+type mailgunRequest struct {
+	path     string
+	user     string
+	password string
+	form     url.Values
+	mime     string
+}
+
+// newMailgunServer starts a fake Mailgun API that records the messages
+// posted to it.
+func newMailgunServer() (*httptest.Server, func() []mailgunRequest) {
+	var (
+		mu       sync.Mutex
+		requests []mailgunRequest
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req := mailgunRequest{path: r.URL.Path}
+		req.user, req.password, _ = r.BasicAuth()
+
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.form = url.Values(r.MultipartForm.Value)
+			if files := r.MultipartForm.File["message"]; len(files) > 0 {
+				f, err := files[0].Open()
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				b, _ := ioutil.ReadAll(f)
+				f.Close()
+				req.mime = string(b)
+			}
+		} else {
+			if err := r.ParseForm(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			req.form = r.PostForm
+		}
+
+		mu.Lock()
+		requests = append(requests, req)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"id": "<1@mg.example.com>", "message": "Queued. Thank you."})
+	}))
+
+	return srv, func() []mailgunRequest {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]mailgunRequest(nil), requests...)
+	}
+}
+
+func mailgunTestMessage() *Message {
+	m := NewMessage("", []string{"ops@example.com"}, "api is down", "body", "<p>body</p>")
+	m.Tags = []string{"upmail", "alert", "down", "api"}
+	m.Variables = map[string]string{"kind": "alert", "title": "api"}
+	m.SetHeader(TransportHeader, "mailgun")
+	return m
+}
+
+func TestMailgunTransportSend(t *testing.T) {
+	srv, requests := newMailgunServer()
+	defer srv.Close()
+
+	tr := MailgunTransport{
+		Domain:   "mg.example.com",
+		APIKey:   "key-secret",
+		APIBase:  srv.URL + "/v3",
+		TestMode: true,
+		Headers:  map[string]string{"x-team": "ops"},
+	}
+	m := mailgunTestMessage()
+	if err := tr.Send(m); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if _, ok := m.Header["X-Team"]; ok {
+		t.Error("Send added the transport headers to the message of the caller")
+	}
+
+	reqs := requests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(reqs))
+	}
+	req := reqs[0]
+	if req.path != "/v3/mg.example.com/messages.mime" {
+		t.Errorf("posted to %s", req.path)
+	}
+	if req.user != "api" || req.password != "key-secret" {
+		t.Errorf("authenticated as %s:%s", req.user, req.password)
+	}
+	if got := req.form["o:tag"]; strings.Join(got, ",") != "upmail,alert,down" {
+		t.Errorf("tags are %q, want the first %d", got, mailgunMaxTags)
+	}
+	if got := req.form.Get("o:testmode"); got != "yes" {
+		t.Errorf("o:testmode is %q, want yes", got)
+	}
+	if got := req.form.Get("to"); got != "ops@example.com" {
+		t.Errorf("to is %q", got)
+	}
+	for _, want := range []string{
+		"From: <upmail@mg.example.com>\r\n",
+		"X-Team: ops\r\n",
+		"X-Upmail-Transport: mailgun\r\n",
+	} {
+		if !strings.Contains(req.mime, want) {
+			t.Errorf("message lacks %q:\n%s", want, req.mime)
+		}
+	}
+}
+
+func TestMailgunTransportSendTemplate(t *testing.T) {
+	srv, requests := newMailgunServer()
+	defer srv.Close()
+
+	tr := MailgunTransport{
+		Domain:   "mg.example.com",
+		APIKey:   "key-secret",
+		APIBase:  srv.URL + "/v3/",
+		Template: "upmail-alert",
+		Headers:  map[string]string{"x-team": "ops\r\nBcc: evil@example.com"},
+	}
+	if err := tr.Send(mailgunTestMessage()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	reqs := requests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests, want 1", len(reqs))
+	}
+	req := reqs[0]
+	if req.path != "/v3/mg.example.com/messages" {
+		t.Errorf("posted to %s", req.path)
+	}
+	if req.user != "api" || req.password != "key-secret" {
+		t.Errorf("authenticated as %s:%s", req.user, req.password)
+	}
+
+	want := map[string]string{
+		"from":                 "upmail@mg.example.com",
+		"to":                   "ops@example.com",
+		"subject":              "api is down",
+		"template":             "upmail-alert",
+		"h:X-Team":             "ops  Bcc: evil@example.com",
+		"h:X-Upmail-Transport": "mailgun",
+		"o:testmode":           "",
+	}
+	for k, v := range want {
+		if got := req.form.Get(k); got != v {
+			t.Errorf("%s is %q, want %q", k, got, v)
+		}
+	}
+	if got := req.form["o:tag"]; strings.Join(got, ",") != "upmail,alert,down" {
+		t.Errorf("tags are %q, want the first %d", got, mailgunMaxTags)
+	}
+
+	var vars map[string]string
+	if err := json.Unmarshal([]byte(req.form.Get("h:X-Mailgun-Variables")), &vars); err != nil {
+		t.Fatalf("decoding h:X-Mailgun-Variables failed: %v", err)
+	}
+	if vars["kind"] != "alert" || vars["title"] != "api" || len(vars) != 2 {
+		t.Errorf("variables are %v", vars)
+	}
+}
+
+func TestMailgunTransportSendTemplateError(t *testing.T) {
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		wantError string
+	}{
+		{
+			name: "API error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, `{"message": "template not found"}`, http.StatusBadRequest)
+			},
+			wantError: "template not found",
+		},
+		{
+			name: "not JSON",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("<html>gateway</html>"))
+			},
+			wantError: `decoding Mailgun template response "<html>gateway</html>" failed`,
+		},
+		{
+			name: "truncated",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", "100")
+				w.Write([]byte(`{"id": "<1@mg.example.com>", "mess`))
+			},
+			wantError: "reading Mailgun template response failed: 200 OK: unexpected EOF",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+
+			tr := MailgunTransport{Domain: "mg.example.com", APIKey: "key-secret", APIBase: srv.URL, Template: "missing"}
+			err := tr.Send(mailgunTestMessage())
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Fatalf("Send returned %v, want an error containing %q", err, tt.wantError)
+			}
+		})
+	}
+}
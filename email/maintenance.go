@@ -0,0 +1,230 @@
+package email
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sourcegraph/checkup"
+)
+
+// MaintenanceWindow is a planned period during which the checks it matches
+// are still checked but not emailed about. A window is either one-off, from
+// Start until End, or recurs weekly on Days at At for Duration. Conditions
+// that are left empty match every check.
+type MaintenanceWindow struct {
+	// Name identifies the window in logs, notices and the state file.
+	Name string `json:"name"`
+	// Title matches the title of the check.
+	Title Pattern `json:"title,omitempty"`
+	// Endpoint matches the endpoint of the check.
+	Endpoint Pattern `json:"endpoint,omitempty"`
+	// Start is when a one-off window starts.
+	Start time.Time `json:"start,omitempty"`
+	// End is when a one-off window ends.
+	End time.Time `json:"end,omitempty"`
+	// Days are the weekdays a recurring window starts on, such as "tue".
+	Days []string `json:"days,omitempty"`
+	// At is the time of day a recurring window starts, such as "22:00".
+	At string `json:"at,omitempty"`
+	// Duration is how long a recurring window lasts.
+	Duration Duration `json:"duration,omitempty"`
+	// TimeZone is the IANA time zone of At. Empty means UTC.
+	TimeZone string `json:"time_zone,omitempty"`
+	// Comment says what the maintenance is about.
+	Comment string `json:"comment,omitempty"`
+	// Notify sends a notice when the window starts and ends.
+	Notify bool `json:"notify,omitempty"`
+	// Recipients get the notices. Empty means the recipients the matching
+	// checks are routed to when they are down.
+	Recipients []string `json:"recipients,omitempty"`
+
+	// titles limits the window to the checks named in a calendar event.
+	titles []Pattern
+}
+
+// ActiveMaintenance is the persisted state of a maintenance window whose
+// start was notified.
+type ActiveMaintenance struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseWeekday parses a weekday such as "tue" or "Tuesday".
+func parseWeekday(s string) (time.Weekday, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) >= 3 {
+		if d, ok := weekdays[s[:3]]; ok && strings.HasPrefix(strings.ToLower(d.String()), s) {
+			return d, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %q", s)
+}
+
+// recurring reports whether w recurs weekly.
+func (w MaintenanceWindow) recurring() bool {
+	return len(w.Days) > 0
+}
+
+// Validate reports whether the window settings are usable.
+func (w MaintenanceWindow) Validate() error {
+	if w.Name == "" {
+		return fmt.Errorf("maintenance window without a name")
+	}
+
+	if !w.recurring() {
+		if w.Start.IsZero() || !w.End.After(w.Start) {
+			return fmt.Errorf("maintenance window %s needs a start before its end, or days", w.Name)
+		}
+		return nil
+	}
+
+	for _, d := range w.Days {
+		if _, err := parseWeekday(d); err != nil {
+			return fmt.Errorf("maintenance window %s: %v", w.Name, err)
+		}
+	}
+	if _, err := time.Parse("15:04", w.At); err != nil {
+		return fmt.Errorf("maintenance window %s: invalid time %q, expected HH:MM", w.Name, w.At)
+	}
+	if w.Duration <= 0 || time.Duration(w.Duration) > 7*24*time.Hour {
+		return fmt.Errorf("maintenance window %s: duration must be between 0 and 7 days", w.Name)
+	}
+	if _, err := time.LoadLocation(w.TimeZone); err != nil {
+		return fmt.Errorf("maintenance window %s: invalid time zone %q: %v", w.Name, w.TimeZone, err)
+	}
+	return nil
+}
+
+// Match reports whether the window applies to r.
+func (w MaintenanceWindow) Match(r checkup.Result) bool {
+	return w.Title.Match(r.Title) && w.Endpoint.Match(r.Endpoint) && matchesTitles(w.titles, r)
+}
+
+// Active returns the occurrence of the window that t falls in, if any.
+func (w MaintenanceWindow) Active(t time.Time) (start, end time.Time, ok bool) {
+	if !w.recurring() {
+		return w.Start, w.End, !t.Before(w.Start) && t.Before(w.End)
+	}
+
+	loc, err := time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return start, end, false
+	}
+	at, err := time.Parse("15:04", w.At)
+	if err != nil {
+		return start, end, false
+	}
+	days := map[time.Weekday]bool{}
+	for _, d := range w.Days {
+		if wd, err := parseWeekday(d); err == nil {
+			days[wd] = true
+		}
+	}
+
+	// A window lasts at most a week, so it started within the last 7 days.
+	t = t.In(loc)
+	for i := 0; i <= 7; i++ {
+		day := t.AddDate(0, 0, -i)
+		start = time.Date(day.Year(), day.Month(), day.Day(), at.Hour(), at.Minute(), 0, 0, loc)
+		end = start.Add(time.Duration(w.Duration))
+		if days[start.Weekday()] && !t.Before(start) && t.Before(end) {
+			return start, end, true
+		}
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+// maintenance returns the first active maintenance window that applies to r.
+func (n *Notifier) maintenance(r checkup.Result, now time.Time) (MaintenanceWindow, bool) {
+	for _, w := range n.windows {
+		if _, _, ok := w.Active(now); ok && w.Match(r) {
+			return w, true
+		}
+	}
+	return MaintenanceWindow{}, false
+}
+
+// notifyMaintenance sends the notices of the maintenance windows that
+// started or ended since the last run.
+func (n *Notifier) notifyMaintenance(results []checkup.Result, now time.Time) error {
+	var errs checkup.Errors
+	names := map[string]bool{}
+	for _, w := range n.windows {
+		names[w.Name] = true
+		if !w.Notify {
+			continue
+		}
+
+		start, end, active := w.Active(now)
+		prev, notified := n.state.Maintenance[w.Name]
+		switch {
+		case active && (!notified || !prev.Start.Equal(start)):
+			m := ActiveMaintenance{Start: start, End: end}
+			if err := n.sendMaintenance(TemplateMaintenanceStarted, w, m, results, now); err != nil {
+				errs = append(errs, fmt.Errorf("maintenance %s: %v", w.Name, err))
+				continue
+			}
+			if n.state.Maintenance == nil {
+				n.state.Maintenance = map[string]ActiveMaintenance{}
+			}
+			n.state.Maintenance[w.Name] = m
+		case !active && notified:
+			if err := n.sendMaintenance(TemplateMaintenanceEnded, w, prev, results, now); err != nil {
+				errs = append(errs, fmt.Errorf("maintenance %s: %v", w.Name, err))
+				continue
+			}
+			delete(n.state.Maintenance, w.Name)
+		}
+	}
+
+	// Windows that were removed, or calendar events that ended long ago,
+	// are forgotten without a notice.
+	for name := range n.state.Maintenance {
+		if !names[name] {
+			delete(n.state.Maintenance, name)
+		}
+	}
+	if !errs.Empty() {
+		return errs
+	}
+
+	return nil
+}
+
+// sendMaintenance sends a notice about the start or end of a maintenance
+// window listing the checks it applies to.
+func (n *Notifier) sendMaintenance(name string, w MaintenanceWindow, m ActiveMaintenance, results []checkup.Result, now time.Time) error {
+	data := newTemplateData(name, now)
+	data.Maintenance = MaintenanceNotice{
+		Name:    w.Name,
+		Comment: w.Comment,
+		Start:   m.Start,
+		End:     m.End,
+	}
+
+	rcpts := w.Recipients
+	for _, r := range results {
+		if !w.Match(r) {
+			continue
+		}
+		data.Maintenance.Checks = append(data.Maintenance.Checks, newCheckData(r, n.state.Checks[StateKey(r)], now))
+		if len(w.Recipients) == 0 {
+			rcpts = append(rcpts, n.Routing.Recipients(r, checkup.Down)...)
+		}
+	}
+
+	logrus.Infof("maintenance %s %s: sending notice", w.Name, strings.TrimPrefix(name, "maintenance-"))
+	return n.sendTemplate(data, uniqueAddresses(rcpts))
+}
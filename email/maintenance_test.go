@@ -0,0 +1,219 @@
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/checkup"
+)
+
+func TestMaintenanceWindowActive(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04 MST", s, berlin)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	nightly := MaintenanceWindow{
+		Name:     "nightly",
+		Days:     []string{"sat"},
+		At:       "23:00",
+		Duration: Duration(2 * time.Hour),
+		TimeZone: "Europe/Berlin",
+	}
+	// 2026-10-25 is the end of daylight saving time in Berlin, 03:00 CEST
+	// becomes 02:00 CET.
+	autumn := MaintenanceWindow{
+		Name:     "autumn",
+		Days:     []string{"sun"},
+		At:       "01:00",
+		Duration: Duration(3 * time.Hour),
+		TimeZone: "Europe/Berlin",
+	}
+	// 2026-03-29 is the start of daylight saving time in Berlin, 02:00 CET
+	// becomes 03:00 CEST.
+	spring := MaintenanceWindow{
+		Name:     "spring",
+		Days:     []string{"sunday"},
+		At:       "01:00",
+		Duration: Duration(2 * time.Hour),
+		TimeZone: "Europe/Berlin",
+	}
+	oneOff := MaintenanceWindow{
+		Name:  "migration",
+		Start: at("2026-10-20 22:00 CEST"),
+		End:   at("2026-10-21 02:00 CEST"),
+	}
+
+	tests := []struct {
+		name   string
+		window MaintenanceWindow
+		t      string
+		want   string
+	}{
+		{"before a window", nightly, "2026-10-17 22:59 CEST", ""},
+		{"at the start", nightly, "2026-10-17 23:00 CEST", "2026-10-17 23:00 CEST - 2026-10-18 01:00 CEST"},
+		{"after midnight", nightly, "2026-10-18 00:59 CEST", "2026-10-17 23:00 CEST - 2026-10-18 01:00 CEST"},
+		{"at the end", nightly, "2026-10-18 01:00 CEST", ""},
+		{"other weekday", nightly, "2026-10-16 23:30 CEST", ""},
+		{"across midnight into the end of dst", nightly, "2026-10-25 00:30 CEST", "2026-10-24 23:00 CEST - 2026-10-25 01:00 CEST"},
+		{"repeated hour first time", autumn, "2026-10-25 02:30 CEST", "2026-10-25 01:00 CEST - 2026-10-25 03:00 CET"},
+		{"repeated hour second time", autumn, "2026-10-25 02:30 CET", "2026-10-25 01:00 CEST - 2026-10-25 03:00 CET"},
+		{"after the repeated hour", autumn, "2026-10-25 03:00 CET", ""},
+		{"across the start of dst", spring, "2026-03-29 03:30 CEST", "2026-03-29 01:00 CET - 2026-03-29 04:00 CEST"},
+		{"after the start of dst", spring, "2026-03-29 04:00 CEST", ""},
+		{"one-off", oneOff, "2026-10-21 01:00 CEST", "2026-10-20 22:00 CEST - 2026-10-21 02:00 CEST"},
+		{"after a one-off", oneOff, "2026-10-21 02:00 CEST", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.window.Validate(); err != nil {
+				t.Fatalf("Validate: %v", err)
+			}
+
+			start, end, ok := tt.window.Active(at(tt.t))
+			var got string
+			if ok {
+				got = start.In(berlin).Format("2006-01-02 15:04 MST") + " - " + end.In(berlin).Format("2006-01-02 15:04 MST")
+			}
+			if got != tt.want {
+				t.Fatalf("active occurrence is %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotifyMaintenance(t *testing.T) {
+	start := time.Date(2026, 10, 17, 22, 0, 0, 0, time.UTC)
+	daily := MaintenanceWindow{
+		Name:     "backup",
+		Title:    mustParsePattern(t, "db*"),
+		Days:     []string{"mon", "tue", "wed", "thu", "fri", "sat", "sun"},
+		At:       "22:00",
+		Duration: Duration(time.Hour),
+		Notify:   true,
+	}
+
+	tr := &fakeTransport{}
+	n := &Notifier{
+		Transports: []Transport{tr},
+		Routing:    Routing{Default: []string{"ops@example.com"}},
+		windows:    []MaintenanceWindow{daily},
+		state:      &State{Checks: map[string]*CheckState{}},
+	}
+	results := []checkup.Result{testResult("db", "up"), testResult("api", "up")}
+
+	runs := []struct {
+		after time.Duration
+		want  []string
+	}{
+		{-time.Minute, nil},
+		{0, []string{"[UPMAIL]: maintenance backup started"}},
+		{30 * time.Minute, nil},
+		{time.Hour, []string{"[UPMAIL]: maintenance backup ended"}},
+		{2 * time.Hour, nil},
+		// The next occurrence is notified again.
+		{24 * time.Hour, []string{"[UPMAIL]: maintenance backup started"}},
+		{24*time.Hour + time.Minute, nil},
+		{25 * time.Hour, []string{"[UPMAIL]: maintenance backup ended"}},
+	}
+	for _, run := range runs {
+		before := len(tr.subjects())
+		if err := n.notifyMaintenance(results, start.Add(run.after)); err != nil {
+			t.Fatalf("%s: notifyMaintenance: %v", run.after, err)
+		}
+		got := tr.subjects()[before:]
+		if strings.Join(got, "\n") != strings.Join(run.want, "\n") {
+			t.Fatalf("%s: sent %q, want %q", run.after, got, run.want)
+		}
+	}
+	if len(n.state.Maintenance) != 0 {
+		t.Fatalf("state still has maintenance %v", n.state.Maintenance)
+	}
+}
+
+func TestNotifyMaintenanceRetriesFailedNotice(t *testing.T) {
+	start := time.Date(2026, 10, 17, 22, 0, 0, 0, time.UTC)
+	tr := &fakeTransport{down: true}
+	n := &Notifier{
+		Transports: []Transport{tr},
+		Routing:    Routing{Default: []string{"ops@example.com"}},
+		windows: []MaintenanceWindow{{
+			Name:   "migration",
+			Start:  start,
+			End:    start.Add(time.Hour),
+			Notify: true,
+		}},
+		state: &State{Checks: map[string]*CheckState{}},
+	}
+	results := []checkup.Result{testResult("db", "up")}
+
+	if err := n.notifyMaintenance(results, start); err == nil {
+		t.Fatal("notifyMaintenance succeeded while the transport was down")
+	}
+	tr.setDown(false)
+	if err := n.notifyMaintenance(results, start.Add(time.Minute)); err != nil {
+		t.Fatalf("notifyMaintenance: %v", err)
+	}
+	if got := tr.subjects(); len(got) != 1 || got[0] != "[UPMAIL]: maintenance migration started" {
+		t.Fatalf("sent %q, want the start notice", got)
+	}
+}
+
+func TestMaintenanceAlertsAfterWindow(t *testing.T) {
+	now := time.Now()
+	tr := &fakeTransport{}
+	n := &Notifier{
+		Transports: []Transport{tr},
+		Routing:    Routing{Default: []string{"ops@example.com"}},
+		Maintenance: []MaintenanceWindow{{
+			Name:  "migration",
+			Title: mustParsePattern(t, "db"),
+			Start: now.Add(-time.Hour),
+			End:   now.Add(time.Hour),
+		}},
+	}
+
+	// db goes down during the window and is not emailed about.
+	results := []checkup.Result{testResult("db", "up"), testResult("api", "up")}
+	if err := n.Notify(results); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	results = []checkup.Result{testResult("db", "down"), testResult("api", "up")}
+	if err := n.Notify(results); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got := tr.subjects(); len(got) != 0 {
+		t.Fatalf("sent %q during maintenance", got)
+	}
+
+	// Once the window ended, the check that is still down is alerted.
+	n.Maintenance[0].End = now.Add(-time.Minute)
+	if err := n.Notify(results); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	got := tr.subjects()
+	if len(got) != 1 || !strings.Contains(got[0], "db") {
+		t.Fatalf("sent %q after maintenance, want an alert about db", got)
+	}
+
+	// And only once.
+	if err := n.Notify(results); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got := tr.subjects(); len(got) != 1 {
+		t.Fatalf("sent %q, want a single alert", got)
+	}
+}
+
+func mustParsePattern(t *testing.T, s string) Pattern {
+	p, err := ParsePattern(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
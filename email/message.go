@@ -0,0 +1,294 @@
+package email
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxLineLength is the length header lines are folded at, as recommended by
+// RFC 5322 section 2.1.1.
+const maxLineLength = 78
+
+// Message is an email message. It is rendered into an RFC 5322 compliant
+// multipart/alternative message by Bytes and is shared by every transport.
+type Message struct {
+	// From is the address of the sender.
+	From string `json:"from"`
+	// To are the addresses of the recipients.
+	To []string `json:"to"`
+	// Subject is the subject of the message. It may contain any UTF-8
+	// characters, it is encoded as required.
+	Subject string `json:"subject"`
+	// Date is when the message was created.
+	Date time.Time `json:"date"`
+	// MessageID is the globally unique identifier of the message, without
+	// the angle brackets.
+	MessageID string `json:"message_id"`
+	// Header holds additional header fields.
+	Header map[string]string `json:"header,omitempty"`
+	// Text is the plain text body.
+	Text string `json:"text"`
+	// HTML is the HTML body. It is omitted if empty.
+	HTML string `json:"html,omitempty"`
+	// Tags label the message for transports that support it, such as
+	// Mailgun. They are not part of the rendered message.
+	Tags []string `json:"tags,omitempty"`
+	// Variables describe what the message is about for transports that
+	// render messages themselves, such as Mailgun stored templates.
+	Variables map[string]string `json:"variables,omitempty"`
+}
+
+// NewMessage creates a message with a fresh Date and Message-ID.
+func NewMessage(from string, to []string, subject, text, html string) *Message {
+	now := time.Now()
+	return &Message{
+		From:      from,
+		To:        to,
+		Subject:   subject,
+		Date:      now,
+		MessageID: newMessageID(from, now),
+		Text:      text,
+		HTML:      html,
+	}
+}
+
+// SetHeader sets an additional header field.
+func (m *Message) SetHeader(key, value string) {
+	if m.Header == nil {
+		m.Header = map[string]string{}
+	}
+	m.Header[textproto.CanonicalMIMEHeaderKey(key)] = value
+}
+
+// clone returns a copy of m that shares nothing with it, so that transports
+// setting header fields on one do not race with readers of the other.
+func (m *Message) clone() *Message {
+	c := *m
+	c.To = append([]string(nil), m.To...)
+	c.Tags = append([]string(nil), m.Tags...)
+	if m.Header != nil {
+		c.Header = make(map[string]string, len(m.Header))
+		for k, v := range m.Header {
+			c.Header[k] = v
+		}
+	}
+	if m.Variables != nil {
+		c.Variables = make(map[string]string, len(m.Variables))
+		for k, v := range m.Variables {
+			c.Variables[k] = v
+		}
+	}
+	return &c
+}
+
+// Recipients returns the bare addresses of the recipients for use in the
+// SMTP envelope.
+func (m *Message) Recipients() ([]string, error) {
+	var rcpts []string
+	for _, to := range m.To {
+		addrs, err := mail.ParseAddressList(to)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %v", to, err)
+		}
+		for _, a := range addrs {
+			rcpts = append(rcpts, a.Address)
+		}
+	}
+	return rcpts, nil
+}
+
+// Sender returns the bare address of the sender for use in the SMTP
+// envelope.
+func (m *Message) Sender() (string, error) {
+	a, err := m.sender()
+	if err != nil {
+		return "", err
+	}
+	return a.Address, nil
+}
+
+// sender parses the sender of m. Without one, messages are sent from upmail
+// at the hostname, like Mailgun sends them from upmail at its domain.
+func (m *Message) sender() (*mail.Address, error) {
+	if m.From == "" {
+		return &mail.Address{Address: "upmail@" + hostname()}, nil
+	}
+	a, err := mail.ParseAddress(m.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid sender %q: %v", m.From, err)
+	}
+	return a, nil
+}
+
+// Bytes renders the message with CRLF line endings, RFC 2047 encoded header
+// fields and quoted-printable bodies.
+func (m *Message) Bytes() ([]byte, error) {
+	from, err := m.sender()
+	if err != nil {
+		return nil, err
+	}
+
+	var to []string
+	for _, t := range m.To {
+		addrs, err := mail.ParseAddressList(t)
+		if err != nil {
+			return nil, fmt.Errorf("invalid recipient %q: %v", t, err)
+		}
+		for _, a := range addrs {
+			to = append(to, a.String())
+		}
+	}
+	if len(to) < 1 {
+		return nil, fmt.Errorf("message has no recipients")
+	}
+
+	var b bytes.Buffer
+	writeHeader(&b, "From", from.String())
+	writeHeader(&b, "To", strings.Join(to, ", "))
+	writeHeader(&b, "Subject", mime.QEncoding.Encode("utf-8", sanitizeHeader(m.Subject)))
+	writeHeader(&b, "Date", m.Date.Format(time.RFC1123Z))
+	writeHeader(&b, "Message-ID", "<"+sanitizeHeader(m.MessageID)+">")
+
+	keys := make([]string, 0, len(m.Header))
+	for k := range m.Header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		switch k {
+		case "From", "To", "Subject", "Date", "Message-Id", "Mime-Version", "Content-Type", "Content-Transfer-Encoding":
+			// Those are always generated from the message itself.
+			continue
+		}
+		writeHeader(&b, sanitizeHeaderKey(k), mime.QEncoding.Encode("utf-8", sanitizeHeader(m.Header[k])))
+	}
+
+	writeHeader(&b, "MIME-Version", "1.0")
+
+	if m.HTML == "" {
+		writeHeader(&b, "Content-Type", "text/plain; charset=utf-8")
+		writeHeader(&b, "Content-Transfer-Encoding", "quoted-printable")
+		b.WriteString("\r\n")
+		if err := writeQuotedPrintable(&b, m.Text); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for _, part := range []struct {
+		contentType string
+		body        string
+	}{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeQuotedPrintable(pw, part.body); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	writeHeader(&b, "Content-Type", "multipart/alternative; boundary=\""+w.Boundary()+"\"")
+	b.WriteString("\r\n")
+	b.Write(body.Bytes())
+
+	return b.Bytes(), nil
+}
+
+// writeHeader writes a header field, folding it at whitespace so that lines
+// stay within maxLineLength where possible.
+func writeHeader(b *bytes.Buffer, key, value string) {
+	line := key + ":"
+	for _, word := range strings.Fields(value) {
+		if len(line)+1+len(word) > maxLineLength && strings.TrimSpace(line) != key+":" {
+			b.WriteString(line + "\r\n")
+			line = ""
+		}
+		line += " " + word
+	}
+	b.WriteString(line + "\r\n")
+}
+
+// sanitizeHeader replaces line breaks and other control characters in a
+// header value so that untrusted input, such as check titles, cannot inject
+// header fields or a premature body.
+func sanitizeHeader(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, s)
+}
+
+// sanitizeHeaderKey strips everything that is not allowed in a header field
+// name.
+func sanitizeHeaderKey(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == ':' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// writeQuotedPrintable writes s quoted-printable encoded. Line breaks are
+// normalized to CRLF by the encoder.
+func writeQuotedPrintable(w io.Writer, s string) error {
+	qp := quotedprintable.NewWriter(w)
+	if _, err := qp.Write([]byte(s)); err != nil {
+		return err
+	}
+	return qp.Close()
+}
+
+// newMessageID generates a unique message ID in the domain of the sender,
+// falling back to the hostname.
+func newMessageID(from string, now time.Time) string {
+	domain := ""
+	if a, err := mail.ParseAddress(from); err == nil {
+		if i := strings.LastIndex(a.Address, "@"); i >= 0 {
+			domain = a.Address[i+1:]
+		}
+	}
+	if domain == "" {
+		domain = hostname()
+	}
+
+	r := make([]byte, 8)
+	rand.Read(r)
+
+	return fmt.Sprintf("%d.%s.upmail@%s", now.UnixNano(), hex.EncodeToString(r), domain)
+}
+
+// hostname returns the hostname of the machine, or localhost if it is
+// unknown.
+func hostname() string {
+	if h, err := os.Hostname(); err == nil && h != "" {
+		return h
+	}
+	return "localhost"
+}
@@ -0,0 +1,219 @@
+package email
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageWithoutSender(t *testing.T) {
+	m := NewMessage("", []string{"ops@example.com"}, "alert", "body", "")
+
+	from, err := m.Sender()
+	if err != nil {
+		t.Fatalf("Sender: %v", err)
+	}
+	if want := "upmail@" + hostname(); from != want {
+		t.Fatalf("sender is %q, want %q", from, want)
+	}
+
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes: %v", err)
+	}
+	if !strings.Contains(string(b), "From: <"+from+">\r\n") {
+		t.Fatalf("message has no From header for %s:\n%s", from, b)
+	}
+}
+
+func TestMessageInvalidSender(t *testing.T) {
+	m := NewMessage("not an address", []string{"ops@example.com"}, "alert", "body", "")
+	if _, err := m.Sender(); err == nil {
+		t.Fatal("Sender accepted an invalid address")
+	}
+	if _, err := m.Bytes(); err == nil {
+		t.Fatal("Bytes accepted an invalid sender")
+	}
+}
+
+// parseMessage renders m and parses the result.
+func parseMessage(t *testing.T, m *Message) ([]byte, *mail.Message) {
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatalf("Bytes: %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("parsing message: %v\n%s", err, b)
+	}
+	return b, msg
+}
+
+func TestMessageLineEndings(t *testing.T) {
+	to := []string{"ops@example.com", "Database Team <db@example.com>", "Frontend Team <frontend@example.com>"}
+	for _, html := range []string{"", "<p>first</p>\n<p>second</p>"} {
+		m := NewMessage("upmail@example.com", to, "api is down", "first\nsecond\r\nthird\n", html)
+		b, err := m.Bytes()
+		if err != nil {
+			t.Fatalf("Bytes: %v", err)
+		}
+		for i, line := range strings.Split(strings.TrimSuffix(string(b), "\n"), "\n") {
+			if !strings.HasSuffix(line, "\r") {
+				t.Fatalf("line %d %q does not end in CRLF:\n%s", i+1, line, b)
+			}
+			if len(line) > maxLineLength+1 {
+				t.Fatalf("line %d %q is longer than %d characters", i+1, line, maxLineLength)
+			}
+		}
+	}
+}
+
+func TestMessageHeaderInjection(t *testing.T) {
+	m := NewMessage("upmail@example.com", []string{"ops@example.com"}, "api\r\nBcc: evil@example.com\r\n\r\ninjected body", "body", "")
+	m.SetHeader("X-Check", "api\nX-Injected: yes")
+	m.SetHeader("X-Bad:Key\r\nX-Injected", "value")
+
+	b, msg := parseMessage(t, m)
+	for _, h := range []string{"Bcc", "X-Injected"} {
+		if v := msg.Header.Get(h); v != "" {
+			t.Fatalf("injected header %s: %q\n%s", h, v, b)
+		}
+	}
+
+	dec := new(mime.WordDecoder)
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "api Bcc: evil@example.com injected body"; subject != want {
+		t.Fatalf("subject is %q, want %q", subject, want)
+	}
+	if v := msg.Header.Get("X-Check"); v != "api X-Injected: yes" {
+		t.Fatalf("X-Check is %q", v)
+	}
+	if v := msg.Header.Get("X-BadKeyX-Injected"); v != "value" {
+		t.Fatalf("sanitized custom header is %q, want %q\n%s", v, "value", b)
+	}
+
+	body, _ := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+	if string(body) != "body" {
+		t.Fatalf("body is %q, want %q", body, "body")
+	}
+}
+
+func TestMessageEncodedSubject(t *testing.T) {
+	subject := "Dienst „api“ ist ausgefallen – Größe überschritten"
+	b, msg := parseMessage(t, NewMessage("upmail@example.com", []string{"ops@example.com"}, subject, "body", ""))
+
+	header := string(b[:bytes.Index(b, []byte("\r\n\r\n"))])
+	for _, r := range header {
+		if r > '~' {
+			t.Fatalf("header has non-ASCII character %q:\n%s", r, header)
+		}
+	}
+	raw := msg.Header.Get("Subject")
+	if !strings.HasPrefix(raw, "=?utf-8?q?") {
+		t.Fatalf("subject %q is not RFC 2047 encoded", raw)
+	}
+
+	dec := new(mime.WordDecoder)
+	got, err := dec.DecodeHeader(raw)
+	if err != nil {
+		t.Fatalf("decoding subject: %v", err)
+	}
+	if got != subject {
+		t.Fatalf("subject is %q, want %q", got, subject)
+	}
+
+	// ASCII subjects stay readable.
+	_, msg = parseMessage(t, NewMessage("upmail@example.com", []string{"ops@example.com"}, "api is down", "body", ""))
+	if v := msg.Header.Get("Subject"); v != "api is down" {
+		t.Fatalf("subject is %q, want %q", v, "api is down")
+	}
+}
+
+func TestMessageQuotedPrintable(t *testing.T) {
+	text := "Größe = 100%\n" + strings.Repeat("a", 100) + "\n"
+	b, msg := parseMessage(t, NewMessage("upmail@example.com", []string{"ops@example.com"}, "api is down", text, ""))
+
+	if v := msg.Header.Get("Content-Transfer-Encoding"); v != "quoted-printable" {
+		t.Fatalf("Content-Transfer-Encoding is %q", v)
+	}
+	raw, _ := ioutil.ReadAll(msg.Body)
+	if !strings.Contains(string(raw), "Gr=C3=B6=C3=9Fe =3D 100%\r\n") {
+		t.Fatalf("body is not quoted-printable encoded:\n%s", b)
+	}
+	for _, line := range strings.Split(string(raw), "\r\n") {
+		if len(line) > 76 {
+			t.Fatalf("body line %q is longer than 76 characters", line)
+		}
+	}
+
+	body, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(raw)))
+	if err != nil {
+		t.Fatalf("decoding body: %v", err)
+	}
+	if want := strings.Replace(text, "\n", "\r\n", -1); string(body) != want {
+		t.Fatalf("decoded body is %q, want %q", body, want)
+	}
+}
+
+func TestMessageHeaders(t *testing.T) {
+	date := time.Date(2026, 10, 17, 9, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+	m := NewMessage("Upmail <upmail@example.com>", []string{"ops@example.com"}, "api is down", "body", "<p>body</p>")
+	m.Date = date
+	m.MessageID = "1.abc.upmail@example.com"
+
+	_, msg := parseMessage(t, m)
+	for k, want := range map[string]string{
+		"Date":         "Sat, 17 Oct 2026 09:30:00 +0200",
+		"Message-Id":   "<1.abc.upmail@example.com>",
+		"Mime-Version": "1.0",
+	} {
+		if v := msg.Header.Get(k); v != want {
+			t.Errorf("%s is %q, want %q", k, v, want)
+		}
+	}
+	if d, err := msg.Header.Date(); err != nil || !d.Equal(date) {
+		t.Errorf("Date parses as %v (%v), want %v", d, err, date)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parsing Content-Type: %v", err)
+	}
+	if mediaType != "multipart/alternative" {
+		t.Fatalf("Content-Type is %q, want multipart/alternative", mediaType)
+	}
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	var parts []string
+	for {
+		p, err := r.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading part: %v", err)
+		}
+		parts = append(parts, p.Header.Get("Content-Type"))
+	}
+	if want := "text/plain; charset=utf-8,text/html; charset=utf-8"; strings.Join(parts, ",") != want {
+		t.Fatalf("parts are %q, want %q", parts, want)
+	}
+
+	// Without HTML the message is plain text.
+	_, msg = parseMessage(t, NewMessage("upmail@example.com", []string{"ops@example.com"}, "api is down", "body", ""))
+	if v := msg.Header.Get("Content-Type"); v != "text/plain; charset=utf-8" {
+		t.Fatalf("Content-Type is %q, want text/plain", v)
+	}
+	if msg.Header.Get("Date") == "" || msg.Header.Get("Message-Id") == "" {
+		t.Fatalf("message lacks a Date or Message-ID: %v", msg.Header)
+	}
+}
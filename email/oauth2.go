@@ -0,0 +1,237 @@
+package email
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// AuthXOAUTH2 is the XOAUTH2 mechanism used by Gmail and Microsoft 365.
+const AuthXOAUTH2 = "xoauth2"
+
+// tokenExpiryDelta is how long before its expiry an access token is
+// refreshed.
+const tokenExpiryDelta = time.Minute
+
+// OAuth2Config holds the OAuth2 client credentials used to obtain access
+// tokens for XOAUTH2.
+type OAuth2Config struct {
+	// ClientID is the OAuth2 client ID.
+	ClientID string `json:"client_id"`
+	// ClientSecret is the OAuth2 client secret.
+	ClientSecret string `json:"client_secret"`
+	// RefreshToken is the long lived token access tokens are obtained with.
+	RefreshToken string `json:"refresh_token"`
+	// TokenURL is the token endpoint of the provider, for example
+	// https://oauth2.googleapis.com/token or
+	// https://login.microsoftonline.com/<tenant>/oauth2/v2.0/token.
+	TokenURL string `json:"token_url"`
+	// Scopes are the scopes to request, if the provider requires them.
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// OAuth2TokenSource obtains access tokens with a refresh token and caches
+// them until shortly before they expire.
+type OAuth2TokenSource struct {
+	config OAuth2Config
+	client *http.Client
+	// file keeps the refresh token across restarts if the provider
+	// rotates it.
+	file string
+	// replaces identifies the refresh token of the config a token in file
+	// replaces.
+	replaces string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// oauth2TokenFile is the content of the file a rotated refresh token is
+// kept in.
+type oauth2TokenFile struct {
+	// Replaces is the SHA-256 of the refresh token of the config the
+	// rotated token replaces, so that a new token in the config wins.
+	Replaces string `json:"replaces"`
+	// RefreshToken is the rotated refresh token.
+	RefreshToken string `json:"refresh_token"`
+}
+
+// NewOAuth2TokenSource returns a token source for config. Providers may
+// rotate the refresh token and invalidate the old one, so a rotated refresh
+// token is written to file and used instead of the one in config after a
+// restart, until config gets a different refresh token. An empty file keeps
+// rotated tokens in memory only.
+func NewOAuth2TokenSource(config OAuth2Config, file string) (*OAuth2TokenSource, error) {
+	if config.TokenURL == "" {
+		return nil, errors.New("oauth2: token_url cannot be empty")
+	}
+	if config.ClientID == "" || config.RefreshToken == "" {
+		return nil, errors.New("oauth2: client_id and refresh_token cannot be empty")
+	}
+
+	sum := sha256.Sum256([]byte(config.RefreshToken))
+	s := &OAuth2TokenSource{
+		config:   config,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		file:     file,
+		replaces: hex.EncodeToString(sum[:]),
+	}
+	if file == "" {
+		return s, nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("oauth2: reading token file %s failed: %v", file, err)
+	}
+	var f oauth2TokenFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("oauth2: decoding token file %s failed: %v", file, err)
+	}
+	if f.Replaces == s.replaces && f.RefreshToken != "" {
+		s.config.RefreshToken = f.RefreshToken
+	}
+	return s, nil
+}
+
+// Token returns a valid access token, refreshing it if needed.
+func (s *OAuth2TokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Now().Add(tokenExpiryDelta).Before(s.expiry) {
+		return s.token, nil
+	}
+
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {s.config.RefreshToken},
+		"client_id":     {s.config.ClientID},
+	}
+	if s.config.ClientSecret != "" {
+		form.Set("client_secret", s.config.ClientSecret)
+	}
+	if len(s.config.Scopes) > 0 {
+		form.Set("scope", strings.Join(s.config.Scopes, " "))
+	}
+
+	resp, err := s.client.PostForm(s.config.TokenURL, form)
+	if err != nil {
+		return "", fmt.Errorf("oauth2: refreshing access token failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("oauth2: reading token response failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("oauth2: refreshing access token failed: %s: %s", resp.Status, body)
+	}
+
+	var t struct {
+		AccessToken  string `json:"access_token"`
+		ExpiresIn    int64  `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(body, &t); err != nil {
+		return "", fmt.Errorf("oauth2: decoding token response failed: %v", err)
+	}
+	if t.AccessToken == "" {
+		return "", errors.New("oauth2: token response contains no access_token")
+	}
+
+	s.token = t.AccessToken
+	s.expiry = time.Now().Add(time.Duration(t.ExpiresIn) * time.Second)
+	if t.ExpiresIn == 0 {
+		// Without an expiry the token is only used once.
+		s.expiry = time.Now()
+	}
+	if t.RefreshToken != "" && t.RefreshToken != s.config.RefreshToken {
+		// Some providers rotate the refresh token.
+		s.config.RefreshToken = t.RefreshToken
+		if err := s.save(); err != nil {
+			logrus.Warnf("keeping the rotated refresh token in memory only: %v", err)
+		}
+	}
+
+	return s.token, nil
+}
+
+// save writes the current refresh token to the token file.
+func (s *OAuth2TokenSource) save() error {
+	if s.file == "" {
+		return nil
+	}
+	b, err := json.MarshalIndent(oauth2TokenFile{Replaces: s.replaces, RefreshToken: s.config.RefreshToken}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("oauth2: encoding token file failed: %v", err)
+	}
+	if err := writeFileAtomic(s.file, b); err != nil {
+		return fmt.Errorf("oauth2: writing token file failed: %v", err)
+	}
+	return nil
+}
+
+// invalidate forgets the cached access token, so the next call to Token
+// refreshes it.
+func (s *OAuth2TokenSource) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = ""
+}
+
+// NewXOAUTH2Auth returns an smtp.Auth that authenticates username with
+// access tokens from tokens using the SASL XOAUTH2 mechanism.
+func NewXOAUTH2Auth(username, host string, tokens *OAuth2TokenSource) smtp.Auth {
+	return &xoauth2Auth{username: username, host: host, tokens: tokens}
+}
+
+type xoauth2Auth struct {
+	username string
+	host     string
+	tokens   *OAuth2TokenSource
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS && !isLocalhost(server.Name) {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	if server.Name != a.host {
+		return "", nil, errors.New("wrong host name")
+	}
+
+	token, err := a.tokens.Token()
+	if err != nil {
+		return "", nil, err
+	}
+
+	return "XOAUTH2", []byte("user=" + a.username + "\x01auth=Bearer " + token + "\x01\x01"), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if more {
+		// The server sends a JSON error as challenge and expects an empty
+		// response before failing the authentication. The token might have
+		// been revoked, so get a new one next time.
+		a.tokens.invalidate()
+		return []byte{}, nil
+	}
+	return nil, nil
+}
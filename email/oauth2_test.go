@@ -0,0 +1,255 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// tokenServer is a fake OAuth2 token endpoint. Every refresh issues a new
+// access token and, if rotate is set, a new refresh token.
+type tokenServer struct {
+	expiresIn int
+	rotate    bool
+
+	mu            sync.Mutex
+	refreshTokens []string
+}
+
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.PostForm.Get("grant_type") != "refresh_token" || r.PostForm.Get("client_id") != "client" || r.PostForm.Get("client_secret") != "secret" {
+		http.Error(w, `{"error": "invalid_client"}`, http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	s.refreshTokens = append(s.refreshTokens, r.PostForm.Get("refresh_token"))
+	n := len(s.refreshTokens)
+	s.mu.Unlock()
+
+	resp := map[string]interface{}{
+		"access_token": fmt.Sprintf("access-%d", n),
+		"expires_in":   s.expiresIn,
+		"token_type":   "Bearer",
+	}
+	if s.rotate {
+		resp["refresh_token"] = fmt.Sprintf("refresh-%d", n+1)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// refreshes returns the refresh tokens the server was called with.
+func (s *tokenServer) refreshes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.refreshTokens...)
+}
+
+func newTestTokenSource(t *testing.T, url string) *OAuth2TokenSource {
+	tokens, err := NewOAuth2TokenSource(OAuth2Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RefreshToken: "refresh-1",
+		TokenURL:     url,
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func TestOAuth2TokenSource(t *testing.T) {
+	tests := []struct {
+		name      string
+		expiresIn int
+		rotate    bool
+		// calls is the number of calls to Token.
+		calls     int
+		tokens    []string
+		refreshes []string
+	}{
+		{
+			name:      "cached until expiry",
+			expiresIn: 3600,
+			calls:     3,
+			tokens:    []string{"access-1", "access-1", "access-1"},
+			refreshes: []string{"refresh-1"},
+		},
+		{
+			name:      "refreshed shortly before expiry",
+			expiresIn: 30,
+			calls:     2,
+			tokens:    []string{"access-1", "access-2"},
+			refreshes: []string{"refresh-1", "refresh-1"},
+		},
+		{
+			name:      "without expiry used once",
+			calls:     2,
+			tokens:    []string{"access-1", "access-2"},
+			refreshes: []string{"refresh-1", "refresh-1"},
+		},
+		{
+			name:      "rotated refresh token is used",
+			expiresIn: 30,
+			rotate:    true,
+			calls:     3,
+			tokens:    []string{"access-1", "access-2", "access-3"},
+			refreshes: []string{"refresh-1", "refresh-2", "refresh-3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := &tokenServer{expiresIn: tt.expiresIn, rotate: tt.rotate}
+			srv := httptest.NewServer(ts)
+			defer srv.Close()
+
+			tokens := newTestTokenSource(t, srv.URL)
+			var got []string
+			for i := 0; i < tt.calls; i++ {
+				token, err := tokens.Token()
+				if err != nil {
+					t.Fatalf("Token: %v", err)
+				}
+				got = append(got, token)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.tokens, ",") {
+				t.Errorf("tokens are %q, want %q", got, tt.tokens)
+			}
+			if got := ts.refreshes(); strings.Join(got, ",") != strings.Join(tt.refreshes, ",") {
+				t.Errorf("refreshed with %q, want %q", got, tt.refreshes)
+			}
+		})
+	}
+}
+
+func TestOAuth2TokenSourceKeepsRotatedToken(t *testing.T) {
+	ts := &tokenServer{expiresIn: 30, rotate: true}
+	srv := httptest.NewServer(ts)
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "upmail-oauth2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "upmail.oauth2.json")
+
+	config := OAuth2Config{
+		ClientID:     "client",
+		ClientSecret: "secret",
+		RefreshToken: "refresh-1",
+		TokenURL:     srv.URL,
+	}
+	token := func(config OAuth2Config) {
+		tokens, err := NewOAuth2TokenSource(config, file)
+		if err != nil {
+			t.Fatalf("NewOAuth2TokenSource: %v", err)
+		}
+		if _, err := tokens.Token(); err != nil {
+			t.Fatalf("Token: %v", err)
+		}
+	}
+
+	// The rotated token is used after a restart.
+	token(config)
+	token(config)
+	if got, want := ts.refreshes(), []string{"refresh-1", "refresh-2"}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("refreshed with %q, want %q", got, want)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Fatalf("token file has mode %o, want 600", mode)
+	}
+
+	// A new refresh token in the config replaces the kept one.
+	config.RefreshToken = "refresh-new"
+	token(config)
+	if got := ts.refreshes(); got[len(got)-1] != "refresh-new" {
+		t.Fatalf("refreshed with %q, want the token of the config", got)
+	}
+	token(config)
+	if got := ts.refreshes(); got[len(got)-1] != "refresh-4" {
+		t.Fatalf("refreshed with %q, want the token rotated from the new one", got)
+	}
+
+	// A broken file is reported instead of silently using a token that
+	// might have been invalidated.
+	if err := ioutil.WriteFile(file, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewOAuth2TokenSource(config, file); err == nil {
+		t.Fatal("NewOAuth2TokenSource accepted a broken token file")
+	}
+}
+
+func TestOAuth2TokenSourceError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error": "invalid_grant"}`, http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	if _, err := newTestTokenSource(t, srv.URL).Token(); err == nil || !strings.Contains(err.Error(), "invalid_grant") {
+		t.Fatalf("Token returned %v, want the error of the token endpoint", err)
+	}
+}
+
+func TestXOAUTH2AuthInvalidatesToken(t *testing.T) {
+	ts := &tokenServer{expiresIn: 3600}
+	srv := httptest.NewServer(ts)
+	defer srv.Close()
+
+	auth := NewXOAUTH2Auth("ops@example.com", "smtp.example.com", newTestTokenSource(t, srv.URL))
+	server := &smtp.ServerInfo{Name: "smtp.example.com", TLS: true, Auth: []string{"XOAUTH2"}}
+
+	start := func() string {
+		mech, resp, err := auth.Start(server)
+		if err != nil {
+			t.Fatalf("Start: %v", err)
+		}
+		if mech != "XOAUTH2" {
+			t.Fatalf("mechanism is %s, want XOAUTH2", mech)
+		}
+		return string(resp)
+	}
+
+	if got, want := start(), "user=ops@example.com\x01auth=Bearer access-1\x01\x01"; got != want {
+		t.Fatalf("initial response is %q, want %q", got, want)
+	}
+
+	// A successful authentication keeps the token.
+	if _, err := auth.Next(nil, false); err != nil {
+		t.Fatalf("Next: %v", err)
+	}
+	if got := start(); !strings.Contains(got, "Bearer access-1") {
+		t.Fatalf("token was refreshed after a successful authentication: %q", got)
+	}
+
+	// The server answers a rejected token with a JSON challenge.
+	resp, err := auth.Next([]byte(`{"status":"401","schemes":"bearer"}`), true)
+	if err != nil || len(resp) != 0 {
+		t.Fatalf("Next returned %q, %v, want an empty response", resp, err)
+	}
+	if got := start(); !strings.Contains(got, "Bearer access-2") {
+		t.Fatalf("token was not refreshed after a failed challenge: %q", got)
+	}
+
+	if _, _, err := auth.Start(&smtp.ServerInfo{Name: "smtp.example.com", Auth: []string{"XOAUTH2"}}); err == nil {
+		t.Fatal("Start sent the token over an unencrypted connection")
+	}
+}
@@ -0,0 +1,273 @@
+package email
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Default retry settings of the outbox.
+const (
+	DefaultOutboxMaxAge     = 24 * time.Hour
+	DefaultOutboxMinBackoff = 30 * time.Second
+	DefaultOutboxMaxBackoff = 30 * time.Minute
+)
+
+// OutboxEntry is a message waiting to be retried.
+type OutboxEntry struct {
+	// Message is the message to deliver.
+	Message *Message `json:"message"`
+	// Created is when the first delivery attempt failed.
+	Created time.Time `json:"created"`
+	// Attempts is the number of failed delivery attempts.
+	Attempts int `json:"attempts"`
+	// NextAttempt is when the message is retried next.
+	NextAttempt time.Time `json:"next_attempt"`
+	// LastError is the error of the last failed attempt.
+	LastError string `json:"last_error"`
+}
+
+// Outbox persists messages that could not be delivered in a directory, one
+// JSON file per message, and schedules their retries with exponential
+// backoff and jitter until they reach MaxAge.
+type Outbox struct {
+	// Dir is the directory the messages are stored in.
+	Dir string
+	// MaxAge is how long a message is retried before it is dropped.
+	MaxAge time.Duration
+	// MinBackoff is the delay before the first retry.
+	MinBackoff time.Duration
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*OutboxEntry
+}
+
+// Load reads the messages left over from a previous run. Entries that cannot
+// be read are skipped with a warning and renamed to end in ".corrupt".
+func (o *Outbox) Load() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.entries = map[string]*OutboxEntry{}
+	if err := os.MkdirAll(o.Dir, 0700); err != nil {
+		return fmt.Errorf("creating outbox %s failed: %v", o.Dir, err)
+	}
+
+	files, err := ioutil.ReadDir(o.Dir)
+	if err != nil {
+		return fmt.Errorf("reading outbox %s failed: %v", o.Dir, err)
+	}
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(o.Dir, f.Name()))
+		if err != nil {
+			o.quarantine(f.Name(), fmt.Errorf("reading failed: %v", err))
+			continue
+		}
+		var e OutboxEntry
+		if err := json.Unmarshal(b, &e); err != nil {
+			o.quarantine(f.Name(), fmt.Errorf("decoding failed: %v", err))
+			continue
+		}
+		if e.Message == nil {
+			o.quarantine(f.Name(), errors.New("it has no message"))
+			continue
+		}
+		o.entries[strings.TrimSuffix(f.Name(), ".json")] = &e
+	}
+
+	return nil
+}
+
+// quarantine moves an unreadable entry out of the way, so that it neither
+// keeps the other messages from being delivered nor is loaded again, and
+// leaves it next to the others for inspection.
+func (o *Outbox) quarantine(name string, err error) {
+	file := filepath.Join(o.Dir, name)
+	if rerr := os.Rename(file, file+".corrupt"); rerr != nil {
+		logrus.Warnf("Skipping outbox entry %s: %v, moving it aside failed: %v", file, err, rerr)
+		return
+	}
+	logrus.Warnf("Skipping outbox entry %s: %v, moved it to %s.corrupt", file, err, file)
+}
+
+// Len returns the number of queued messages.
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.entries)
+}
+
+// Add queues a message whose delivery failed with err.
+func (o *Outbox) Add(m *Message, err error, now time.Time) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.entries == nil {
+		o.entries = map[string]*OutboxEntry{}
+	}
+
+	e := &OutboxEntry{
+		Message:   m.clone(),
+		Created:   now,
+		Attempts:  1,
+		LastError: err.Error(),
+	}
+	e.NextAttempt = now.Add(o.backoff(e.Attempts))
+
+	id := outboxID(m)
+	o.entries[id] = e
+	return o.write(id, e)
+}
+
+// Due returns the IDs of the messages that should be retried at now, oldest
+// first. Messages are delivered in the order they were queued, so nothing is
+// due until the oldest message is, and then every message is.
+func (o *Outbox) Due(now time.Time) []string {
+	ids := o.All()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if e, ok := o.entries[ids[0]]; !ok || e.NextAttempt.After(now) {
+		return nil
+	}
+	return ids
+}
+
+// All returns the IDs of every queued message, oldest first.
+func (o *Outbox) All() []string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	ids := make([]string, 0, len(o.entries))
+	for id := range o.entries {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := o.entries[ids[i]], o.entries[ids[j]]
+		if !a.Created.Equal(b.Created) {
+			return a.Created.Before(b.Created)
+		}
+		return a.Message.Date.Before(b.Message.Date)
+	})
+	return ids
+}
+
+// Message returns a copy of the queued message with the given ID.
+func (o *Outbox) Message(id string) *Message {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if e, ok := o.entries[id]; ok {
+		return e.Message.clone()
+	}
+	return nil
+}
+
+// Delivered removes a message after it was delivered.
+func (o *Outbox) Delivered(id string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.remove(id)
+}
+
+// Failed records another failed delivery attempt and schedules the next
+// one. It reports whether the message was dropped because it exceeded
+// MaxAge.
+func (o *Outbox) Failed(id string, err error, now time.Time) (bool, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	e, ok := o.entries[id]
+	if !ok {
+		return false, nil
+	}
+
+	if now.Sub(e.Created) >= o.maxAge() {
+		return true, o.remove(id)
+	}
+
+	e.Attempts++
+	e.LastError = err.Error()
+	e.NextAttempt = now.Add(o.backoff(e.Attempts))
+	return false, o.write(id, e)
+}
+
+// backoff returns the delay after the given number of failed attempts,
+// doubling from MinBackoff up to MaxBackoff with 20% of jitter either way.
+func (o *Outbox) backoff(attempts int) time.Duration {
+	min, max := o.MinBackoff, o.MaxBackoff
+	if min <= 0 {
+		min = DefaultOutboxMinBackoff
+	}
+	if max <= 0 {
+		max = DefaultOutboxMaxBackoff
+	}
+
+	d := min
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+
+	jitter := time.Duration(rand.Int63n(int64(d)/5*2+1)) - d/5
+	return d + jitter
+}
+
+func (o *Outbox) maxAge() time.Duration {
+	if o.MaxAge <= 0 {
+		return DefaultOutboxMaxAge
+	}
+	return o.MaxAge
+}
+
+// write persists an entry. o.mu must be held.
+func (o *Outbox) write(id string, e *OutboxEntry) error {
+	b, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding outbox entry failed: %v", err)
+	}
+
+	// The entry is only readable by the owner, like every file
+	// writeFileAtomic creates.
+	if err := writeFileAtomic(filepath.Join(o.Dir, id+".json"), b); err != nil {
+		return fmt.Errorf("writing outbox entry failed: %v", err)
+	}
+	return nil
+}
+
+// remove deletes an entry. o.mu must be held.
+func (o *Outbox) remove(id string) error {
+	delete(o.entries, id)
+	if err := os.Remove(filepath.Join(o.Dir, id+".json")); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("removing outbox entry failed: %v", err)
+	}
+	return nil
+}
+
+// outboxID derives a file name safe ID from the Message-ID.
+func outboxID(m *Message) string {
+	sum := sha1.Sum([]byte(m.MessageID))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,306 @@
+package email
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport records the messages it delivers and fails while down is
+// set.
+type fakeTransport struct {
+	mu       sync.Mutex
+	down     bool
+	sent     []string
+	to       []string
+	msgs     []*Message
+	attempts int
+}
+
+func (t *fakeTransport) Name() string { return "fake" }
+
+func (t *fakeTransport) Send(m *Message) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.attempts++
+	if t.down {
+		return errors.New("connection refused")
+	}
+	t.sent = append(t.sent, m.Subject)
+	t.to = append(t.to, strings.Join(m.To, ","))
+	t.msgs = append(t.msgs, m)
+	return nil
+}
+
+func (t *fakeTransport) setDown(down bool) {
+	t.mu.Lock()
+	t.down = down
+	t.mu.Unlock()
+}
+
+func (t *fakeTransport) subjects() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.sent...)
+}
+
+func (t *fakeTransport) messages() []*Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*Message(nil), t.msgs...)
+}
+
+// delivered returns "<recipients>: <subject>" for every delivered message.
+func (t *fakeTransport) delivered() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var d []string
+	for i := range t.sent {
+		d = append(d, t.to[i]+": "+t.sent[i])
+	}
+	return d
+}
+
+// newTestOutbox returns an outbox in a temporary directory and a function
+// that removes it.
+func newTestOutbox(t *testing.T) (*Outbox, func()) {
+	dir, err := ioutil.TempDir("", "upmail-outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := &Outbox{Dir: dir, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	if err := o.Load(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return o, func() { os.RemoveAll(dir) }
+}
+
+func testMessage(subject string) *Message {
+	return NewMessage("upmail@example.com", []string{"ops@example.com"}, subject, "body", "")
+}
+
+func TestDeliverKeepsOrder(t *testing.T) {
+	tr := &fakeTransport{down: true}
+	o, cleanup := newTestOutbox(t)
+	defer cleanup()
+	n := &Notifier{Transports: []Transport{tr}, Outbox: o}
+
+	if err := n.deliver(testMessage("alert")); err != nil {
+		t.Fatalf("deliver alert: %v", err)
+	}
+	if n.Outbox.Len() != 1 {
+		t.Fatalf("outbox depth is %d, want 1", n.Outbox.Len())
+	}
+
+	// Still down: the recovery is queued behind the alert.
+	if err := n.deliver(testMessage("recovery 1")); err != nil {
+		t.Fatalf("deliver recovery: %v", err)
+	}
+	if n.Outbox.Len() != 2 {
+		t.Fatalf("outbox depth is %d, want 2", n.Outbox.Len())
+	}
+
+	// Back up: the queued messages go first once their backoff passed.
+	tr.setDown(false)
+	time.Sleep(10 * time.Millisecond)
+	if err := n.deliver(testMessage("recovery 2")); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	want := []string{"alert", "recovery 1", "recovery 2"}
+	got := tr.subjects()
+	if len(got) != len(want) {
+		t.Fatalf("sent %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("sent %q, want %q", got, want)
+		}
+	}
+	if n.Outbox.Len() != 0 {
+		t.Fatalf("outbox depth is %d, want 0", n.Outbox.Len())
+	}
+}
+
+func TestDeliverWaitsForBackoff(t *testing.T) {
+	tr := &fakeTransport{down: true}
+	o, cleanup := newTestOutbox(t)
+	defer cleanup()
+	o.MinBackoff, o.MaxBackoff = time.Hour, time.Hour
+	n := &Notifier{Transports: []Transport{tr}, Outbox: o}
+
+	if err := n.deliver(testMessage("alert")); err != nil {
+		t.Fatalf("deliver alert: %v", err)
+	}
+
+	// The alert is not due, so neither it nor the new messages are sent,
+	// even once the transport is back up.
+	if err := n.deliver(testMessage("recovery 1")); err != nil {
+		t.Fatalf("deliver recovery: %v", err)
+	}
+	tr.setDown(false)
+	if err := n.deliver(testMessage("recovery 2")); err != nil {
+		t.Fatalf("deliver: %v", err)
+	}
+	if tr.attempts != 1 {
+		t.Fatalf("transport was tried %d times, want 1", tr.attempts)
+	}
+	if n.Outbox.Len() != 3 {
+		t.Fatalf("outbox depth is %d, want 3", n.Outbox.Len())
+	}
+
+	n.FlushOutbox()
+	want := []string{"alert", "recovery 1", "recovery 2"}
+	got := tr.subjects()
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("sent %q, want %q", got, want)
+	}
+}
+
+func TestOutboxDueWaitsForOldest(t *testing.T) {
+	o, cleanup := newTestOutbox(t)
+	defer cleanup()
+	now := time.Now()
+
+	if err := o.Add(testMessage("old"), errors.New("down"), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Add(testMessage("new"), errors.New("down"), now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	old := o.All()[0]
+	o.entries[old].NextAttempt = now.Add(time.Hour)
+	if ids := o.Due(now.Add(time.Minute)); len(ids) != 0 {
+		t.Fatalf("due %v before the oldest message is due", ids)
+	}
+	if ids := o.Due(now.Add(2 * time.Hour)); len(ids) != 2 || ids[0] != old {
+		t.Fatalf("due %v, want both messages oldest first", ids)
+	}
+}
+
+func TestOutboxMessageIsCopy(t *testing.T) {
+	o, cleanup := newTestOutbox(t)
+	defer cleanup()
+	if err := o.Add(testMessage("alert"), errors.New("down"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	id := o.All()[0]
+	m := o.Message(id)
+	m.SetHeader(TransportHeader, "changed")
+	if _, ok := o.Message(id).Header[TransportHeader]; ok {
+		t.Fatal("changing the returned message changed the queued one")
+	}
+}
+
+func TestFlushOutboxWhileRetrying(t *testing.T) {
+	tr := &fakeTransport{down: true}
+	o, cleanup := newTestOutbox(t)
+	defer cleanup()
+	n := &Notifier{Transports: []Transport{tr}, Outbox: o}
+	for _, s := range []string{"a", "b", "c"} {
+		if err := n.Outbox.Add(testMessage(s), errors.New("down"), time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		n.RetryOutbox(time.Millisecond, stop)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	tr.setDown(false)
+	close(stop)
+	n.FlushOutbox()
+	<-done
+
+	if got := tr.subjects(); len(got) != 3 {
+		t.Fatalf("sent %q, want every message once", got)
+	}
+	if n.Outbox.Len() != 0 {
+		t.Fatalf("outbox depth is %d, want 0", n.Outbox.Len())
+	}
+}
+
+func TestOutboxEntriesArePrivate(t *testing.T) {
+	o, cleanup := newTestOutbox(t)
+	defer cleanup()
+	if err := o.Add(testMessage("alert"), errors.New("down"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := ioutil.ReadDir(o.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("outbox has %d files, want 1", len(files))
+	}
+	if mode := files[0].Mode().Perm(); mode != 0600 {
+		t.Fatalf("outbox entry has mode %o, want 600", mode)
+	}
+
+	// Entries survive a restart.
+	reloaded := &Outbox{Dir: o.Dir}
+	if err := reloaded.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded.Len() != 1 {
+		t.Fatalf("reloaded outbox depth is %d, want 1", reloaded.Len())
+	}
+}
+
+func TestOutboxLoadSkipsCorruptEntries(t *testing.T) {
+	o, cleanup := newTestOutbox(t)
+	defer cleanup()
+	if err := o.Add(testMessage("alert"), errors.New("down"), time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"truncated.json":  `{"message": {"subject": "al`,
+		"no-message.json": `{"attempts": 3}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(o.Dir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloaded := &Outbox{Dir: o.Dir}
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if reloaded.Len() != 1 {
+		t.Fatalf("reloaded outbox depth is %d, want 1", reloaded.Len())
+	}
+	if m := reloaded.Message(reloaded.All()[0]); m.Subject != "alert" {
+		t.Fatalf("reloaded %q, want the alert", m.Subject)
+	}
+
+	// The corrupt entries are moved aside and not loaded again.
+	files, err := ioutil.ReadDir(o.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var corrupt []string
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".corrupt") {
+			corrupt = append(corrupt, f.Name())
+		}
+	}
+	if strings.Join(corrupt, ",") != "no-message.json.corrupt,truncated.json.corrupt" {
+		t.Fatalf("corrupt entries are %q", corrupt)
+	}
+	if err := reloaded.Load(); err != nil || reloaded.Len() != 1 {
+		t.Fatalf("second Load loaded %d messages, %v", reloaded.Len(), err)
+	}
+}
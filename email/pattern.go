@@ -0,0 +1,90 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Pattern matches strings against a shell-style glob, where "*" matches any
+// sequence of characters and "?" any single character, or, if prefixed with
+// "~", against an anchored regular expression. The empty pattern matches
+// everything.
+type Pattern struct {
+	raw string
+	re  *regexp.Regexp
+}
+
+// ParsePattern parses a glob or "~" prefixed regular expression.
+func ParsePattern(s string) (Pattern, error) {
+	p := Pattern{raw: s}
+	if s == "" {
+		return p, nil
+	}
+
+	expr := ""
+	if strings.HasPrefix(s, "~") {
+		expr = "^(?:" + s[1:] + ")$"
+	} else {
+		var b strings.Builder
+		b.WriteString("^")
+		for _, r := range s {
+			switch r {
+			case '*':
+				b.WriteString(".*")
+			case '?':
+				b.WriteString(".")
+			default:
+				b.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		b.WriteString("$")
+		expr = b.String()
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return p, fmt.Errorf("invalid pattern %q: %v", s, err)
+	}
+	p.re = re
+
+	return p, nil
+}
+
+// Match reports whether s matches the pattern.
+func (p Pattern) Match(s string) bool {
+	if p.re == nil {
+		return true
+	}
+	return p.re.MatchString(s)
+}
+
+// IsEmpty reports whether the pattern matches everything.
+func (p Pattern) IsEmpty() bool {
+	return p.re == nil
+}
+
+// String returns the pattern as it was written.
+func (p Pattern) String() string {
+	return p.raw
+}
+
+// MarshalJSON encodes the pattern as it was written.
+func (p Pattern) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.raw)
+}
+
+// UnmarshalJSON parses a pattern from a JSON string.
+func (p *Pattern) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := ParsePattern(s)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
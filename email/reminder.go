@@ -0,0 +1,76 @@
+package email
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sourcegraph/checkup"
+)
+
+// ParseReminders parses comma separated reminder intervals per status, as
+// in "down=1h,degraded=6h".
+func ParseReminders(s string) (map[checkup.StatusText]time.Duration, error) {
+	reminders := map[checkup.StatusText]time.Duration{}
+	for _, r := range strings.Split(s, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+
+		parts := strings.SplitN(r, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid reminder %q, must be <status>=<interval>", r)
+		}
+		status := checkup.StatusText(strings.ToLower(strings.TrimSpace(parts[0])))
+		switch status {
+		case checkup.Down, checkup.Degraded, checkup.Unknown:
+		default:
+			return nil, fmt.Errorf("invalid reminder status %q, must be one of down, degraded or unknown", parts[0])
+		}
+		interval, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid reminder interval %q", parts[1])
+		}
+		reminders[status] = interval
+	}
+	return reminders, nil
+}
+
+// evaluateReminder returns a reminder about cs if its notified status is
+// unhealthy and the reminder interval of that status passed since the last
+// email.
+func (n *Notifier) evaluateReminder(r checkup.Result, key string, cs *CheckState, now time.Time) (*notification, bool) {
+	interval := n.Reminders[cs.Status]
+	if interval <= 0 || cs.Status == checkup.Healthy || cs.OutageStart.IsZero() {
+		return nil, false
+	}
+
+	last := cs.Notified
+	if last.IsZero() {
+		last = cs.Since
+	}
+	if now.Sub(last) < interval {
+		return nil, false
+	}
+
+	next := *cs
+	next.Notified = now
+	logrus.Debugf("%s is still %s after %s: sending reminder", r.Title, cs.Status, now.Sub(cs.OutageStart))
+	return &notification{
+		kind:   kindReminder,
+		key:    key,
+		result: r,
+		prev:   cs,
+		next:   &next,
+	}, true
+}
+
+// sendReminder sends a reminder about a check that is still unhealthy.
+func (n *Notifier) sendReminder(p notification, now time.Time) error {
+	data := newTemplateData(TemplateReminder, now)
+	data.CheckData = newCheckData(p.result, p.prev, now)
+	data.FailedRuns = p.prev.FailedRuns
+	return n.sendTemplate(data, n.recipients(p))
+}
@@ -0,0 +1,236 @@
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/checkup"
+)
+
+func TestParseReminders(t *testing.T) {
+	tests := []struct {
+		in        string
+		want      map[checkup.StatusText]time.Duration
+		wantError string
+	}{
+		{in: "", want: map[checkup.StatusText]time.Duration{}},
+		{in: "down=1h", want: map[checkup.StatusText]time.Duration{checkup.Down: time.Hour}},
+		{
+			in: " Down = 30m , degraded=6h,unknown=1h30m,",
+			want: map[checkup.StatusText]time.Duration{
+				checkup.Down:     30 * time.Minute,
+				checkup.Degraded: 6 * time.Hour,
+				checkup.Unknown:  90 * time.Minute,
+			},
+		},
+		{in: "down=1h,down=2h", want: map[checkup.StatusText]time.Duration{checkup.Down: 2 * time.Hour}},
+		{in: "down", wantError: "must be <status>=<interval>"},
+		{in: "healthy=1h", wantError: "invalid reminder status"},
+		{in: "down=soon", wantError: "invalid reminder interval"},
+		{in: "down=0s", wantError: "invalid reminder interval"},
+		{in: "down=-1h", wantError: "invalid reminder interval"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseReminders(tt.in)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("ParseReminders returned %v, want an error containing %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseReminders: %v", err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("reminders are %v, want %v", got, tt.want)
+			}
+			for status, interval := range tt.want {
+				if got[status] != interval {
+					t.Fatalf("reminders are %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestEvaluateReminders(t *testing.T) {
+	kinds := map[kind]string{kindAlert: "alert", kindRecovery: "recovery", kindReminder: "reminder"}
+
+	type run struct {
+		// at is the time of the run since the first one.
+		at     time.Duration
+		status string
+		want   string
+		// failed leaves the state untouched, like Notify does when the
+		// email could not be sent.
+		failed bool
+	}
+	tests := []struct {
+		name string
+		runs []run
+	}{
+		{
+			name: "reminded every interval",
+			runs: []run{
+				{0, "down", "alert", false},
+				{30 * time.Minute, "down", "", false},
+				{time.Hour, "down", "reminder", false},
+				{90 * time.Minute, "down", "", false},
+				{2 * time.Hour, "down", "reminder", false},
+			},
+		},
+		{
+			name: "interval counts from the last email",
+			runs: []run{
+				{0, "down", "alert", false},
+				{70 * time.Minute, "down", "reminder", false},
+				{2 * time.Hour, "down", "", false},
+				{130 * time.Minute, "down", "reminder", false},
+			},
+		},
+		{
+			name: "interval per status",
+			runs: []run{
+				{0, "degraded", "alert", false},
+				{time.Hour, "degraded", "", false},
+				{3 * time.Hour, "degraded", "", false},
+				{6 * time.Hour, "degraded", "reminder", false},
+			},
+		},
+		{
+			name: "status without an interval is not reminded",
+			runs: []run{
+				{0, "unknown", "alert", false},
+				{time.Hour, "unknown", "", false},
+				{24 * time.Hour, "unknown", "", false},
+			},
+		},
+		{
+			name: "status change restarts the interval",
+			runs: []run{
+				{0, "down", "alert", false},
+				{50 * time.Minute, "degraded", "alert", false},
+				{70 * time.Minute, "down", "alert", false},
+				{100 * time.Minute, "down", "", false},
+				{130 * time.Minute, "down", "reminder", false},
+			},
+		},
+		{
+			name: "recovery stops reminders",
+			runs: []run{
+				{0, "down", "alert", false},
+				{30 * time.Minute, "up", "recovery", false},
+				{2 * time.Hour, "up", "", false},
+			},
+		},
+		{
+			name: "reminder that could not be sent is due again",
+			runs: []run{
+				{0, "down", "alert", false},
+				{time.Hour, "down", "reminder", true},
+				{90 * time.Minute, "down", "reminder", false},
+				{2 * time.Hour, "down", "", false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &Notifier{
+				Reminders: map[checkup.StatusText]time.Duration{
+					checkup.Down:     time.Hour,
+					checkup.Degraded: 6 * time.Hour,
+				},
+				state: &State{Checks: map[string]*CheckState{}},
+			}
+
+			start := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+			for i, run := range tt.runs {
+				pending := n.evaluate([]checkup.Result{testResult("api", run.status)}, start.Add(run.at))
+				if len(pending) > 1 {
+					t.Fatalf("run %d: got %d notifications for one result", i, len(pending))
+				}
+				notified := ""
+				for _, p := range pending {
+					notified = kinds[p.kind]
+					if !run.failed {
+						n.state.Checks[p.key] = p.next
+					}
+				}
+				if notified != run.want {
+					t.Fatalf("run %d (%s, %s): notified %q, want %q", i, run.at, run.status, notified, run.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSendReminder(t *testing.T) {
+	tr := &fakeTransport{}
+	n := &Notifier{
+		Transports:   []Transport{tr},
+		Routing:      Routing{Default: []string{"ops@example.com"}},
+		RecoverAfter: 2,
+		Reminders:    map[checkup.StatusText]time.Duration{checkup.Down: time.Hour},
+		state:        &State{Checks: map[string]*CheckState{}},
+	}
+
+	start := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	runs := []struct {
+		at     time.Duration
+		status string
+	}{
+		{0, "down"},
+		{20 * time.Minute, "down"},
+		{40 * time.Minute, "down"},
+		{time.Hour, "down"},
+		// A single healthy result is not a recovery and not a failed run.
+		{80 * time.Minute, "up"},
+		{100 * time.Minute, "down"},
+		{2 * time.Hour, "down"},
+	}
+	for i, run := range runs {
+		now := start.Add(run.at)
+		for _, p := range n.evaluate([]checkup.Result{testResult("api", run.status)}, now) {
+			if p.kind == kindReminder {
+				if err := n.sendReminder(p, now); err != nil {
+					t.Fatalf("run %d: sendReminder: %v", i, err)
+				}
+			}
+			n.state.Checks[p.key] = p.next
+		}
+	}
+
+	msgs := tr.messages()
+	if len(msgs) != 2 {
+		t.Fatalf("sent %q, want two reminders", tr.subjects())
+	}
+	for i, want := range []struct {
+		subject  string
+		duration string
+		failed   string
+	}{
+		{"[UPMAIL]: api still down after 1h0m0s", "1h0m0s", "4"},
+		{"[UPMAIL]: api still down after 2h0m0s", "2h0m0s", "6"},
+	} {
+		m := msgs[i]
+		if m.Subject != want.subject {
+			t.Errorf("reminder %d subject is %q, want %q", i, m.Subject, want.subject)
+		}
+		for _, s := range []string{
+			"== api - https://api.example.com is still down",
+			"Outage started: " + start.Format(time.UnixDate),
+			"Outage duration: " + want.duration + "\n",
+			"Failed runs: " + want.failed + "\n",
+		} {
+			if !strings.Contains(m.Text, s) {
+				t.Errorf("reminder %d text does not contain %q:\n%s", i, s, m.Text)
+			}
+		}
+		s := "after <b>" + want.duration + "</b> since " + start.Format(time.UnixDate) + ", with <b>" + want.failed + "</b> failed runs so far."
+		if !strings.Contains(m.HTML, s) {
+			t.Errorf("reminder %d HTML does not contain %q:\n%s", i, s, m.HTML)
+		}
+	}
+}
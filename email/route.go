@@ -0,0 +1,104 @@
+package email
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/sourcegraph/checkup"
+)
+
+// Route sends the notifications about the checks it matches to its
+// recipients. All conditions of a route must match; conditions that are left
+// empty match every check.
+type Route struct {
+	// Title matches the title of the check.
+	Title Pattern `json:"title,omitempty"`
+	// Endpoint matches the endpoint of the check.
+	Endpoint Pattern `json:"endpoint,omitempty"`
+	// Status limits the route to checks with one of the given statuses.
+	Status []checkup.StatusText `json:"status,omitempty"`
+	// Recipients are the email addresses the notifications are sent to.
+	Recipients []string `json:"recipients"`
+	// Escalation is the name of the escalation policy of the alerts of
+	// the route. It is optional.
+	Escalation string `json:"escalation,omitempty"`
+}
+
+// Match reports whether the route applies to r while it has the given
+// status.
+func (rt Route) Match(r checkup.Result, status checkup.StatusText) bool {
+	if !rt.Title.Match(r.Title) || !rt.Endpoint.Match(r.Endpoint) {
+		return false
+	}
+	if len(rt.Status) == 0 {
+		return true
+	}
+	for _, s := range rt.Status {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// Routing is the routing table of a notifier. Every matching route
+// contributes its recipients; checks that no route matches are sent to the
+// default recipients.
+type Routing struct {
+	// Routes are the routing rules.
+	Routes []Route `json:"routes,omitempty"`
+	// Default are the recipients of checks that no route matches.
+	Default []string `json:"default,omitempty"`
+}
+
+// Recipients returns the sorted, deduplicated recipients for r while it has
+// the given status.
+func (rt Routing) Recipients(r checkup.Result, status checkup.StatusText) []string {
+	var rcpts []string
+	for _, route := range rt.Routes {
+		if route.Match(r, status) {
+			rcpts = append(rcpts, route.Recipients...)
+		}
+	}
+	if len(rcpts) == 0 {
+		rcpts = rt.Default
+	}
+	return uniqueAddresses(rcpts)
+}
+
+// Escalation returns the escalation policy of the first route that matches
+// r while it has the given status and has one.
+func (rt Routing) Escalation(r checkup.Result, status checkup.StatusText) string {
+	for _, route := range rt.Routes {
+		if route.Escalation != "" && route.Match(r, status) {
+			return route.Escalation
+		}
+	}
+	return ""
+}
+
+// Addresses returns the sorted, deduplicated recipients of every route and
+// the default recipients.
+func (rt Routing) Addresses() []string {
+	rcpts := append([]string{}, rt.Default...)
+	for _, route := range rt.Routes {
+		rcpts = append(rcpts, route.Recipients...)
+	}
+	return uniqueAddresses(rcpts)
+}
+
+// uniqueAddresses sorts addresses and removes the empty and duplicate ones.
+func uniqueAddresses(addrs []string) []string {
+	seen := map[string]bool{}
+	var unique []string
+	for _, a := range addrs {
+		a = strings.TrimSpace(a)
+		if a == "" || seen[strings.ToLower(a)] {
+			continue
+		}
+		seen[strings.ToLower(a)] = true
+		unique = append(unique, a)
+	}
+	sort.Strings(unique)
+	return unique
+}
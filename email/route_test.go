@@ -0,0 +1,133 @@
+package email
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/sourcegraph/checkup"
+)
+
+const testRouting = `{
+	"default": ["ops@example.com"],
+	"routes": [
+		{"title": "api*", "recipients": ["api@example.com", "Ops Lead <lead@example.com>"], "escalation": "api"},
+		{"title": "~db-(eu|us)", "recipients": ["dba@example.com"]},
+		{"endpoint": "*.internal:*", "recipients": ["infra@example.com"], "escalation": "infra"},
+		{"title": "api-?", "status": ["down"], "recipients": ["oncall@example.com", "API@example.com"], "escalation": "oncall"}
+	]
+}`
+
+func TestRoutingRecipients(t *testing.T) {
+	var routing Routing
+	if err := json.Unmarshal([]byte(testRouting), &routing); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		title      string
+		endpoint   string
+		status     checkup.StatusText
+		want       []string
+		escalation string
+	}{
+		{
+			name:   "no route matches",
+			title:  "web",
+			status: checkup.Down,
+			want:   []string{"ops@example.com"},
+		},
+		{
+			name:       "glob",
+			title:      "api",
+			status:     checkup.Degraded,
+			want:       []string{"Ops Lead <lead@example.com>", "api@example.com"},
+			escalation: "api",
+		},
+		{
+			name:       "every matching route contributes once per address",
+			title:      "api-1",
+			status:     checkup.Down,
+			want:       []string{"Ops Lead <lead@example.com>", "api@example.com", "oncall@example.com"},
+			escalation: "api",
+		},
+		{
+			name:       "status condition",
+			title:      "api-1",
+			status:     checkup.Degraded,
+			want:       []string{"Ops Lead <lead@example.com>", "api@example.com"},
+			escalation: "api",
+		},
+		{
+			name:   "single character wildcard",
+			title:  "api-10",
+			status: checkup.Down,
+			want:   []string{"Ops Lead <lead@example.com>", "api@example.com"},
+			// Only the first matching route with a policy counts.
+			escalation: "api",
+		},
+		{
+			name:   "anchored regular expression",
+			title:  "db-eu",
+			status: checkup.Down,
+			want:   []string{"dba@example.com"},
+		},
+		{
+			name:   "regular expression does not match a prefix",
+			title:  "db-eu-2",
+			status: checkup.Down,
+			want:   []string{"ops@example.com"},
+		},
+		{
+			name:       "endpoint",
+			title:      "db-us",
+			endpoint:   "tcp://db.internal:5432",
+			status:     checkup.Down,
+			want:       []string{"dba@example.com", "infra@example.com"},
+			escalation: "infra",
+		},
+		{
+			name:   "glob is case sensitive",
+			title:  "API",
+			status: checkup.Down,
+			want:   []string{"ops@example.com"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := checkup.Result{Title: tt.title, Endpoint: tt.endpoint}
+			if r.Endpoint == "" {
+				r.Endpoint = "https://" + tt.title + ".example.com"
+			}
+
+			got := routing.Recipients(r, tt.status)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("recipients are %q, want %q", got, tt.want)
+			}
+			if e := routing.Escalation(r, tt.status); e != tt.escalation {
+				t.Errorf("escalation is %q, want %q", e, tt.escalation)
+			}
+		})
+	}
+}
+
+func TestRoutingAddresses(t *testing.T) {
+	var routing Routing
+	if err := json.Unmarshal([]byte(testRouting), &routing); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"Ops Lead <lead@example.com>", "api@example.com", "dba@example.com", "infra@example.com", "oncall@example.com", "ops@example.com"}
+	if got := routing.Addresses(); strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("addresses are %q, want %q", got, want)
+	}
+}
+
+func TestRoutingInvalidPattern(t *testing.T) {
+	var routing Routing
+	err := json.Unmarshal([]byte(`{"routes": [{"title": "~api(", "recipients": ["api@example.com"]}]}`), &routing)
+	if err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Fatalf("Unmarshal returned %v, want an invalid pattern error", err)
+	}
+}
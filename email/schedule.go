@@ -0,0 +1,272 @@
+package email
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SchedulePrefix marks a recipient that refers to an on-call schedule by
+// name, such as "schedule:ops". It resolves to whoever is on call when the
+// email is sent.
+const SchedulePrefix = "schedule:"
+
+// Schedule is an on-call rotation. The participants take turns, each for
+// RotationDays days starting at the Handoff time on the Start date.
+type Schedule struct {
+	// Participants are the email addresses of the people on call, in
+	// rotation order.
+	Participants []string `json:"participants"`
+	// Start is the date of the first shift, such as "2024-01-01", which
+	// goes to the first participant.
+	Start string `json:"start"`
+	// Handoff is the time of day shifts change, such as "09:00". Empty
+	// means midnight.
+	Handoff string `json:"handoff,omitempty"`
+	// RotationDays is the length of a shift in days. Zero means 7.
+	RotationDays int `json:"rotation_days,omitempty"`
+	// TimeZone is the IANA time zone of Start and Handoff, such as
+	// "Europe/Berlin". Empty means UTC.
+	TimeZone string `json:"time_zone,omitempty"`
+	// Overrides hand the rotation to someone else for a while. Later
+	// overrides win over earlier ones.
+	Overrides []Override `json:"overrides,omitempty"`
+}
+
+// Override puts Recipient on call from Start until End.
+type Override struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Recipient string    `json:"recipient"`
+}
+
+// Shift is a period during which Recipient is on call.
+type Shift struct {
+	Start     time.Time
+	End       time.Time
+	Recipient string
+	// Override is set if the shift comes from an override.
+	Override bool
+}
+
+// rotation is the parsed form of the rotation settings of a Schedule.
+type rotation struct {
+	loc          *time.Location
+	year         int
+	month        time.Month
+	day          int
+	hour, minute int
+	days         int
+}
+
+// rotation parses the rotation settings of s.
+func (s Schedule) rotation() (rotation, error) {
+	var rot rotation
+	if len(s.Participants) == 0 {
+		return rot, fmt.Errorf("no participants")
+	}
+
+	loc, err := time.LoadLocation(s.TimeZone)
+	if err != nil {
+		return rot, fmt.Errorf("invalid time zone %q: %v", s.TimeZone, err)
+	}
+	rot.loc = loc
+
+	start, err := time.ParseInLocation("2006-01-02", s.Start, loc)
+	if err != nil {
+		return rot, fmt.Errorf("invalid start date %q, expected YYYY-MM-DD", s.Start)
+	}
+	rot.year, rot.month, rot.day = start.Date()
+
+	if s.Handoff != "" {
+		handoff, err := time.Parse("15:04", s.Handoff)
+		if err != nil {
+			return rot, fmt.Errorf("invalid handoff time %q, expected HH:MM", s.Handoff)
+		}
+		rot.hour, rot.minute = handoff.Hour(), handoff.Minute()
+	}
+
+	rot.days = s.RotationDays
+	if rot.days == 0 {
+		rot.days = 7
+	}
+	if rot.days < 0 {
+		return rot, fmt.Errorf("invalid rotation_days %d", s.RotationDays)
+	}
+
+	return rot, nil
+}
+
+// shiftStart returns the start of the i-th shift. Shifts start at the
+// handoff time in the schedule's time zone, so daylight saving time changes
+// do not move the handoff.
+func (rot rotation) shiftStart(i int) time.Time {
+	return time.Date(rot.year, rot.month, rot.day+i*rot.days, rot.hour, rot.minute, 0, 0, rot.loc)
+}
+
+// shift returns the index of the shift t falls in.
+func (rot rotation) shift(t time.Time) int {
+	i := int(t.Sub(rot.shiftStart(0)) / (time.Duration(rot.days) * 24 * time.Hour))
+	for rot.shiftStart(i).After(t) {
+		i--
+	}
+	for !rot.shiftStart(i + 1).After(t) {
+		i++
+	}
+	return i
+}
+
+// Validate reports whether the schedule settings are usable.
+func (s Schedule) Validate() error {
+	if _, err := s.rotation(); err != nil {
+		return err
+	}
+	for _, o := range s.Overrides {
+		if strings.TrimSpace(o.Recipient) == "" {
+			return fmt.Errorf("override from %s has no recipient", o.Start.Format(time.RFC3339))
+		}
+		if !o.End.After(o.Start) {
+			return fmt.Errorf("override of %s ends before it starts", o.Recipient)
+		}
+	}
+	return nil
+}
+
+// OnCall returns who is on call at t.
+func (s Schedule) OnCall(t time.Time) (string, error) {
+	shifts, err := s.Shifts(t, 1)
+	if err != nil {
+		return "", err
+	}
+	return shifts[0].Recipient, nil
+}
+
+// maxShiftBoundaries caps how many rotation and override boundaries Shifts
+// walks, however many shifts are asked for.
+const maxShiftBoundaries = 10000
+
+// Shifts returns the shift that is on at from followed by the next ones, up
+// to n in total. Overrides split the rotation into separate shifts, and
+// consecutive shifts of the same recipient are merged, so a rotation that
+// only ever hands over to the same person returns fewer than n shifts.
+func (s Schedule) Shifts(from time.Time, n int) ([]Shift, error) {
+	rot, err := s.rotation()
+	if err != nil {
+		return nil, err
+	}
+
+	// The current shift started at the latest boundary of the rotation or
+	// an override.
+	start := rot.shiftStart(rot.shift(from))
+	for _, o := range s.Overrides {
+		for _, b := range []time.Time{o.Start, o.End} {
+			if b.After(start) && !b.After(from) {
+				start = b
+			}
+		}
+	}
+
+	// Every full round of the rotation hands over at least once unless all
+	// participants are the same, and every override adds at most two
+	// boundaries.
+	limit := n*len(s.Participants) + 2*len(s.Overrides)
+	if limit > maxShiftBoundaries {
+		limit = maxShiftBoundaries
+	}
+
+	var shifts []Shift
+	t := from
+	for walked := 0; len(shifts) < n && walked < limit; walked++ {
+		i := rot.shift(t)
+		rcpt, override := s.Participants[mod(i, len(s.Participants))], false
+		end := rot.shiftStart(i + 1)
+		for _, o := range s.Overrides {
+			if !t.Before(o.Start) && t.Before(o.End) {
+				rcpt, override = o.Recipient, true
+			}
+			for _, b := range []time.Time{o.Start, o.End} {
+				if b.After(t) && b.Before(end) {
+					end = b
+				}
+			}
+		}
+
+		if last := len(shifts) - 1; last < 0 || shifts[last].Recipient != rcpt || shifts[last].Override != override {
+			shifts = append(shifts, Shift{
+				Start:     start.In(rot.loc),
+				Recipient: rcpt,
+				Override:  override,
+			})
+		}
+		shifts[len(shifts)-1].End = end.In(rot.loc)
+		start, t = end, end
+	}
+
+	return shifts, nil
+}
+
+// Recipients returns everyone who can be on call for s.
+func (s Schedule) Recipients() []string {
+	rcpts := append([]string(nil), s.Participants...)
+	for _, o := range s.Overrides {
+		rcpts = append(rcpts, o.Recipient)
+	}
+	return uniqueAddresses(rcpts)
+}
+
+// ExpandSchedules replaces the schedule references in addrs with every
+// recipient of the schedules.
+func ExpandSchedules(addrs []string, schedules map[string]Schedule) []string {
+	var expanded []string
+	for _, a := range addrs {
+		name, ok := scheduleName(a)
+		if !ok {
+			expanded = append(expanded, a)
+			continue
+		}
+		expanded = append(expanded, schedules[name].Recipients()...)
+	}
+	return uniqueAddresses(expanded)
+}
+
+// resolveRecipients replaces the schedule references in addrs with who is
+// on call at t.
+func (n *Notifier) resolveRecipients(addrs []string, t time.Time) []string {
+	var resolved []string
+	for _, a := range addrs {
+		name, ok := scheduleName(a)
+		if !ok {
+			resolved = append(resolved, a)
+			continue
+		}
+		s, ok := n.Schedules[name]
+		if !ok {
+			logrus.Warnf("recipient %s refers to an unknown schedule, skipping it", a)
+			continue
+		}
+		rcpt, err := s.OnCall(t)
+		if err != nil {
+			logrus.Warnf("resolving schedule %s failed: %v", name, err)
+			continue
+		}
+		resolved = append(resolved, rcpt)
+	}
+	return uniqueAddresses(resolved)
+}
+
+// scheduleName returns the schedule name addr refers to, if any.
+func scheduleName(addr string) (string, bool) {
+	addr = strings.TrimSpace(addr)
+	if !strings.HasPrefix(addr, SchedulePrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, SchedulePrefix), true
+}
+
+// mod returns the non-negative remainder of i divided by n, so shifts before
+// the start date rotate backwards.
+func mod(i, n int) int {
+	return (i%n + n) % n
+}
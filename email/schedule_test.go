@@ -0,0 +1,227 @@
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s is not available: %v", name, err)
+	}
+	return loc
+}
+
+func TestScheduleShifts(t *testing.T) {
+	berlin := mustLoadLocation(t, "Europe/Berlin")
+	at := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, berlin)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	weekly := Schedule{
+		Participants: []string{"a@example.com", "b@example.com", "c@example.com"},
+		Start:        "2026-10-05",
+		Handoff:      "09:00",
+		TimeZone:     "Europe/Berlin",
+	}
+	withOverride := weekly
+	withOverride.Overrides = []Override{
+		{Start: at("2026-10-21 12:00"), End: at("2026-10-23 00:00"), Recipient: "z@example.com"},
+	}
+	daily := Schedule{
+		Participants: []string{"a@example.com", "b@example.com"},
+		Start:        "2026-10-24",
+		RotationDays: 1,
+		TimeZone:     "Europe/Berlin",
+	}
+	alone := weekly
+	alone.Participants = []string{"a@example.com"}
+	twice := weekly
+	twice.Participants = []string{"a@example.com", "a@example.com"}
+	twiceThenB := weekly
+	twiceThenB.Participants = []string{"a@example.com", "a@example.com", "b@example.com"}
+	aloneWithOverride := alone
+	aloneWithOverride.Overrides = withOverride.Overrides
+
+	tests := []struct {
+		name     string
+		schedule Schedule
+		from     string
+		n        int
+		want     []string
+	}{
+		{
+			name:     "weekly rotation",
+			schedule: weekly,
+			from:     "2026-10-14 10:00",
+			n:        3,
+			want: []string{
+				"b@example.com 2026-10-12 09:00 - 2026-10-19 09:00",
+				"c@example.com 2026-10-19 09:00 - 2026-10-26 09:00",
+				"a@example.com 2026-10-26 09:00 - 2026-11-02 09:00",
+			},
+		},
+		{
+			name:     "override splits a shift",
+			schedule: withOverride,
+			from:     "2026-10-14 10:00",
+			n:        5,
+			want: []string{
+				"b@example.com 2026-10-12 09:00 - 2026-10-19 09:00",
+				"c@example.com 2026-10-19 09:00 - 2026-10-21 12:00",
+				"z@example.com 2026-10-21 12:00 - 2026-10-23 00:00 (override)",
+				"c@example.com 2026-10-23 00:00 - 2026-10-26 09:00",
+				"a@example.com 2026-10-26 09:00 - 2026-11-02 09:00",
+			},
+		},
+		{
+			name:     "during an override",
+			schedule: withOverride,
+			from:     "2026-10-22 08:00",
+			n:        2,
+			want: []string{
+				"z@example.com 2026-10-21 12:00 - 2026-10-23 00:00 (override)",
+				"c@example.com 2026-10-23 00:00 - 2026-10-26 09:00",
+			},
+		},
+		{
+			name:     "before the start rotates backwards",
+			schedule: weekly,
+			from:     "2026-10-01 12:00",
+			n:        2,
+			want: []string{
+				"c@example.com 2026-09-28 09:00 - 2026-10-05 09:00",
+				"a@example.com 2026-10-05 09:00 - 2026-10-12 09:00",
+			},
+		},
+		{
+			name:     "daily across the end of dst",
+			schedule: daily,
+			from:     "2026-10-24 12:00",
+			n:        3,
+			want: []string{
+				"a@example.com 2026-10-24 00:00 - 2026-10-25 00:00",
+				"b@example.com 2026-10-25 00:00 - 2026-10-26 00:00",
+				"a@example.com 2026-10-26 00:00 - 2026-10-27 00:00",
+			},
+		},
+		{
+			name:     "single participant",
+			schedule: alone,
+			from:     "2026-10-14 10:00",
+			n:        3,
+			want: []string{
+				"a@example.com 2026-10-12 09:00 - 2026-11-02 09:00",
+			},
+		},
+		{
+			name:     "duplicate participants",
+			schedule: twice,
+			from:     "2026-10-14 10:00",
+			n:        3,
+			want: []string{
+				"a@example.com 2026-10-12 09:00 - 2026-11-23 09:00",
+			},
+		},
+		{
+			name:     "consecutive shifts of the same participant",
+			schedule: twiceThenB,
+			from:     "2026-10-14 10:00",
+			n:        2,
+			want: []string{
+				"a@example.com 2026-10-12 09:00 - 2026-10-19 09:00",
+				"b@example.com 2026-10-19 09:00 - 2026-10-26 09:00",
+			},
+		},
+		{
+			name:     "single participant with an override",
+			schedule: aloneWithOverride,
+			from:     "2026-10-14 10:00",
+			n:        5,
+			want: []string{
+				"a@example.com 2026-10-12 09:00 - 2026-10-21 12:00",
+				"z@example.com 2026-10-21 12:00 - 2026-10-23 00:00 (override)",
+				"a@example.com 2026-10-23 00:00 - 2026-11-16 09:00",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shifts, err := tt.schedule.Shifts(at(tt.from), tt.n)
+			if err != nil {
+				t.Fatalf("Shifts: %v", err)
+			}
+
+			var got []string
+			for _, s := range shifts {
+				line := s.Recipient + " " + s.Start.Format("2006-01-02 15:04") + " - " + s.End.Format("2006-01-02 15:04")
+				if s.Override {
+					line += " (override)"
+				}
+				got = append(got, line)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Fatalf("shifts are\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+
+			// The shift that is on is who OnCall returns.
+			rcpt, err := tt.schedule.OnCall(at(tt.from))
+			if err != nil {
+				t.Fatalf("OnCall: %v", err)
+			}
+			if rcpt != shifts[0].Recipient {
+				t.Fatalf("OnCall returned %s, want %s", rcpt, shifts[0].Recipient)
+			}
+		})
+	}
+}
+
+func TestScheduleValidate(t *testing.T) {
+	start := time.Date(2026, 10, 21, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		schedule Schedule
+		err      string
+	}{
+		{name: "valid", schedule: Schedule{Participants: []string{"a@example.com"}, Start: "2026-10-05"}},
+		{name: "no participants", schedule: Schedule{Start: "2026-10-05"}, err: "no participants"},
+		{name: "invalid start", schedule: Schedule{Participants: []string{"a@example.com"}, Start: "05.10.2026"}, err: "invalid start date"},
+		{name: "invalid handoff", schedule: Schedule{Participants: []string{"a@example.com"}, Start: "2026-10-05", Handoff: "9am"}, err: "invalid handoff time"},
+		{name: "invalid time zone", schedule: Schedule{Participants: []string{"a@example.com"}, Start: "2026-10-05", TimeZone: "Nowhere/Special"}, err: "invalid time zone"},
+		{name: "negative rotation", schedule: Schedule{Participants: []string{"a@example.com"}, Start: "2026-10-05", RotationDays: -1}, err: "invalid rotation_days"},
+		{
+			name: "override without recipient",
+			schedule: Schedule{Participants: []string{"a@example.com"}, Start: "2026-10-05", Overrides: []Override{
+				{Start: start, End: start.Add(time.Hour)},
+			}},
+			err: "has no recipient",
+		},
+		{
+			name: "override ending before it starts",
+			schedule: Schedule{Participants: []string{"a@example.com"}, Start: "2026-10-05", Overrides: []Override{
+				{Start: start, End: start, Recipient: "z@example.com"},
+			}},
+			err: "ends before it starts",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.schedule.Validate()
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("Validate: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Validate returned %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package email
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// DefaultSendmailPath is the sendmail binary used if none is configured.
+const DefaultSendmailPath = "/usr/sbin/sendmail"
+
+// DefaultSendmailTimeout is how long sendmail may run if no timeout is
+// configured.
+const DefaultSendmailTimeout = time.Minute
+
+// sysexits describes the exit codes sendmail compatible programs use, see
+// sysexits(3).
+var sysexits = map[int]string{
+	64: "command line usage error",
+	65: "data format error",
+	66: "cannot open input",
+	67: "addressee unknown",
+	68: "host name unknown",
+	69: "service unavailable",
+	70: "internal software error",
+	71: "system error",
+	72: "critical OS file missing",
+	73: "cannot create output file",
+	74: "input/output error",
+	75: "temporary failure",
+	76: "remote error in protocol",
+	77: "permission denied",
+	78: "configuration error",
+}
+
+// SendmailTransport delivers messages by piping them into the sendmail
+// binary of the local MTA as "sendmail -t -i", so the recipients are taken
+// from the message and a line with a single dot does not end it.
+type SendmailTransport struct {
+	// Path is the sendmail binary. If empty, DefaultSendmailPath is used.
+	Path string
+	// Timeout is how long sendmail may run before it is killed. If zero,
+	// DefaultSendmailTimeout is used.
+	Timeout time.Duration
+}
+
+// Name returns "sendmail".
+func (t SendmailTransport) Name() string {
+	return "sendmail"
+}
+
+// Send pipes m into sendmail. A non-zero exit code is returned as an error
+// together with what sendmail wrote to stderr, and sendmail is killed if it
+// runs longer than the timeout.
+func (t SendmailTransport) Send(m *Message) error {
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+
+	path := t.Path
+	if path == "" {
+		path = DefaultSendmailPath
+	}
+
+	timeout := t.Timeout
+	if timeout <= 0 {
+		timeout = DefaultSendmailTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, "-t", "-i")
+	// sendmail expects local line endings on stdin.
+	cmd.Stdin = bytes.NewReader(toLF(msg))
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		out := strings.TrimSpace(stderr.String())
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("sendmail: %s timed out after %s: %s", path, timeout, out)
+		}
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code := exitErr.ExitCode()
+			if desc, ok := sysexits[code]; ok {
+				return fmt.Errorf("sendmail: %s exited with status %d (%s): %s", path, code, desc, out)
+			}
+			return fmt.Errorf("sendmail: %s exited with status %d: %s", path, code, out)
+		}
+		return fmt.Errorf("sendmail: running %s failed: %v", path, err)
+	}
+
+	return nil
+}
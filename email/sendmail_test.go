@@ -0,0 +1,57 @@
+package email
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSendmail writes a shell script standing in for sendmail and returns
+// its path and a function that removes it.
+func writeSendmail(t *testing.T, script string) (string, func()) {
+	dir, err := ioutil.TempDir("", "upmail-sendmail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "sendmail")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0700); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func TestSendmailTransport(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		err     string
+	}{
+		{name: "delivered", script: "cat >/dev/null"},
+		{name: "sysexit", script: "echo 'no such user' >&2; exit 67", err: "exited with status 67 (addressee unknown): no such user"},
+		{name: "other exit", script: "exit 3", err: "exited with status 3"},
+		{name: "timeout", script: "exec sleep 10", timeout: 100 * time.Millisecond, err: "timed out after 100ms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, cleanup := writeSendmail(t, tt.script)
+			defer cleanup()
+
+			tr := SendmailTransport{Path: path, Timeout: tt.timeout}
+			err := tr.Send(testMessage("alert"))
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("Send: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("Send returned %v, want an error containing %q", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ses"
+	"github.com/sirupsen/logrus"
+)
+
+// SESTransport delivers messages through the Amazon SES API. Credentials are
+// taken from the standard AWS chain: the environment, the shared credentials
+// and config files, and the EC2 or ECS role.
+type SESTransport struct {
+	// Region is the AWS region of SES. If empty, the region of the
+	// environment or shared config file is used.
+	Region string
+	// ConfigurationSet is the SES configuration set messages are sent with.
+	// It is optional.
+	ConfigurationSet string
+	// Endpoint overrides the SES API endpoint, for example to use a local
+	// fake. It is optional.
+	Endpoint string
+}
+
+// Name returns "ses".
+func (t SESTransport) Name() string {
+	return "ses"
+}
+
+// Send delivers m through SES with SendRawEmail, so the message is sent
+// exactly as rendered by Bytes.
+func (t SESTransport) Send(m *Message) error {
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	from, err := m.Sender()
+	if err != nil {
+		return err
+	}
+	to, err := m.Recipients()
+	if err != nil {
+		return err
+	}
+
+	svc, err := t.client()
+	if err != nil {
+		return err
+	}
+
+	input := &ses.SendRawEmailInput{
+		Source:       aws.String(from),
+		Destinations: aws.StringSlice(to),
+		RawMessage:   &ses.RawMessage{Data: msg},
+	}
+	if t.ConfigurationSet != "" {
+		input.ConfigurationSetName = aws.String(t.ConfigurationSet)
+	}
+
+	resp, err := svc.SendRawEmail(input)
+	if err != nil {
+		return fmt.Errorf("sending SES message failed: %v", err)
+	}
+	logrus.Infof("SES send message succeeded: %s", aws.StringValue(resp.MessageId))
+
+	return nil
+}
+
+// client creates an SES client from the AWS credential chain.
+func (t SESTransport) client() (*ses.SES, error) {
+	config := aws.NewConfig()
+	if t.Region != "" {
+		config = config.WithRegion(t.Region)
+	}
+	if t.Endpoint != "" {
+		config = config.WithEndpoint(t.Endpoint)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            *config,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating AWS session failed: %v", err)
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		return nil, errors.New("no AWS region configured for SES")
+	}
+
+	return ses.New(sess), nil
+}
@@ -0,0 +1,175 @@
+package email
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// setSESCredentials sets static AWS credentials for the fake SES API and
+// returns a function that restores the environment.
+func setSESCredentials() func() {
+	vars := map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKIDEXAMPLE",
+		"AWS_SECRET_ACCESS_KEY": "secret",
+		"AWS_SESSION_TOKEN":     "",
+	}
+	old := map[string]*string{}
+	for k, v := range vars {
+		if prev, ok := os.LookupEnv(k); ok {
+			old[k] = &prev
+		} else {
+			old[k] = nil
+		}
+		os.Setenv(k, v)
+	}
+	return func() {
+		for k, v := range old {
+			if v == nil {
+				os.Unsetenv(k)
+			} else {
+				os.Setenv(k, *v)
+			}
+		}
+	}
+}
+
+// newSESServer starts a fake SES API that answers every request with
+// status and body and records the forms posted to it.
+func newSESServer(status int, body string) (*httptest.Server, func() []url.Values) {
+	var (
+		mu    sync.Mutex
+		forms []url.Values
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		forms = append(forms, r.PostForm)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/xml")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+
+	return srv, func() []url.Values {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]url.Values(nil), forms...)
+	}
+}
+
+func TestSESTransportSend(t *testing.T) {
+	defer setSESCredentials()()
+	srv, forms := newSESServer(http.StatusOK, `<SendRawEmailResponse xmlns="http://ses.amazonaws.com/doc/2010-12-01/">
+  <SendRawEmailResult><MessageId>0100-ses-id</MessageId></SendRawEmailResult>
+  <ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata>
+</SendRawEmailResponse>`)
+	defer srv.Close()
+
+	m := NewMessage("Upmail <upmail@example.com>", []string{"ops@example.com", "Dev <dev@example.com>"}, "api is down", "body", "<p>body</p>")
+	tr := SESTransport{Region: "eu-west-1", ConfigurationSet: "alerts", Endpoint: srv.URL}
+	if err := tr.Send(m); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	got := forms()
+	if len(got) != 1 {
+		t.Fatalf("fake SES received %d requests, want 1", len(got))
+	}
+	form := got[0]
+	for k, want := range map[string]string{
+		"Action":                "SendRawEmail",
+		"Source":                "upmail@example.com",
+		"Destinations.member.1": "ops@example.com",
+		"Destinations.member.2": "dev@example.com",
+		"ConfigurationSetName":  "alerts",
+	} {
+		if v := form.Get(k); v != want {
+			t.Errorf("%s is %q, want %q", k, v, want)
+		}
+	}
+	if v := form.Get("Destinations.member.3"); v != "" {
+		t.Errorf("unexpected third destination %q", v)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(form.Get("RawMessage.Data"))
+	if err != nil {
+		t.Fatalf("decoding RawMessage.Data: %v", err)
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("parsing raw message: %v", err)
+	}
+	for k, want := range map[string]string{
+		"From":       `"Upmail" <upmail@example.com>`,
+		"To":         `<ops@example.com>, "Dev" <dev@example.com>`,
+		"Subject":    "api is down",
+		"Message-Id": "<" + m.MessageID + ">",
+	} {
+		if v := msg.Header.Get(k); v != want {
+			t.Errorf("raw message header %s is %q, want %q", k, v, want)
+		}
+	}
+	if ct := msg.Header.Get("Content-Type"); !strings.HasPrefix(ct, "multipart/alternative;") {
+		t.Errorf("raw message has content type %q, want multipart/alternative", ct)
+	}
+	body, _ := ioutil.ReadAll(msg.Body)
+	for _, want := range []string{"Content-Type: text/plain; charset=utf-8\r\n\r\nbody\r\n", "Content-Type: text/html; charset=utf-8\r\n\r\n<p>body</p>\r\n"} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("raw message body does not contain %q:\n%s", want, body)
+		}
+	}
+}
+
+func TestSESTransportSendWithoutConfigurationSet(t *testing.T) {
+	defer setSESCredentials()()
+	srv, forms := newSESServer(http.StatusOK, `<SendRawEmailResponse><SendRawEmailResult><MessageId>id</MessageId></SendRawEmailResult></SendRawEmailResponse>`)
+	defer srv.Close()
+
+	tr := SESTransport{Region: "eu-west-1", Endpoint: srv.URL}
+	if err := tr.Send(testMessage("api is down")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := forms(); len(got) != 1 || got[0].Get("ConfigurationSetName") != "" {
+		t.Fatalf("requests are %v, want one without ConfigurationSetName", got)
+	}
+}
+
+func TestSESTransportSendError(t *testing.T) {
+	defer setSESCredentials()()
+	srv, forms := newSESServer(http.StatusBadRequest, `<ErrorResponse xmlns="http://ses.amazonaws.com/doc/2010-12-01/">
+  <Error>
+    <Type>Sender</Type>
+    <Code>MessageRejected</Code>
+    <Message>Email address is not verified.</Message>
+  </Error>
+  <RequestId>req-2</RequestId>
+</ErrorResponse>`)
+	defer srv.Close()
+
+	tr := SESTransport{Region: "eu-west-1", Endpoint: srv.URL}
+	err := tr.Send(testMessage("api is down"))
+	if err == nil {
+		t.Fatal("Send succeeded, want an error")
+	}
+	for _, want := range []string{"sending SES message failed", "MessageRejected", "Email address is not verified."} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+	if n := len(forms()); n != 1 {
+		t.Fatalf("fake SES received %d requests, want 1", n)
+	}
+}
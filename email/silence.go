@@ -0,0 +1,264 @@
+package email
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sourcegraph/checkup"
+)
+
+// silenceRetention is how long expired silences are kept in the file.
+const silenceRetention = 7 * 24 * time.Hour
+
+// Matcher operators.
+const (
+	MatchEqual     = "="
+	MatchNotEqual  = "!="
+	MatchRegexp    = "=~"
+	MatchNotRegexp = "!~"
+)
+
+// Matcher matches a field of a check result: "title", "endpoint" or
+// "status".
+type Matcher struct {
+	Name  string `json:"name"`
+	Op    string `json:"op"`
+	Value string `json:"value"`
+
+	re *regexp.Regexp
+}
+
+var matcherFields = map[string]bool{"title": true, "endpoint": true, "status": true}
+
+// ParseMatcher parses a matcher such as title=~"api-.*". Regular
+// expressions are anchored.
+func ParseMatcher(s string) (Matcher, error) {
+	i := strings.IndexAny(s, "=!")
+	if i <= 0 {
+		return Matcher{}, fmt.Errorf("invalid matcher %q, expected <field><op><value> with op =, !=, =~ or !~", s)
+	}
+	op := MatchEqual
+	if len(s) > i+1 {
+		switch two := s[i : i+2]; two {
+		case MatchNotEqual, MatchRegexp, MatchNotRegexp:
+			op = two
+		}
+	}
+	if s[i] == '!' && op == MatchEqual {
+		return Matcher{}, fmt.Errorf("invalid matcher %q, expected <field><op><value> with op =, !=, =~ or !~", s)
+	}
+	m := Matcher{
+		Name:  strings.ToLower(strings.TrimSpace(s[:i])),
+		Op:    op,
+		Value: strings.TrimSpace(s[i+len(op):]),
+	}
+	if unquoted, err := unquoteMatcherValue(m.Value); err == nil {
+		m.Value = unquoted
+	}
+	if err := m.compile(); err != nil {
+		return m, err
+	}
+	return m, nil
+}
+
+// unquoteMatcherValue removes the double quotes around a matcher value.
+func unquoteMatcherValue(v string) (string, error) {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v, fmt.Errorf("not quoted")
+	}
+	return v[1 : len(v)-1], nil
+}
+
+// compile validates m and compiles its regular expression.
+func (m *Matcher) compile() error {
+	if !matcherFields[m.Name] {
+		return fmt.Errorf("invalid matcher field %q, expected title, endpoint or status", m.Name)
+	}
+	if m.Op == MatchRegexp || m.Op == MatchNotRegexp {
+		re, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid matcher regular expression %q: %v", m.Value, err)
+		}
+		m.re = re
+	}
+	return nil
+}
+
+// UnmarshalJSON decodes a matcher and compiles its regular expression.
+func (m *Matcher) UnmarshalJSON(b []byte) error {
+	type plain Matcher
+	var p plain
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	*m = Matcher(p)
+	return m.compile()
+}
+
+// Match reports whether r matches.
+func (m Matcher) Match(r checkup.Result) bool {
+	var v string
+	switch m.Name {
+	case "title":
+		v = r.Title
+	case "endpoint":
+		v = r.Endpoint
+	case "status":
+		v = string(r.Status())
+	}
+
+	switch m.Op {
+	case MatchEqual:
+		return v == m.Value
+	case MatchNotEqual:
+		return v != m.Value
+	case MatchRegexp:
+		return m.re.MatchString(v)
+	case MatchNotRegexp:
+		return !m.re.MatchString(v)
+	}
+	return false
+}
+
+// String returns the matcher as it is written on the command line.
+func (m Matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Name, m.Op, m.Value)
+}
+
+// Silence mutes the notifications about the checks matching all of its
+// matchers from Start until End.
+type Silence struct {
+	ID        string    `json:"id"`
+	Matchers  []Matcher `json:"matchers"`
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+}
+
+// Active reports whether s is in effect at t.
+func (s Silence) Active(t time.Time) bool {
+	return !t.Before(s.Start) && t.Before(s.End)
+}
+
+// Match reports whether s applies to r.
+func (s Silence) Match(r checkup.Result) bool {
+	for _, m := range s.Matchers {
+		if !m.Match(r) {
+			return false
+		}
+	}
+	return len(s.Matchers) > 0
+}
+
+// Silences holds the silences. They are managed by "upmail silence" and
+// read by the notifier on every run.
+type Silences struct {
+	Silences []Silence `json:"silences"`
+}
+
+// LoadSilences reads the silences from file. A missing file results in no
+// silences.
+func LoadSilences(file string) (*Silences, error) {
+	s := &Silences{}
+	if file == "" {
+		return s, nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("reading silences file %s failed: %v", file, err)
+	}
+
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("decoding silences file %s failed: %v", file, err)
+	}
+
+	return s, nil
+}
+
+// Save atomically writes the silences to file.
+func (s *Silences) Save(file string) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding silences failed: %v", err)
+	}
+	if err := writeFileAtomic(file, b); err != nil {
+		return fmt.Errorf("writing silences file failed: %v", err)
+	}
+	return nil
+}
+
+// Add assigns a new ID to silence, adds it and drops the silences that
+// expired more than silenceRetention ago.
+func (s *Silences) Add(silence Silence) (string, error) {
+	if len(silence.Matchers) == 0 {
+		return "", fmt.Errorf("a silence needs at least one matcher")
+	}
+	if !silence.End.After(silence.Start) {
+		return "", fmt.Errorf("a silence must end after it starts")
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", fmt.Errorf("generating silence ID failed: %v", err)
+	}
+	silence.ID = hex.EncodeToString(id)
+
+	var kept []Silence
+	for _, old := range s.Silences {
+		if silence.Start.Sub(old.End) < silenceRetention {
+			kept = append(kept, old)
+		}
+	}
+	s.Silences = append(kept, silence)
+	return silence.ID, nil
+}
+
+// Expire ends the silence whose ID starts with id at now.
+func (s *Silences) Expire(id string, now time.Time) (*Silence, error) {
+	var found *Silence
+	for i := range s.Silences {
+		if id != "" && strings.HasPrefix(s.Silences[i].ID, id) {
+			if found != nil {
+				return nil, fmt.Errorf("silence ID %s is ambiguous", id)
+			}
+			found = &s.Silences[i]
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no silence with ID %s", id)
+	}
+	if !found.End.After(now) {
+		return nil, fmt.Errorf("silence %s already expired", found.ID)
+	}
+
+	found.End = now
+	if found.Start.After(now) {
+		found.Start = now
+	}
+	return found, nil
+}
+
+// find returns the first silence that is active at now and applies to r.
+func (s *Silences) find(r checkup.Result, now time.Time) *Silence {
+	if s == nil {
+		return nil
+	}
+	for i, silence := range s.Silences {
+		if silence.Active(now) && silence.Match(r) {
+			return &s.Silences[i]
+		}
+	}
+	return nil
+}
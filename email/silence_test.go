@@ -0,0 +1,225 @@
+package email
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/checkup"
+)
+
+func TestParseMatcher(t *testing.T) {
+	tests := []struct {
+		in        string
+		want      string
+		match     []string
+		mismatch  []string
+		wantError string
+	}{
+		{
+			in:       "title=api",
+			want:     `title="api"`,
+			match:    []string{"api"},
+			mismatch: []string{"api-eu", "web"},
+		},
+		{
+			in:       "title!=api",
+			want:     `title!="api"`,
+			match:    []string{"web", "api-eu"},
+			mismatch: []string{"api"},
+		},
+		{
+			in:       `title=~"api-.*"`,
+			want:     `title=~"api-.*"`,
+			match:    []string{"api-eu", "api-"},
+			mismatch: []string{"api", "my-api-eu"},
+		},
+		{
+			in:       "title!~api-.*",
+			want:     `title!~"api-.*"`,
+			match:    []string{"api", "web"},
+			mismatch: []string{"api-eu"},
+		},
+		{
+			in:       ` Title = "my api" `,
+			want:     `title="my api"`,
+			match:    []string{"my api"},
+			mismatch: []string{`"my api"`, "my"},
+		},
+		{
+			in:       `title="a=b"`,
+			want:     `title="a=b"`,
+			match:    []string{"a=b"},
+			mismatch: []string{"a"},
+		},
+		{
+			in:       `title="unterminated`,
+			want:     `title="\"unterminated"`,
+			match:    []string{`"unterminated`},
+			mismatch: []string{"unterminated"},
+		},
+		{in: "title", wantError: "invalid matcher"},
+		{in: "=api", wantError: "invalid matcher"},
+		{in: "title!api", wantError: "invalid matcher"},
+		{in: "title<api", wantError: "invalid matcher"},
+		{in: "name=api", wantError: "invalid matcher field"},
+		{in: "title=~api(", wantError: "invalid matcher regular expression"},
+		{in: `title!~"[a-"`, wantError: "invalid matcher regular expression"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			m, err := ParseMatcher(tt.in)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("ParseMatcher returned %v, want an error containing %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseMatcher: %v", err)
+			}
+			if m.String() != tt.want {
+				t.Fatalf("matcher is %s, want %s", m, tt.want)
+			}
+			for _, title := range tt.match {
+				if !m.Match(testResult(title, "down")) {
+					t.Errorf("%s does not match %q", m, title)
+				}
+			}
+			for _, title := range tt.mismatch {
+				if m.Match(testResult(title, "down")) {
+					t.Errorf("%s matches %q", m, title)
+				}
+			}
+		})
+	}
+}
+
+func TestMatcherFields(t *testing.T) {
+	r := testResult("api", "degraded")
+	for _, s := range []string{"endpoint=https://api.example.com", "status=degraded", `endpoint=~"https://.*\.example\.com"`} {
+		m, err := ParseMatcher(s)
+		if err != nil {
+			t.Fatalf("ParseMatcher(%q): %v", s, err)
+		}
+		if !m.Match(r) {
+			t.Errorf("%s does not match %+v", m, r)
+		}
+	}
+}
+
+func TestSilencesExpire(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+	newSilences := func() *Silences {
+		return &Silences{Silences: []Silence{
+			{ID: "ab12cd34", Start: now.Add(-time.Hour), End: now.Add(time.Hour)},
+			{ID: "ab98ff00", Start: now.Add(-time.Hour), End: now.Add(time.Hour)},
+			{ID: "c0ffee00", Start: now.Add(time.Hour), End: now.Add(2 * time.Hour)},
+			{ID: "dead0000", Start: now.Add(-2 * time.Hour), End: now.Add(-time.Hour)},
+		}}
+	}
+
+	tests := []struct {
+		id        string
+		wantID    string
+		wantError string
+	}{
+		{id: "ab12", wantID: "ab12cd34"},
+		{id: "ab98ff00", wantID: "ab98ff00"},
+		{id: "c0f", wantID: "c0ffee00"},
+		{id: "ab", wantError: "ambiguous"},
+		{id: "ff", wantError: "no silence with ID ff"},
+		{id: "", wantError: "no silence"},
+		{id: "dead", wantError: "already expired"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			s := newSilences()
+			got, err := s.Expire(tt.id, now)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("Expire returned %v, want an error containing %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expire: %v", err)
+			}
+			if got.ID != tt.wantID {
+				t.Fatalf("expired %s, want %s", got.ID, tt.wantID)
+			}
+			if !got.End.Equal(now) || got.Start.After(now) {
+				t.Fatalf("expired silence runs from %s to %s, want it to end at %s", got.Start, got.End, now)
+			}
+
+			// The silence in the list is expired, not a copy.
+			for _, silence := range s.Silences {
+				if silence.ID == tt.wantID && silence.Active(now) {
+					t.Fatalf("silence %s is still active", silence.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestExpiredSilenceStopsMuting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upmail-silences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "silences.json")
+	m, err := ParseMatcher("title=~api.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	silences := &Silences{}
+	now := time.Now()
+	id, err := silences.Add(Silence{Matchers: []Matcher{m}, Start: now.Add(-time.Minute), End: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := silences.Save(file); err != nil {
+		t.Fatal(err)
+	}
+
+	tr := &fakeTransport{}
+	n := &Notifier{
+		Transports:  []Transport{tr},
+		Routing:     Routing{Default: []string{"ops@example.com"}},
+		SilenceFile: file,
+	}
+	results := []checkup.Result{testResult("api", "down"), testResult("web", "down")}
+
+	if err := n.Notify(results); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got := tr.subjects(); len(got) != 1 || !strings.Contains(got[0], "web") {
+		t.Fatalf("sent %q while api was silenced, want only the alert about web", got)
+	}
+
+	// Expiring the silence by a prefix of its ID lets the alert about api,
+	// which is still down, through on the next run.
+	silences, err = LoadSilences(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := silences.Expire(id[:6], time.Now()); err != nil {
+		t.Fatalf("Expire: %v", err)
+	}
+	if err := silences.Save(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := n.Notify(results); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	got := tr.subjects()
+	if len(got) != 2 || !strings.Contains(got[1], "api") {
+		t.Fatalf("sent %q after the silence expired, want an alert about api", got)
+	}
+}
@@ -0,0 +1,169 @@
+package email
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The sinks below do not deliver messages but write them locally, so alert
+// content and routing can be reviewed without sending any email.
+
+// sinkMu serializes writes to the sinks.
+var sinkMu sync.Mutex
+
+// StdoutTransport writes messages to stdout, each followed by an empty
+// line.
+type StdoutTransport struct{}
+
+// Name returns "stdout".
+func (t StdoutTransport) Name() string {
+	return "stdout"
+}
+
+// Send writes m to stdout exactly as it would have been sent.
+func (t StdoutTransport) Send(m *Message) error {
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+
+	if !bytes.HasSuffix(msg, []byte("\r\n")) {
+		msg = append(msg, '\r', '\n')
+	}
+
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+
+	if _, err := os.Stdout.Write(append(msg, '\r', '\n')); err != nil {
+		return fmt.Errorf("stdout: writing message failed: %v", err)
+	}
+	return nil
+}
+
+// MboxTransport appends messages to a file in mboxrd format.
+type MboxTransport struct {
+	// Path is the mbox file. It is created if it does not exist.
+	Path string
+}
+
+// Name returns "mbox".
+func (t MboxTransport) Name() string {
+	return "mbox"
+}
+
+// Send appends m to the mbox file. Lines starting with "From " are quoted
+// with ">" as required by mboxrd.
+func (t MboxTransport) Send(m *Message) error {
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	from, err := m.Sender()
+	if err != nil {
+		return err
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From %s %s\n", from, m.Date.UTC().Format(time.ANSIC))
+	s := bufio.NewScanner(bytes.NewReader(toLF(msg)))
+	s.Buffer(nil, len(msg)+1)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			b.WriteString(">")
+		}
+		b.WriteString(line + "\n")
+	}
+	b.WriteString("\n")
+
+	sinkMu.Lock()
+	defer sinkMu.Unlock()
+
+	f, err := os.OpenFile(t.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("mbox: opening %s failed: %v", t.Path, err)
+	}
+	if _, err := b.WriteTo(f); err != nil {
+		f.Close()
+		return fmt.Errorf("mbox: writing to %s failed: %v", t.Path, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("mbox: writing to %s failed: %v", t.Path, err)
+	}
+	return nil
+}
+
+// MaildirTransport delivers messages into a Maildir.
+type MaildirTransport struct {
+	// Dir is the Maildir. It and its tmp, new and cur subdirectories are
+	// created if they do not exist.
+	Dir string
+}
+
+// Name returns "maildir".
+func (t MaildirTransport) Name() string {
+	return "maildir"
+}
+
+// Send writes m to the tmp directory of the Maildir and moves it to new once
+// it is complete.
+func (t MaildirTransport) Send(m *Message) error {
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(t.Dir, sub), 0700); err != nil {
+			return fmt.Errorf("maildir: creating %s failed: %v", t.Dir, err)
+		}
+	}
+
+	name := maildirName()
+	tmp := filepath.Join(t.Dir, "tmp", name)
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("maildir: creating message failed: %v", err)
+	}
+	if _, err := io.Copy(f, bytes.NewReader(toLF(msg))); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("maildir: writing message failed: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("maildir: writing message failed: %v", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(t.Dir, "new", name)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("maildir: delivering message failed: %v", err)
+	}
+	return nil
+}
+
+// maildirName returns a unique file name for a Maildir message.
+func maildirName() string {
+	// "/" and ":" are not allowed in the host part of the name.
+	host := strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname())
+
+	r := make([]byte, 8)
+	rand.Read(r)
+
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dR%s.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), hex.EncodeToString(r), host)
+}
+
+// toLF converts CRLF line endings, as used on the wire, to the LF line
+// endings of local mailboxes.
+func toLF(b []byte) []byte {
+	return bytes.Replace(b, []byte("\r\n"), []byte("\n"), -1)
+}
@@ -0,0 +1,260 @@
+package email
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStdoutTransport(t *testing.T) {
+	f, err := ioutil.TempFile("", "upmail-stdout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	stdout := os.Stdout
+	os.Stdout = f
+	tr := StdoutTransport{}
+	err = tr.Send(testMessage("api is down"))
+	if err == nil {
+		err = tr.Send(testMessage("api is up"))
+	}
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	out, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each message is followed by an empty line, also when its body does
+	// not end with a line break.
+	messages := strings.SplitAfter(string(out), "body\r\n\r\n")
+	if len(messages) != 3 || messages[2] != "" {
+		t.Fatalf("stdout does not have two messages each followed by an empty line:\n%q", out)
+	}
+	for i, subject := range []string{"api is down", "api is up"} {
+		if !strings.Contains(messages[i], "\r\nSubject: "+subject+"\r\n") {
+			t.Fatalf("message %d does not have the subject %q:\n%s", i, subject, messages[i])
+		}
+	}
+}
+
+func TestMboxTransport(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain line", "api is down", "api is down"},
+		{"from line", "From here on", ">From here on"},
+		{"quoted from line", ">From here on", ">>From here on"},
+		{"twice quoted from line", ">>From here on", ">>>From here on"},
+		{"from in the middle", "Sent From here", "Sent From here"},
+		{"indented from line", " From here on", " From here on"},
+		{"lower case from line", "from here on", "from here on"},
+		{"quoted line", ">Fromage", ">Fromage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "upmail-mbox")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			m := testMessage("api is down")
+			m.Text = "Hello,\r\n" + tt.text + "\r\n"
+			m.Date = time.Date(2026, 10, 17, 12, 0, 0, 0, time.FixedZone("CEST", 2*60*60))
+			path := filepath.Join(dir, "upmail.mbox")
+			if err := (MboxTransport{Path: path}).Send(m); err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+
+			b, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mbox := string(b)
+			if want := "From upmail@example.com Sat Oct 17 10:00:00 2026\n"; !strings.HasPrefix(mbox, want) {
+				t.Fatalf("mbox does not start with %q:\n%s", want, mbox)
+			}
+			if strings.Contains(mbox, "\r") {
+				t.Fatalf("mbox has CRLF line endings:\n%q", mbox)
+			}
+			if !strings.HasSuffix(mbox, "\n"+tt.want+"\n\n") {
+				t.Fatalf("mbox does not end with the line %q and an empty line:\n%s", tt.want, mbox)
+			}
+			if strings.Count(mbox, "\nFrom ") != 0 {
+				t.Fatalf("mbox has an unquoted From line in the message:\n%s", mbox)
+			}
+		})
+	}
+}
+
+func TestMboxTransportAppends(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upmail-mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "upmail.mbox")
+	tr := MboxTransport{Path: path}
+	for _, subject := range []string{"api is down", "api is up"} {
+		if err := tr.Send(testMessage(subject)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mbox := string(b)
+	if n := strings.Count("\n"+mbox, "\nFrom upmail@example.com "); n != 2 {
+		t.Fatalf("mbox has %d messages, want 2:\n%s", n, mbox)
+	}
+	if i, j := strings.Index(mbox, "Subject: api is down"), strings.Index(mbox, "Subject: api is up"); i < 0 || j < i {
+		t.Fatalf("mbox does not have the messages in order:\n%s", mbox)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("mbox mode is %v, want 0600", fi.Mode().Perm())
+	}
+
+	err = MboxTransport{Path: filepath.Join(dir, "missing", "upmail.mbox")}.Send(testMessage("api is down"))
+	if err == nil || !strings.Contains(err.Error(), "mbox: opening") {
+		t.Fatalf("Send to a missing directory returned %v", err)
+	}
+}
+
+func TestMaildirTransport(t *testing.T) {
+	tests := []struct {
+		name string
+		// setup prepares the Maildir before the messages are sent.
+		setup     func(dir string) error
+		wantError string
+	}{
+		{
+			name:  "missing Maildir is created",
+			setup: func(dir string) error { return nil },
+		},
+		{
+			name: "existing Maildir",
+			setup: func(dir string) error {
+				for _, sub := range []string{"tmp", "new", "cur"} {
+					if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+		{
+			name: "Maildir is a file",
+			setup: func(dir string) error {
+				return ioutil.WriteFile(dir, nil, 0600)
+			},
+			wantError: "maildir: creating",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parent, err := ioutil.TempDir("", "upmail-maildir")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(parent)
+
+			dir := filepath.Join(parent, "Maildir")
+			if err := tt.setup(dir); err != nil {
+				t.Fatal(err)
+			}
+			tr := MaildirTransport{Dir: dir}
+
+			subjects := []string{"api is down", "api is up"}
+			for _, subject := range subjects {
+				err := tr.Send(testMessage(subject))
+				if tt.wantError != "" {
+					if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+						t.Fatalf("Send returned %v, want an error containing %q", err, tt.wantError)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("Send: %v", err)
+				}
+			}
+
+			// Complete messages are moved out of tmp into new, none are
+			// left behind in tmp and cur is left to the mail reader.
+			for sub, want := range map[string]int{"tmp": 0, "new": len(subjects), "cur": 0} {
+				files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(files) != want {
+					t.Fatalf("%s has %d files, want %d", sub, len(files), want)
+				}
+			}
+
+			files, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, fi := range files {
+				if strings.ContainsAny(fi.Name(), "/:") {
+					t.Errorf("message name %q contains / or :", fi.Name())
+				}
+				if fi.Mode().Perm() != 0600 {
+					t.Errorf("message %s mode is %v, want 0600", fi.Name(), fi.Mode().Perm())
+				}
+				b, err := ioutil.ReadFile(filepath.Join(dir, "new", fi.Name()))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(b, []byte("\r")) {
+					t.Errorf("message %s has CRLF line endings", fi.Name())
+				}
+				msg, err := mail.ReadMessage(bytes.NewReader(b))
+				if err != nil {
+					t.Fatalf("parsing message %s: %v", fi.Name(), err)
+				}
+				got = append(got, msg.Header.Get("Subject"))
+			}
+			sort.Strings(got)
+			if strings.Join(got, ",") != strings.Join(subjects, ",") {
+				t.Fatalf("delivered %q, want %q", got, subjects)
+			}
+		})
+	}
+}
+
+func TestMaildirName(t *testing.T) {
+	a, b := maildirName(), maildirName()
+	if a == b {
+		t.Fatalf("two messages are both named %s", a)
+	}
+	host := strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostname())
+	if !strings.HasSuffix(a, "."+host) {
+		t.Fatalf("name %s does not end in the host name %s", a, host)
+	}
+	if strings.ContainsAny(a, "/:") {
+		t.Fatalf("name %s contains a / or a :", a)
+	}
+}
@@ -0,0 +1,209 @@
+package email
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// TLSMode is the TLS policy of an SMTP connection.
+type TLSMode string
+
+const (
+	// TLSStartTLS upgrades the connection with STARTTLS if the server
+	// supports it and continues in plaintext otherwise.
+	TLSStartTLS TLSMode = "starttls"
+	// TLSRequireStartTLS upgrades the connection with STARTTLS and refuses
+	// to send anything if the server does not support it.
+	TLSRequireStartTLS TLSMode = "require-starttls"
+	// TLSImplicit connects with TLS right away, usually on port 465.
+	TLSImplicit TLSMode = "implicit"
+	// TLSNone never uses TLS.
+	TLSNone TLSMode = "none"
+)
+
+// ParseTLSMode parses a TLS mode. The empty string results in TLSStartTLS.
+func ParseTLSMode(s string) (TLSMode, error) {
+	switch m := TLSMode(s); m {
+	case "":
+		return TLSStartTLS, nil
+	case TLSStartTLS, TLSRequireStartTLS, TLSImplicit, TLSNone:
+		return m, nil
+	}
+	return "", fmt.Errorf("invalid TLS mode %q, must be one of implicit, starttls, require-starttls or none", s)
+}
+
+// NewTLSConfig builds the TLS configuration for a server. caFile adds a
+// PEM encoded CA bundle to the trusted roots, certFile and keyFile configure
+// a client certificate.
+func NewTLSConfig(serverName, caFile, certFile, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA bundle failed: %v", err)
+		}
+		config.RootCAs, err = x509.SystemCertPool()
+		if err != nil || config.RootCAs == nil {
+			config.RootCAs = x509.NewCertPool()
+		}
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("CA bundle %s does not contain any PEM encoded certificates", caFile)
+		}
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate failed: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// smtpTimeout bounds connecting to the SMTP server. Twice as long bounds
+// the whole session, so that a stalled server cannot block delivery.
+const smtpTimeout = 30 * time.Second
+
+// SMTPTransport delivers messages to an SMTP server.
+type SMTPTransport struct {
+	// Server is the address of the SMTP server as host:port.
+	Server string
+	// Auth holds the authentication details for the server.
+	Auth smtp.Auth
+	// TLS is the TLS policy. The zero value means TLSStartTLS.
+	TLS TLSMode
+	// TLSConfig is the TLS configuration. If nil, the system roots are
+	// trusted and the host of Server is verified.
+	TLSConfig *tls.Config
+}
+
+// Name returns "smtp".
+func (t SMTPTransport) Name() string {
+	return "smtp"
+}
+
+// Send delivers m over SMTP.
+func (t SMTPTransport) Send(m *Message) error {
+	msg, err := m.Bytes()
+	if err != nil {
+		return err
+	}
+	from, err := m.Sender()
+	if err != nil {
+		return err
+	}
+	to, err := m.Recipients()
+	if err != nil {
+		return err
+	}
+
+	c, err := t.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if t.Auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("smtp: server %s does not support authentication", t.Server)
+		}
+		if err := c.Auth(connAuth(t.Auth)); err != nil {
+			return fmt.Errorf("smtp: authentication failed: %v", err)
+		}
+	}
+
+	if err := c.Mail(from); err != nil {
+		return fmt.Errorf("smtp: MAIL FROM failed: %v", err)
+	}
+	for _, rcpt := range to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return fmt.Errorf("smtp: RCPT TO %s failed: %v", rcpt, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("smtp: DATA failed: %v", err)
+	}
+	if _, err := w.Write(msg); err != nil {
+		return fmt.Errorf("smtp: writing message failed: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("smtp: message rejected: %v", err)
+	}
+
+	return c.Quit()
+}
+
+// dial connects to the server and negotiates TLS according to the policy of
+// the transport.
+func (t SMTPTransport) dial() (*smtp.Client, error) {
+	mode, err := ParseTLSMode(string(t.TLS))
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(t.Server)
+	if err != nil {
+		return nil, fmt.Errorf("smtp: invalid server address %q: %v", t.Server, err)
+	}
+	config := t.TLSConfig
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	if mode == TLSImplicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", t.Server, config)
+		if err != nil {
+			return nil, fmt.Errorf("smtp: implicit TLS connection to %s failed: %v", t.Server, err)
+		}
+	} else {
+		conn, err = dialer.Dial("tcp", t.Server)
+		if err != nil {
+			return nil, fmt.Errorf("smtp: connecting to %s failed: %v", t.Server, err)
+		}
+	}
+	conn.SetDeadline(time.Now().Add(2 * smtpTimeout))
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("smtp: greeting from %s failed: %v", t.Server, err)
+	}
+
+	if err := c.Hello(hostname()); err != nil {
+		c.Close()
+		return nil, fmt.Errorf("smtp: EHLO failed: %v", err)
+	}
+
+	if mode == TLSStartTLS || mode == TLSRequireStartTLS {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(config); err != nil {
+				c.Close()
+				return nil, fmt.Errorf("smtp: STARTTLS handshake with %s failed: %v", t.Server, err)
+			}
+		} else if mode == TLSRequireStartTLS {
+			c.Close()
+			return nil, fmt.Errorf("smtp: server %s does not support STARTTLS and TLS is required", t.Server)
+		}
+	}
+
+	return c, nil
+}
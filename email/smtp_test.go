@@ -0,0 +1,594 @@
+package email
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCert is a self-signed certificate for 127.0.0.1 and localhost.
+type testCert struct {
+	cert tls.Certificate
+	// certFile and keyFile hold the PEM encoded certificate and key.
+	certFile string
+	keyFile  string
+}
+
+// newTestCert creates a self-signed certificate with the common name cn in
+// dir.
+func newTestCert(t *testing.T, dir, cn string) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	c := testCert{
+		certFile: filepath.Join(dir, cn+".crt"),
+		keyFile:  filepath.Join(dir, cn+".key"),
+	}
+	if err := ioutil.WriteFile(c.certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(c.keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if c.cert, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// smtpSession is what the fake SMTP server received on one connection.
+type smtpSession struct {
+	helo       string
+	tls        bool
+	clientCert string
+	commands   []string
+	// auth is the mechanism and the credentials the client authenticated
+	// with, as "<mechanism> <username> <password>".
+	auth string
+	data string
+}
+
+// smtpServer is a fake SMTP server on a TCP port of localhost.
+type smtpServer struct {
+	// implicit makes the server speak TLS right away.
+	implicit bool
+	// startTLS advertises STARTTLS.
+	startTLS bool
+	// greeting replaces the 220 greeting.
+	greeting string
+	// ehloReply, if set, rejects EHLO and HELO with it.
+	ehloReply string
+	// dataReply replaces the reply to the end of DATA.
+	dataReply string
+	// auth lists the advertised authentication mechanisms.
+	auth []string
+
+	config *tls.Config
+	ln     net.Listener
+
+	mu       sync.Mutex
+	sessions []smtpSession
+}
+
+// newSMTPServer starts a fake SMTP server presenting cert on TLS
+// connections. configure is called before it accepts connections.
+func newSMTPServer(t *testing.T, cert testCert, configure func(s *smtpServer)) *smtpServer {
+	s := &smtpServer{
+		config: &tls.Config{
+			Certificates: []tls.Certificate{cert.cert},
+			ClientAuth:   tls.RequestClientCert,
+		},
+	}
+	if configure != nil {
+		configure(s)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.implicit {
+		ln = tls.NewListener(ln, s.config)
+	}
+	s.ln = ln
+	go s.serve()
+	return s
+}
+
+func (s *smtpServer) addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *smtpServer) close() {
+	s.ln.Close()
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		session := s.handle(conn)
+		conn.Close()
+
+		s.mu.Lock()
+		s.sessions = append(s.sessions, session)
+		s.mu.Unlock()
+	}
+}
+
+func (s *smtpServer) handle(conn net.Conn) smtpSession {
+	var session smtpSession
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			return session
+		}
+		session.tls = true
+		session.clientCert = peerCommonName(tc)
+	}
+
+	c := textproto.NewConn(conn)
+	if s.greeting != "" {
+		c.PrintfLine("%s", s.greeting)
+		return session
+	}
+	c.PrintfLine("220 localhost ESMTP ready")
+
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return session
+		}
+		session.commands = append(session.commands, line)
+
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO") || strings.HasPrefix(cmd, "HELO"):
+			if s.ehloReply != "" {
+				c.PrintfLine("%s", s.ehloReply)
+				continue
+			}
+			session.helo = strings.TrimSpace(line[4:])
+			c.PrintfLine("250-localhost")
+			if s.startTLS && !session.tls {
+				c.PrintfLine("250-STARTTLS")
+			}
+			if len(s.auth) > 0 {
+				c.PrintfLine("250-AUTH %s", strings.Join(s.auth, " "))
+			}
+			c.PrintfLine("250 8BITMIME")
+		case cmd == "STARTTLS":
+			c.PrintfLine("220 Ready to start TLS")
+			tc := tls.Server(conn, s.config)
+			if err := tc.Handshake(); err != nil {
+				return session
+			}
+			conn = tc
+			c = textproto.NewConn(conn)
+			session.tls = true
+			session.clientCert = peerCommonName(tc)
+		case strings.HasPrefix(cmd, "AUTH "):
+			auth, err := smtpAuth(c, strings.Fields(line)[1:])
+			if err != nil {
+				c.PrintfLine("535 5.7.8 %v", err)
+				continue
+			}
+			session.auth = auth
+			c.PrintfLine("235 2.7.0 Authentication successful")
+		case cmd == "DATA":
+			c.PrintfLine("354 Start mail input")
+			b, err := c.ReadDotBytes()
+			if err != nil {
+				return session
+			}
+			session.data = string(b)
+			if s.dataReply != "" {
+				c.PrintfLine("%s", s.dataReply)
+				continue
+			}
+			c.PrintfLine("250 2.0.0 queued")
+		case cmd == "QUIT":
+			c.PrintfLine("221 Bye")
+			return session
+		default:
+			c.PrintfLine("250 OK")
+		}
+	}
+}
+
+// smtpAuth runs the server side of an AUTH command with the given
+// arguments and returns the mechanism and credentials used. The CRAM-MD5
+// response is returned as the password.
+func smtpAuth(c *textproto.Conn, args []string) (string, error) {
+	challenge := func(prompt string) (string, error) {
+		c.PrintfLine("334 %s", base64.StdEncoding.EncodeToString([]byte(prompt)))
+		line, err := c.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		b, err := base64.StdEncoding.DecodeString(line)
+		return string(b), err
+	}
+
+	mech := strings.ToUpper(args[0])
+	switch mech {
+	case "PLAIN":
+		if len(args) != 2 {
+			return "", errors.New("missing initial response")
+		}
+		b, err := base64.StdEncoding.DecodeString(args[1])
+		if err != nil {
+			return "", err
+		}
+		fields := strings.Split(string(b), "\x00")
+		if len(fields) != 3 {
+			return "", fmt.Errorf("invalid PLAIN response %q", b)
+		}
+		return mech + " " + fields[1] + " " + fields[2], nil
+	case "LOGIN":
+		username, err := challenge("Username:")
+		if err != nil {
+			return "", err
+		}
+		password, err := challenge("Password:")
+		if err != nil {
+			return "", err
+		}
+		return mech + " " + username + " " + password, nil
+	case "CRAM-MD5":
+		resp, err := challenge("<1896.697170952@localhost>")
+		if err != nil {
+			return "", err
+		}
+		return mech + " " + resp, nil
+	}
+	return "", fmt.Errorf("unsupported mechanism %s", mech)
+}
+
+// received waits until n sessions ended and returns them.
+func (s *smtpServer) received(t *testing.T, n int) []smtpSession {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.mu.Lock()
+		sessions := append([]smtpSession(nil), s.sessions...)
+		s.mu.Unlock()
+		if len(sessions) >= n || time.Now().After(deadline) {
+			if len(sessions) != n {
+				t.Fatalf("server got %d sessions, want %d", len(sessions), n)
+			}
+			return sessions
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func peerCommonName(c *tls.Conn) string {
+	certs := c.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
+
+func TestParseTLSMode(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    TLSMode
+		invalid bool
+	}{
+		{in: "", want: TLSStartTLS},
+		{in: "starttls", want: TLSStartTLS},
+		{in: "require-starttls", want: TLSRequireStartTLS},
+		{in: "implicit", want: TLSImplicit},
+		{in: "none", want: TLSNone},
+		{in: "tls", invalid: true},
+		{in: "STARTTLS", invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseTLSMode(tt.in)
+			if tt.invalid {
+				if err == nil || !strings.Contains(err.Error(), "invalid TLS mode") {
+					t.Fatalf("ParseTLSMode returned %q, %v, want an invalid TLS mode error", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseTLSMode: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("mode is %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upmail-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, dir, "ca")
+	client := newTestCert(t, dir, "client")
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("no certificates here\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		caFile    string
+		certFile  string
+		keyFile   string
+		wantError string
+	}{
+		{name: "defaults"},
+		{name: "CA bundle", caFile: ca.certFile},
+		{name: "client certificate", certFile: client.certFile, keyFile: client.keyFile},
+		{name: "missing CA bundle", caFile: filepath.Join(dir, "missing.pem"), wantError: "reading CA bundle failed"},
+		{name: "CA bundle without certificates", caFile: empty, wantError: "does not contain any PEM encoded certificates"},
+		{name: "client certificate without key", certFile: client.certFile, wantError: "loading client certificate failed"},
+		{name: "client certificate with the wrong key", certFile: client.certFile, keyFile: ca.keyFile, wantError: "loading client certificate failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := NewTLSConfig("mail.example.com", tt.caFile, tt.certFile, tt.keyFile, false)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("NewTLSConfig returned %v, want an error containing %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewTLSConfig: %v", err)
+			}
+			if config.ServerName != "mail.example.com" {
+				t.Fatalf("server name is %q", config.ServerName)
+			}
+
+			if tt.caFile == "" && config.RootCAs != nil {
+				t.Fatal("system roots were replaced without a CA bundle")
+			}
+			if tt.caFile != "" {
+				leaf, err := x509.ParseCertificate(ca.cert.Certificate[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := leaf.Verify(x509.VerifyOptions{Roots: config.RootCAs, DNSName: "localhost"}); err != nil {
+					t.Fatalf("certificate from the CA bundle is not trusted: %v", err)
+				}
+			}
+			if want := tt.certFile != ""; (len(config.Certificates) == 1) != want {
+				t.Fatalf("config has %d client certificates", len(config.Certificates))
+			}
+		})
+	}
+}
+
+func TestSMTPTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upmail-smtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := newTestCert(t, dir, "server")
+	client := newTestCert(t, dir, "client")
+	trusted, err := NewTLSConfig("", server.certFile, "", "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withClientCert, err := NewTLSConfig("", server.certFile, client.certFile, client.keyFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		configure func(s *smtpServer)
+		mode      TLSMode
+		config    *tls.Config
+		// wantTLS is whether the message was sent over TLS.
+		wantTLS bool
+		// wantCommand is a command the session must contain.
+		wantCommand string
+		// noCommand is a command the session must not contain.
+		noCommand  string
+		clientCert string
+		wantError  string
+	}{
+		{
+			name:        "starttls",
+			configure:   func(s *smtpServer) { s.startTLS = true },
+			config:      trusted,
+			wantTLS:     true,
+			wantCommand: "STARTTLS",
+		},
+		{
+			name:      "starttls without server support",
+			mode:      TLSStartTLS,
+			config:    trusted,
+			noCommand: "STARTTLS",
+		},
+		{
+			name:        "require-starttls",
+			configure:   func(s *smtpServer) { s.startTLS = true },
+			mode:        TLSRequireStartTLS,
+			config:      trusted,
+			wantTLS:     true,
+			wantCommand: "STARTTLS",
+		},
+		{
+			name:      "require-starttls without server support",
+			mode:      TLSRequireStartTLS,
+			config:    trusted,
+			noCommand: "MAIL FROM:<upmail@example.com>",
+			wantError: "does not support STARTTLS and TLS is required",
+		},
+		{
+			name:      "implicit",
+			configure: func(s *smtpServer) { s.implicit = true },
+			mode:      TLSImplicit,
+			config:    trusted,
+			wantTLS:   true,
+		},
+		{
+			name:      "none",
+			configure: func(s *smtpServer) { s.startTLS = true },
+			mode:      TLSNone,
+			noCommand: "STARTTLS",
+		},
+		{
+			name:        "client certificate",
+			configure:   func(s *smtpServer) { s.startTLS = true },
+			mode:        TLSRequireStartTLS,
+			config:      withClientCert,
+			wantTLS:     true,
+			wantCommand: "STARTTLS",
+			clientCert:  "client",
+		},
+		{
+			name:      "implicit TLS against a plaintext server",
+			mode:      TLSImplicit,
+			config:    trusted,
+			wantError: "implicit TLS connection to 127.0.0.1:",
+		},
+		{
+			name:      "STARTTLS with an untrusted certificate",
+			configure: func(s *smtpServer) { s.startTLS = true },
+			wantError: "STARTTLS handshake with 127.0.0.1:",
+		},
+		{
+			name:      "greeting",
+			configure: func(s *smtpServer) { s.greeting = "554 no service" },
+			config:    trusted,
+			wantError: "greeting from 127.0.0.1:",
+		},
+		{
+			name:      "EHLO",
+			configure: func(s *smtpServer) { s.ehloReply = "502 not implemented" },
+			config:    trusted,
+			wantError: "EHLO failed",
+		},
+		{
+			name:      "message rejected",
+			configure: func(s *smtpServer) { s.dataReply = "554 5.7.1 spam" },
+			mode:      TLSNone,
+			wantError: "message rejected: 554",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newSMTPServer(t, server, tt.configure)
+			defer srv.close()
+
+			tr := SMTPTransport{Server: srv.addr(), TLS: tt.mode, TLSConfig: tt.config}
+			err := tr.Send(testMessage("api is down"))
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) || !strings.HasPrefix(err.Error(), "smtp: ") {
+					t.Fatalf("Send returned %v, want an error containing %q", err, tt.wantError)
+				}
+			} else if err != nil {
+				t.Fatalf("Send: %v", err)
+			}
+
+			session := srv.received(t, 1)[0]
+			commands := strings.Join(session.commands, "\n")
+			if tt.wantCommand != "" && !strings.Contains(commands, tt.wantCommand) {
+				t.Fatalf("session does not contain %s:\n%s", tt.wantCommand, commands)
+			}
+			if tt.noCommand != "" && strings.Contains(commands, tt.noCommand) {
+				t.Fatalf("session contains %s:\n%s", tt.noCommand, commands)
+			}
+			if tt.wantError != "" {
+				return
+			}
+
+			if session.tls != tt.wantTLS {
+				t.Fatalf("message was sent with TLS %v, want %v", session.tls, tt.wantTLS)
+			}
+			if session.clientCert != tt.clientCert {
+				t.Fatalf("client certificate is %q, want %q", session.clientCert, tt.clientCert)
+			}
+			if session.helo != hostname() {
+				t.Fatalf("EHLO with %q, want %q", session.helo, hostname())
+			}
+			if !strings.Contains(session.data, "Subject: api is down") {
+				t.Fatalf("server received\n%s", session.data)
+			}
+		})
+	}
+}
+
+func TestSMTPTransportErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := ln.Addr().String()
+	ln.Close()
+
+	tests := []struct {
+		name      string
+		tr        SMTPTransport
+		wantError string
+	}{
+		{"invalid mode", SMTPTransport{Server: closed, TLS: "tls"}, "invalid TLS mode"},
+		{"invalid address", SMTPTransport{Server: "mail.example.com"}, "smtp: invalid server address"},
+		{"connection refused", SMTPTransport{Server: closed}, "smtp: connecting to " + closed + " failed"},
+		{"implicit connection refused", SMTPTransport{Server: closed, TLS: TLSImplicit}, "smtp: implicit TLS connection to " + closed + " failed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.tr.Send(testMessage("api is down"))
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Fatalf("Send returned %v, want an error containing %q", err, tt.wantError)
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+package email
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sourcegraph/checkup"
+)
+
+// stateExpiry is how long a check that no longer shows up in the results,
+// for example because it was removed from the checkup configuration, is kept
+// in the state.
+const stateExpiry = 7 * 24 * time.Hour
+
+// State holds the last known status of every check the notifier has seen.
+// It is persisted between runs so a restart does not re-alert on checks
+// that are already known to be unhealthy.
+type State struct {
+	// Checks maps the key of a check (see StateKey) to its state.
+	Checks map[string]*CheckState `json:"checks"`
+	// Maintenance maps the name of every maintenance window whose start
+	// was notified to its occurrence, until its end is notified.
+	Maintenance map[string]ActiveMaintenance `json:"maintenance,omitempty"`
+}
+
+// CheckState is the persisted state of a single check.
+type CheckState struct {
+	// Title is the title of the check.
+	Title string `json:"title"`
+	// Endpoint is the endpoint of the check.
+	Endpoint string `json:"endpoint"`
+	// Status is the last notified status of the check. It is empty until
+	// a new check reaches its threshold.
+	Status checkup.StatusText `json:"status"`
+	// Since is when the check entered its current status.
+	Since time.Time `json:"since"`
+	// OutageStart is when the check last went from healthy to down or
+	// degraded. It is zero while the check is healthy.
+	OutageStart time.Time `json:"outage_start"`
+	// Notified is when the last email about the check was sent.
+	Notified time.Time `json:"notified,omitempty"`
+	// Seen is when the check was last in the results of a check run.
+	Seen time.Time `json:"seen,omitempty"`
+	// Failures is the number of consecutive unhealthy results.
+	Failures int `json:"failures,omitempty"`
+	// Successes is the number of consecutive healthy results.
+	Successes int `json:"successes,omitempty"`
+	// FailedRuns is the number of unhealthy results since the current
+	// outage started, including those below the alert threshold.
+	FailedRuns int `json:"failed_runs,omitempty"`
+	// History holds the statuses of the recent results for flap
+	// detection, oldest first.
+	History []checkup.StatusText `json:"history,omitempty"`
+	// Flapping is set while the check is flapping.
+	Flapping bool `json:"flapping,omitempty"`
+	// Escalation is the escalation of the current outage, if its route has
+	// an escalation policy.
+	Escalation *Escalation `json:"escalation,omitempty"`
+	// Digested records who already got the pending status change of the
+	// check in a digest while the digest to others failed.
+	Digested *DigestDelivery `json:"digested,omitempty"`
+}
+
+// StateKey returns the key used to identify the check that produced r in
+// the persisted state.
+func StateKey(r checkup.Result) string {
+	return r.Title + " " + r.Endpoint
+}
+
+// LoadState reads the state from file. A missing file results in an empty
+// state.
+func LoadState(file string) (*State, error) {
+	s := &State{Checks: map[string]*CheckState{}}
+	if file == "" {
+		return s, nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, fmt.Errorf("reading state file %s failed: %v", file, err)
+	}
+
+	if err := json.Unmarshal(b, s); err != nil {
+		return nil, fmt.Errorf("decoding state file %s failed: %v", file, err)
+	}
+	if s.Checks == nil {
+		s.Checks = map[string]*CheckState{}
+	}
+
+	return s, nil
+}
+
+// prune records that the checks of results were seen at now and drops the
+// checks that were not seen for stateExpiry. Checks from state files written
+// before Seen was recorded count as seen at now.
+func (s *State) prune(results []checkup.Result, now time.Time) {
+	for _, r := range results {
+		if cs, ok := s.Checks[StateKey(r)]; ok {
+			cs.Seen = now
+		}
+	}
+
+	for key, cs := range s.Checks {
+		switch {
+		case cs.Seen.IsZero():
+			cs.Seen = now
+		case now.Sub(cs.Seen) > stateExpiry:
+			logrus.Infof("%s was not checked since %s: dropping it from the state", cs.Title, cs.Seen.Format(time.RFC3339))
+			delete(s.Checks, key)
+		}
+	}
+}
+
+// Save atomically writes the state to file.
+func (s *State) Save(file string) error {
+	if file == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding state failed: %v", err)
+	}
+
+	if err := writeFileAtomic(file, b); err != nil {
+		return fmt.Errorf("writing state file failed: %v", err)
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes b to a temporary file next to file and renames it
+// over file, so readers never see a partially written file.
+func writeFileAtomic(file string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return nil
+}
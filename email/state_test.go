@@ -0,0 +1,143 @@
+package email
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/checkup"
+)
+
+func TestStateSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upmail-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "upmail.state.json")
+
+	tr := &fakeTransport{}
+	newNotifier := func() *Notifier {
+		return &Notifier{
+			Transports: []Transport{tr},
+			Routing:    Routing{Default: []string{"ops@example.com"}},
+			StateFile:  file,
+		}
+	}
+	down := []checkup.Result{testResult("api", "down"), testResult("web", "up")}
+
+	if err := newNotifier().Notify(down); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got := tr.subjects(); len(got) != 1 || !strings.Contains(got[0], "api") {
+		t.Fatalf("sent %q, want an alert about api", got)
+	}
+
+	// A restarted notifier knows api is already down.
+	n := newNotifier()
+	if err := n.Notify(down); err != nil {
+		t.Fatalf("Notify after a restart: %v", err)
+	}
+	if got := tr.subjects(); len(got) != 1 {
+		t.Fatalf("sent %q after a restart, want no new email", got)
+	}
+
+	// And still sends the recovery.
+	if err := newNotifier().Notify([]checkup.Result{testResult("api", "up"), testResult("web", "up")}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	if got := tr.subjects(); len(got) != 2 || !strings.Contains(got[1], "api") {
+		t.Fatalf("sent %q, want a recovery of api", got)
+	}
+}
+
+func TestStatePrune(t *testing.T) {
+	now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		seen time.Time
+		// checked is set if the check is in the results.
+		checked bool
+		want    time.Time
+	}{
+		{name: "checked", seen: now.Add(-time.Hour), checked: true, want: now},
+		{name: "checked after a long time", seen: now.Add(-30 * 24 * time.Hour), checked: true, want: now},
+		{name: "recently seen", seen: now.Add(-time.Hour), want: now.Add(-time.Hour)},
+		{name: "seen just within the expiry", seen: now.Add(-stateExpiry), want: now.Add(-stateExpiry)},
+		{name: "expired", seen: now.Add(-stateExpiry - time.Minute)},
+		{name: "never seen", want: now},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testResult("api", "down")
+			s := &State{Checks: map[string]*CheckState{
+				StateKey(r): {Title: r.Title, Endpoint: r.Endpoint, Status: checkup.Down, Seen: tt.seen},
+			}}
+
+			var results []checkup.Result
+			if tt.checked {
+				results = append(results, r)
+			}
+			s.prune(results, now)
+
+			cs, ok := s.Checks[StateKey(r)]
+			if tt.want.IsZero() {
+				if ok {
+					t.Fatalf("check was kept, last seen %s", cs.Seen)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("check was dropped")
+			}
+			if !cs.Seen.Equal(tt.want) {
+				t.Fatalf("check was seen %s, want %s", cs.Seen, tt.want)
+			}
+		})
+	}
+}
+
+func TestNotifyDropsRemovedChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "upmail-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "upmail.state.json")
+
+	// db was removed from the checkup configuration long ago.
+	db := testResult("db", "down")
+	s := &State{Checks: map[string]*CheckState{
+		StateKey(db): {Title: db.Title, Endpoint: db.Endpoint, Status: checkup.Down, Seen: time.Now().Add(-2 * stateExpiry)},
+	}}
+	if err := s.Save(file); err != nil {
+		t.Fatal(err)
+	}
+
+	n := &Notifier{
+		Transports: []Transport{&fakeTransport{}},
+		Routing:    Routing{Default: []string{"ops@example.com"}},
+		StateFile:  file,
+	}
+	if err := n.Notify([]checkup.Result{testResult("api", "up"), testResult("web", "up")}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	s, err = LoadState(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, cs := range s.Checks {
+		got = append(got, cs.Title)
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != "api,web" {
+		t.Fatalf("state has the checks %q, want api and web", got)
+	}
+}
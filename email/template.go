@@ -0,0 +1,681 @@
+package email
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+	"time"
+
+	"github.com/sourcegraph/checkup"
+)
+
+// Names of the templates, one set of which exists per kind of email. A
+// template directory may contain any of the files
+// <name>.subject.tmpl, <name>.txt.tmpl and <name>.html.tmpl; the files that
+// are missing fall back to the embedded defaults.
+const (
+	TemplateAlert      = "alert"
+	TemplateRecovery   = "recovery"
+	TemplateDigest     = "digest"
+	TemplateFlapping   = "flapping"
+	TemplateStable     = "stable"
+	TemplateReminder   = "reminder"
+	TemplateEscalation = "escalation"
+
+	TemplateMaintenanceStarted = "maintenance-started"
+	TemplateMaintenanceEnded   = "maintenance-ended"
+)
+
+var templateNames = []string{TemplateAlert, TemplateRecovery, TemplateDigest, TemplateFlapping, TemplateStable, TemplateReminder, TemplateEscalation, TemplateMaintenanceStarted, TemplateMaintenanceEnded}
+
+var defaultSubjectTemplates = map[string]string{
+	TemplateAlert:      `[UPMAIL]: {{.Result.Title}} {{.Status}}`,
+	TemplateRecovery:   `[UPMAIL]: {{.Result.Title}} resolved`,
+	TemplateDigest:     `[UPMAIL]: {{summary .}}`,
+	TemplateFlapping:   `[UPMAIL]: {{.Result.Title}} FLAPPING`,
+	TemplateStable:     `[UPMAIL]: {{.Result.Title}} stopped flapping, {{.Status}}`,
+	TemplateReminder:   `[UPMAIL]: {{.Result.Title}} still {{.Status}} after {{.Duration}}`,
+	TemplateEscalation: `[UPMAIL]: {{.Result.Title}} {{.Status}} not acknowledged after {{.Duration}}`,
+
+	TemplateMaintenanceStarted: `[UPMAIL]: maintenance {{.Maintenance.Name}} started`,
+	TemplateMaintenanceEnded:   `[UPMAIL]: maintenance {{.Maintenance.Name}} ended`,
+}
+
+var defaultTextTemplates = map[string]string{
+	TemplateAlert: `Time: {{date .Time}}
+
+{{.Result.String}}`,
+
+	TemplateRecovery: `Time: {{date .Time}}
+
+== {{.Result.Title}} - {{.Result.Endpoint}} is healthy again
+
+    Outage started: {{date .OutageStart}}
+   Outage duration: {{.Duration}}
+   Previous status: {{.Previous}}
+
+Final RTT stats:
+  Threshold: {{.Result.ThresholdRTT}}
+        Max: {{.Stats.Max}}
+        Min: {{.Stats.Min}}
+     Median: {{.Stats.Median}}
+       Mean: {{.Stats.Mean}}
+`,
+
+	TemplateDigest: `Time: {{date .Time}}
+
+{{if .Unhealthy}}{{table .Unhealthy}}
+{{end}}{{if .Resolved}}Resolved:
+{{range .Resolved}}  {{.Result.Title}} - {{.Result.Endpoint}} was {{.Previous}} for {{.Duration}}
+{{end}}
+{{end}}{{range .Unhealthy}}{{.Result.String}}
+{{end}}`,
+
+	TemplateFlapping: `Time: {{date .Time}}
+
+== {{.Result.Title}} - {{.Result.Endpoint}} is flapping
+
+Its status changed in {{printf "%.0f" .FlapPercent}}% of the last {{len .History}} checks:
+  {{range .History}}{{.}} {{end}}
+
+Further status changes are not emailed until it is stable again.
+`,
+
+	TemplateStable: `Time: {{date .Time}}
+
+== {{.Result.Title}} - {{.Result.Endpoint}} stopped flapping and is {{.Status}}
+
+Its status changed in {{printf "%.0f" .FlapPercent}}% of the last {{len .History}} checks:
+  {{range .History}}{{.}} {{end}}
+
+{{.Result.String}}`,
+
+	TemplateReminder: `Time: {{date .Time}}
+
+== {{.Result.Title}} - {{.Result.Endpoint}} is still {{.Status}}
+
+    Outage started: {{date .OutageStart}}
+   Outage duration: {{.Duration}}
+       Failed runs: {{.FailedRuns}}
+
+{{.Result.String}}`,
+
+	TemplateEscalation: `Time: {{date .Time}}
+
+== {{.Result.Title}} - {{.Result.Endpoint}} is {{.Status}} and not acknowledged
+
+    Outage started: {{date .OutageStart}}
+   Outage duration: {{.Duration}}
+        Escalation: {{.EscalationPolicy}}, step {{.EscalationStep}} of {{.EscalationSteps}}
+
+Acknowledge it to stop the escalation:
+  upmail ack "{{.Result.Title}}"
+
+{{.Result.String}}`,
+
+	TemplateMaintenanceStarted: `Time: {{date .Time}}
+
+== Maintenance {{.Maintenance.Name}} started
+{{with .Maintenance.Comment}}
+{{.}}
+{{end}}
+  Start: {{date .Maintenance.Start}}
+    End: {{date .Maintenance.End}}
+
+No emails are sent about these checks until it ends:
+{{range .Maintenance.Checks}}  {{.Result.Title}} - {{.Result.Endpoint}} ({{.Status}})
+{{end}}`,
+
+	TemplateMaintenanceEnded: `Time: {{date .Time}}
+
+== Maintenance {{.Maintenance.Name}} ended
+{{with .Maintenance.Comment}}
+{{.}}
+{{end}}
+  Start: {{date .Maintenance.Start}}
+    End: {{date .Maintenance.End}}
+
+Emails are sent again about these checks:
+{{range .Maintenance.Checks}}  {{.Result.Title}} - {{.Result.Endpoint}} ({{.Status}})
+{{end}}`,
+}
+
+// htmlPartials are shared by every HTML template, including custom ones.
+const htmlPartials = `{{define "badge"}}<span style="display: inline-block; padding: 2px 8px; border-radius: 4px; font-size: 12px; font-weight: bold; text-transform: uppercase; color: #ffffff; background-color: {{statusColor .}};">{{.}}</span>{{end}}
+
+{{define "stats"}}<table cellpadding="4" cellspacing="0" style="border-collapse: collapse; margin: 0 0 16px;">
+  <tr><td style="color: #586069;">Threshold</td><td style="font-weight: bold; background-color: #fff5b1;">{{.Result.ThresholdRTT}}</td></tr>
+  <tr><td style="color: #586069;">Max</td><td>{{.Stats.Max}}</td></tr>
+  <tr><td style="color: #586069;">Min</td><td>{{.Stats.Min}}</td></tr>
+  <tr><td style="color: #586069;">Median</td><td>{{.Stats.Median}}</td></tr>
+  <tr><td style="color: #586069;">Mean</td><td>{{.Stats.Mean}}</td></tr>
+</table>{{end}}
+
+{{define "attempts"}}<table cellpadding="4" cellspacing="0" style="border-collapse: collapse; margin: 0 0 16px;">
+  <tr style="text-align: left; border-bottom: 1px solid #e1e4e8;"><th>#</th><th>RTT</th><th>Error</th></tr>
+  {{- $threshold := .Result.ThresholdRTT}}
+  {{- range $i, $a := .Attempts}}
+  <tr style="border-bottom: 1px solid #e1e4e8;">
+    <td>{{inc $i}}</td>
+    <td{{if and $threshold (gt $a.RTT $threshold)}} style="font-weight: bold; color: {{statusColor "degraded"}};"{{end}}>{{$a.RTT}}</td>
+    <td{{if $a.Error}} style="color: {{statusColor "down"}};"{{end}}>{{if $a.Error}}{{$a.Error}}{{else}}-{{end}}</td>
+  </tr>
+  {{- end}}
+</table>{{end}}
+
+{{define "maintenance"}}<table cellpadding="4" cellspacing="0" style="border-collapse: collapse; margin: 0 0 16px;">
+  <tr style="text-align: left; border-bottom: 1px solid #e1e4e8;"><th>Title</th><th>Endpoint</th><th>Status</th></tr>
+  {{- range .Maintenance.Checks}}
+  <tr style="border-bottom: 1px solid #e1e4e8;"><td>{{.Result.Title}}</td><td>{{.Result.Endpoint}}</td><td>{{template "badge" .Status}}</td></tr>
+  {{- end}}
+</table>{{end}}
+
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"></head>
+<body style="font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Helvetica, Arial, sans-serif; font-size: 14px; color: #24292e;">{{end}}
+
+{{define "footer"}}<p style="color: #586069; font-size: 12px;">Sent by upmail on {{.Hostname}} at {{date .Time}}.</p>
+</body>
+</html>{{end}}`
+
+var defaultHTMLTemplates = map[string]string{
+	TemplateAlert: `{{template "header" .}}
+<h2 style="margin: 0 0 4px;">{{.Result.Title}} {{template "badge" .Status}}</h2>
+<p style="margin: 0 0 16px; color: #586069;">{{.Result.Endpoint}}</p>
+{{if .Result.Notice}}<p>{{.Result.Notice}}</p>{{end}}
+{{template "stats" .}}
+{{template "attempts" .}}
+{{template "footer" .}}`,
+
+	TemplateRecovery: `{{template "header" .}}
+<h2 style="margin: 0 0 4px;">{{.Result.Title}} {{template "badge" .Status}}</h2>
+<p style="margin: 0 0 16px; color: #586069;">{{.Result.Endpoint}}</p>
+<p>The check was {{template "badge" .Previous}} for <b>{{.Duration}}</b> since {{date .OutageStart}}.</p>
+<h3>Final RTT stats</h3>
+{{template "stats" .}}
+{{template "footer" .}}`,
+
+	TemplateDigest: `{{template "header" .}}
+<h2 style="margin: 0 0 16px;">{{summary .}}</h2>
+{{if .Unhealthy}}<table cellpadding="4" cellspacing="0" style="border-collapse: collapse; margin: 0 0 16px;">
+  <tr style="text-align: left; border-bottom: 1px solid #e1e4e8;"><th>Title</th><th>Endpoint</th><th>Status</th><th>Median RTT</th><th>First error</th></tr>
+  {{- range .Unhealthy}}
+  <tr style="border-bottom: 1px solid #e1e4e8;"><td>{{.Result.Title}}</td><td>{{.Result.Endpoint}}</td><td>{{template "badge" .Status}}</td><td>{{.Stats.Median}}</td><td>{{if .FirstError}}{{.FirstError}}{{else}}-{{end}}</td></tr>
+  {{- end}}
+</table>{{end}}
+{{if .Resolved}}<h3>Resolved</h3>
+<ul>
+  {{- range .Resolved}}
+  <li>{{.Result.Title}} ({{.Result.Endpoint}}) was {{template "badge" .Previous}} for {{.Duration}}</li>
+  {{- end}}
+</ul>{{end}}
+{{range .Unhealthy}}<h3 style="margin: 16px 0 4px;">{{.Result.Title}} {{template "badge" .Status}}</h3>
+<p style="margin: 0 0 8px; color: #586069;">{{.Result.Endpoint}}</p>
+{{template "stats" .}}
+{{template "attempts" .}}
+{{end}}
+{{template "footer" .}}`,
+
+	TemplateFlapping: `{{template "header" .}}
+<h2 style="margin: 0 0 4px;">{{.Result.Title}} is flapping</h2>
+<p style="margin: 0 0 16px; color: #586069;">{{.Result.Endpoint}}</p>
+<p>Its status changed in <b>{{printf "%.0f" .FlapPercent}}%</b> of the last {{len .History}} checks:</p>
+<p>{{range .History}}{{template "badge" .}} {{end}}</p>
+<p>Further status changes are not emailed until it is stable again.</p>
+{{template "footer" .}}`,
+
+	TemplateStable: `{{template "header" .}}
+<h2 style="margin: 0 0 4px;">{{.Result.Title}} {{template "badge" .Status}}</h2>
+<p style="margin: 0 0 16px; color: #586069;">{{.Result.Endpoint}}</p>
+<p>The check stopped flapping. Its status changed in <b>{{printf "%.0f" .FlapPercent}}%</b> of the last {{len .History}} checks:</p>
+<p>{{range .History}}{{template "badge" .}} {{end}}</p>
+{{template "stats" .}}
+{{template "attempts" .}}
+{{template "footer" .}}`,
+
+	TemplateReminder: `{{template "header" .}}
+<h2 style="margin: 0 0 4px;">{{.Result.Title}} {{template "badge" .Status}}</h2>
+<p style="margin: 0 0 16px; color: #586069;">{{.Result.Endpoint}}</p>
+<p>The check is still {{template "badge" .Status}} after <b>{{.Duration}}</b> since {{date .OutageStart}}, with <b>{{.FailedRuns}}</b> failed runs so far.</p>
+{{if .Result.Notice}}<p>{{.Result.Notice}}</p>{{end}}
+{{template "stats" .}}
+{{template "attempts" .}}
+{{template "footer" .}}`,
+
+	TemplateEscalation: `{{template "header" .}}
+<h2 style="margin: 0 0 4px;">{{.Result.Title}} {{template "badge" .Status}}</h2>
+<p style="margin: 0 0 16px; color: #586069;">{{.Result.Endpoint}}</p>
+<p>The outage started {{date .OutageStart}} and has not been acknowledged after <b>{{.Duration}}</b>. This is step <b>{{.EscalationStep}}</b> of {{.EscalationSteps}} of the <b>{{.EscalationPolicy}}</b> escalation policy.</p>
+<p>Acknowledge it to stop the escalation: <code>upmail ack "{{.Result.Title}}"</code></p>
+{{if .Result.Notice}}<p>{{.Result.Notice}}</p>{{end}}
+{{template "stats" .}}
+{{template "attempts" .}}
+{{template "footer" .}}`,
+
+	TemplateMaintenanceStarted: `{{template "header" .}}
+<h2 style="margin: 0 0 4px;">Maintenance {{.Maintenance.Name}} started</h2>
+<p style="margin: 0 0 16px; color: #586069;">{{date .Maintenance.Start}} until {{date .Maintenance.End}}</p>
+{{with .Maintenance.Comment}}<p>{{.}}</p>{{end}}
+<p>No emails are sent about these checks until it ends:</p>
+{{template "maintenance" .}}
+{{template "footer" .}}`,
+
+	TemplateMaintenanceEnded: `{{template "header" .}}
+<h2 style="margin: 0 0 4px;">Maintenance {{.Maintenance.Name}} ended</h2>
+<p style="margin: 0 0 16px; color: #586069;">{{date .Maintenance.Start}} until {{date .Maintenance.End}}</p>
+{{with .Maintenance.Comment}}<p>{{.}}</p>{{end}}
+<p>Emails are sent again about these checks:</p>
+{{template "maintenance" .}}
+{{template "footer" .}}`,
+}
+
+// CheckData describes a single check in the template data.
+type CheckData struct {
+	// Result is the result of the check.
+	Result checkup.Result
+	// Stats are the RTT statistics of Result.
+	Stats checkup.Stats
+	// Attempts are the individual attempts of Result.
+	Attempts checkup.Attempts
+	// Status is the status of Result.
+	Status checkup.StatusText
+	// Previous is the last known status of the check before Result.
+	Previous checkup.StatusText
+	// OutageStart is when the current or just ended outage started.
+	OutageStart time.Time
+	// Duration is how long the outage has lasted so far.
+	Duration time.Duration
+	// FirstError is the error of the first failed attempt, if any.
+	FirstError string
+	// History holds the recent statuses of the check for flapping emails,
+	// oldest first.
+	History []checkup.StatusText
+	// FlapPercent is the weighted percentage of status changes in History.
+	FlapPercent float64
+	// FailedRuns is the number of unhealthy results since the outage
+	// started, for reminders.
+	FailedRuns int
+	// EscalationPolicy is the name of the escalation policy for escalation
+	// emails.
+	EscalationPolicy string
+	// EscalationStep is the number of the escalation step being notified,
+	// starting at 1.
+	EscalationStep int
+	// EscalationSteps is the number of steps of EscalationPolicy.
+	EscalationSteps int
+}
+
+// MaintenanceNotice describes a maintenance window in the template data.
+type MaintenanceNotice struct {
+	// Name is the name of the window.
+	Name string
+	// Comment says what the maintenance is about.
+	Comment string
+	// Start is when the window started.
+	Start time.Time
+	// End is when the window ends or ended.
+	End time.Time
+	// Checks are the checks the window applies to.
+	Checks []CheckData
+}
+
+// TemplateData is the data the email templates are executed with.
+type TemplateData struct {
+	// CheckData is the check the email is about. It is empty for digests.
+	CheckData
+	// Kind is the name of the template set being rendered.
+	Kind string
+	// Hostname is the name of the host upmail is running on.
+	Hostname string
+	// Time is when the email was generated.
+	Time time.Time
+	// Unhealthy holds every unhealthy check of the run for digests.
+	Unhealthy []CheckData
+	// Resolved holds the checks that recovered in the run for digests.
+	Resolved []CheckData
+	// Maintenance is the window of maintenance notices.
+	Maintenance MaintenanceNotice
+}
+
+// newCheckData builds the template data for a single check.
+func newCheckData(r checkup.Result, prev *CheckState, now time.Time) CheckData {
+	d := CheckData{
+		Result:     r,
+		Stats:      r.ComputeStats(),
+		Attempts:   r.Times,
+		Status:     r.Status(),
+		Previous:   checkup.Unknown,
+		FirstError: firstError(r),
+	}
+	if prev != nil {
+		if prev.Status != "" {
+			d.Previous = prev.Status
+		}
+		d.OutageStart = prev.OutageStart
+	}
+	if d.OutageStart.IsZero() && d.Status != checkup.Healthy {
+		d.OutageStart = now
+	}
+	if !d.OutageStart.IsZero() {
+		d.Duration = now.Sub(d.OutageStart).Round(time.Second)
+	}
+	return d
+}
+
+// newTemplateData builds the template data for an email of the given kind.
+func newTemplateData(kind string, now time.Time) TemplateData {
+	hostname, _ := os.Hostname()
+	return TemplateData{
+		Kind:     kind,
+		Hostname: hostname,
+		Time:     now,
+	}
+}
+
+// metadata returns the tags and variables of the message rendered from d.
+// Single check messages are tagged with their kind, check and status.
+func (d TemplateData) metadata() ([]string, map[string]string) {
+	vars := map[string]string{
+		"kind":     d.Kind,
+		"hostname": d.Hostname,
+		"time":     d.Time.Format(time.RFC3339),
+	}
+
+	if d.Kind == TemplateDigest {
+		vars["unhealthy"] = strconv.Itoa(len(d.Unhealthy))
+		vars["resolved"] = strconv.Itoa(len(d.Resolved))
+		return []string{d.Kind}, vars
+	}
+	if d.Kind == TemplateMaintenanceStarted || d.Kind == TemplateMaintenanceEnded {
+		vars["maintenance"] = d.Maintenance.Name
+		vars["maintenance_start"] = d.Maintenance.Start.Format(time.RFC3339)
+		vars["maintenance_end"] = d.Maintenance.End.Format(time.RFC3339)
+		vars["checks"] = strconv.Itoa(len(d.Maintenance.Checks))
+		return []string{d.Kind}, vars
+	}
+
+	vars["title"] = d.Result.Title
+	vars["endpoint"] = d.Result.Endpoint
+	vars["status"] = string(d.Status)
+	vars["previous"] = string(d.Previous)
+	vars["first_error"] = d.FirstError
+	vars["rtt_min"] = d.Stats.Min.String()
+	vars["rtt_median"] = d.Stats.Median.String()
+	vars["rtt_mean"] = d.Stats.Mean.String()
+	vars["rtt_max"] = d.Stats.Max.String()
+	vars["threshold_rtt"] = d.Result.ThresholdRTT.String()
+	if !d.OutageStart.IsZero() {
+		vars["outage_start"] = d.OutageStart.Format(time.RFC3339)
+		vars["duration"] = d.Duration.String()
+	}
+	if d.FailedRuns > 0 {
+		vars["failed_runs"] = strconv.Itoa(d.FailedRuns)
+	}
+	if len(d.History) > 0 {
+		vars["flap_percent"] = strconv.FormatFloat(d.FlapPercent, 'f', 0, 64)
+	}
+	if d.EscalationPolicy != "" {
+		vars["escalation_policy"] = d.EscalationPolicy
+		vars["escalation_step"] = strconv.Itoa(d.EscalationStep)
+	}
+
+	return []string{d.Kind, "check:" + d.Result.Title, "status:" + string(d.Status)}, vars
+}
+
+var templateFuncs = map[string]interface{}{
+	"date": func(t time.Time) string {
+		return t.Format(time.UnixDate)
+	},
+	"inc": func(i int) int {
+		return i + 1
+	},
+	"statusColor": statusColor,
+	"summary":     digestSummary,
+	"table":       statusTable,
+}
+
+// statusColors are the colors used for the status badges.
+var statusColors = map[checkup.StatusText]string{
+	checkup.Healthy:  "#28a745",
+	checkup.Degraded: "#dbab09",
+	checkup.Down:     "#d73a49",
+	checkup.Unknown:  "#6a737d",
+}
+
+// statusColor returns the badge color for a status.
+func statusColor(status checkup.StatusText) string {
+	if c, ok := statusColors[status]; ok {
+		return c
+	}
+	return statusColors[checkup.Unknown]
+}
+
+// ansiEscapes matches the terminal color codes checkup.Result.String adds to
+// the status line.
+var ansiEscapes = regexp.MustCompile("\x1b\\[[0-9;]*m")
+
+// templateSet holds the parsed templates for one kind of email.
+type templateSet struct {
+	subject *template.Template
+	text    *template.Template
+	html    *htmltemplate.Template
+}
+
+// Templates holds the templates used to render every kind of email.
+type Templates struct {
+	sets map[string]*templateSet
+}
+
+// DefaultTemplates returns the embedded default templates.
+func DefaultTemplates() *Templates {
+	t, err := LoadTemplates("")
+	if err != nil {
+		// The embedded templates are known to parse.
+		panic(err)
+	}
+	return t
+}
+
+// LoadTemplates parses the templates found in dir, falling back to the
+// embedded defaults for every file that does not exist. An empty dir only
+// loads the defaults.
+func LoadTemplates(dir string) (*Templates, error) {
+	t := &Templates{sets: map[string]*templateSet{}}
+
+	for _, name := range templateNames {
+		set := &templateSet{}
+
+		subject, err := readTemplate(dir, name+".subject.tmpl", defaultSubjectTemplates[name])
+		if err != nil {
+			return nil, err
+		}
+		if set.subject, err = template.New(name + ".subject").Funcs(templateFuncs).Parse(subject); err != nil {
+			return nil, fmt.Errorf("parsing %s subject template failed: %v", name, err)
+		}
+
+		text, err := readTemplate(dir, name+".txt.tmpl", defaultTextTemplates[name])
+		if err != nil {
+			return nil, err
+		}
+		if set.text, err = template.New(name + ".txt").Funcs(templateFuncs).Parse(text); err != nil {
+			return nil, fmt.Errorf("parsing %s text template failed: %v", name, err)
+		}
+
+		html, err := readTemplate(dir, name+".html.tmpl", defaultHTMLTemplates[name])
+		if err != nil {
+			return nil, err
+		}
+		if set.html, err = htmltemplate.New(name + ".html").Funcs(templateFuncs).Parse(htmlPartials); err != nil {
+			return nil, fmt.Errorf("parsing HTML partials failed: %v", err)
+		}
+		if set.html, err = set.html.Parse(html); err != nil {
+			return nil, fmt.Errorf("parsing %s HTML template failed: %v", name, err)
+		}
+
+		t.sets[name] = set
+
+		// Render the templates once, so that templates that only fail
+		// when they are executed, for example because they refer to a
+		// field that does not exist, are reported right away rather than
+		// when an email is due.
+		if _, err := t.render(sampleData(name)); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// sampleData returns template data of the given kind with every field set.
+func sampleData(kind string) TemplateData {
+	now := time.Now()
+	r := checkup.Result{
+		Title:        "example",
+		Endpoint:     "https://example.com",
+		Timestamp:    now.UnixNano(),
+		ThresholdRTT: time.Second,
+		Times:        checkup.Attempts{{RTT: 2 * time.Second, Error: "timeout"}, {RTT: 500 * time.Millisecond}},
+		Down:         true,
+		Notice:       "example notice",
+	}
+	prev := &CheckState{Status: checkup.Degraded, OutageStart: now.Add(-time.Hour)}
+
+	data := newTemplateData(kind, now)
+	data.CheckData = newCheckData(r, prev, now)
+	data.History = []checkup.StatusText{checkup.Healthy, checkup.Down}
+	data.FlapPercent = 50
+	data.FailedRuns = 3
+	data.EscalationPolicy = "example"
+	data.EscalationStep = 1
+	data.EscalationSteps = 2
+
+	recovered := r
+	recovered.Down = false
+	recovered.Healthy = true
+	data.Unhealthy = []CheckData{data.CheckData}
+	data.Resolved = []CheckData{newCheckData(recovered, prev, now)}
+	data.Maintenance = MaintenanceNotice{
+		Name:    "example",
+		Comment: "example comment",
+		Start:   now,
+		End:     now.Add(time.Hour),
+		Checks:  []CheckData{data.CheckData},
+	}
+	return data
+}
+
+// readTemplate returns the contents of file in dir or def if it does not
+// exist.
+func readTemplate(dir, file, def string) (string, error) {
+	if dir == "" {
+		return def, nil
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, file))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return def, nil
+		}
+		return "", fmt.Errorf("reading template failed: %v", err)
+	}
+
+	return string(b), nil
+}
+
+// content is a rendered email.
+type content struct {
+	subject string
+	text    string
+	html    string
+}
+
+// render executes the templates for data.Kind.
+func (t *Templates) render(data TemplateData) (content, error) {
+	var c content
+
+	set, ok := t.sets[data.Kind]
+	if !ok {
+		return c, fmt.Errorf("no templates for %q emails", data.Kind)
+	}
+
+	var b bytes.Buffer
+	if err := set.subject.Execute(&b, data); err != nil {
+		return c, fmt.Errorf("executing %s subject template failed: %v", data.Kind, err)
+	}
+	// Subjects are a single line, no matter how the template was written.
+	c.subject = strings.Join(strings.Fields(stripANSI(b.String())), " ")
+
+	b.Reset()
+	if err := set.text.Execute(&b, data); err != nil {
+		return c, fmt.Errorf("executing %s text template failed: %v", data.Kind, err)
+	}
+	c.text = stripANSI(b.String())
+
+	b.Reset()
+	if err := set.html.Execute(&b, data); err != nil {
+		return c, fmt.Errorf("executing %s HTML template failed: %v", data.Kind, err)
+	}
+	c.html = stripANSI(b.String())
+
+	return c, nil
+}
+
+// digestSummary counts the checks per status in a digest.
+func digestSummary(data TemplateData) string {
+	counts := map[checkup.StatusText]int{}
+	for _, d := range data.Unhealthy {
+		counts[d.Status]++
+	}
+
+	var parts []string
+	for _, status := range []checkup.StatusText{checkup.Down, checkup.Degraded, checkup.Unknown} {
+		if counts[status] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[status], status))
+		}
+	}
+	if len(data.Resolved) > 0 {
+		parts = append(parts, fmt.Sprintf("%d resolved", len(data.Resolved)))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// statusTable renders an aligned summary table of checks.
+func statusTable(checks []CheckData) string {
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TITLE\tENDPOINT\tSTATUS\tMEDIAN RTT\tFIRST ERROR")
+	for _, d := range checks {
+		firstErr := d.FirstError
+		if firstErr == "" {
+			firstErr = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.Result.Title, d.Result.Endpoint, d.Status, d.Stats.Median, firstErr)
+	}
+	w.Flush()
+	return b.String()
+}
+
+// stripANSI removes terminal color codes from s.
+func stripANSI(s string) string {
+	return ansiEscapes.ReplaceAllString(s, "")
+}
+
+// firstError returns the error of the first failed attempt of r.
+func firstError(r checkup.Result) string {
+	for _, a := range r.Times {
+		if a.Error != "" {
+			return a.Error
+		}
+	}
+	return ""
+}
@@ -0,0 +1,362 @@
+package email
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/sourcegraph/checkup"
+)
+
+// crlf turns the line endings of a message back into the ones of the
+// templates.
+var crlf = strings.NewReplacer("\r\n", "\n")
+
+// mimeContent returns the decoded subject, text and HTML of a raw message.
+func mimeContent(t *testing.T, raw []byte) (subject, text, html string) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("parsing message: %v\n%s", err, raw)
+	}
+	subject, err = new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		t.Fatalf("decoding subject: %v", err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("parsing Content-Type: %v", err)
+	}
+	if mediaType == "text/plain" {
+		b, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+		if err != nil {
+			t.Fatalf("decoding body: %v", err)
+		}
+		return subject, crlf.Replace(string(b)), ""
+	}
+
+	r := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := r.NextPart()
+		if err != nil {
+			break
+		}
+		// The quoted-printable encoding is removed by NextPart.
+		b, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatalf("reading part: %v", err)
+		}
+		switch {
+		case strings.HasPrefix(part.Header.Get("Content-Type"), "text/plain"):
+			text = crlf.Replace(string(b))
+		case strings.HasPrefix(part.Header.Get("Content-Type"), "text/html"):
+			html = crlf.Replace(string(b))
+		}
+	}
+	return subject, text, html
+}
+
+// writeTemplates writes the given template files to a temporary directory.
+func writeTemplates(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "upmail-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0600); err != nil {
+			os.RemoveAll(dir)
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadTemplatesFallback(t *testing.T) {
+	dir := writeTemplates(t, map[string]string{
+		"alert.subject.tmpl": `ALERT {{.Result.Title}}`,
+		"recovery.txt.tmpl":  `{{.Result.Title}} is back after {{.Duration}}`,
+		"digest.html.tmpl":   `<p>{{summary .}}</p>`,
+	})
+	defer os.RemoveAll(dir)
+
+	custom, err := LoadTemplates(dir)
+	if err != nil {
+		t.Fatalf("LoadTemplates: %v", err)
+	}
+	defaults := DefaultTemplates()
+
+	tests := []struct {
+		kind string
+		// custom lists the parts rendered from the custom templates, the
+		// others must match the defaults.
+		subject, text, html bool
+	}{
+		{kind: TemplateAlert, subject: true},
+		{kind: TemplateRecovery, text: true},
+		{kind: TemplateDigest, html: true},
+		{kind: TemplateFlapping},
+		{kind: TemplateReminder},
+		{kind: TemplateMaintenanceStarted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.kind, func(t *testing.T) {
+			data := sampleData(tt.kind)
+			got, err := custom.render(data)
+			if err != nil {
+				t.Fatalf("render: %v", err)
+			}
+			def, err := defaults.render(data)
+			if err != nil {
+				t.Fatalf("render: %v", err)
+			}
+
+			parts := []struct {
+				name      string
+				custom    bool
+				got, def  string
+				wantWhole string
+			}{
+				{"subject", tt.subject, got.subject, def.subject, "ALERT example"},
+				{"text", tt.text, got.text, def.text, "example is back after 1h0m0s"},
+				{"HTML", tt.html, got.html, def.html, "<p>1 down, 1 resolved</p>"},
+			}
+			for _, p := range parts {
+				if p.custom && p.got != p.wantWhole {
+					t.Errorf("custom %s is %q, want %q", p.name, p.got, p.wantWhole)
+				}
+				if !p.custom && p.got != p.def {
+					t.Errorf("%s is\n%s\nwant the default\n%s", p.name, p.got, p.def)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadTemplatesBroken(t *testing.T) {
+	tests := []struct {
+		name      string
+		files     map[string]string
+		wantError string
+	}{
+		{
+			name:      "subject does not parse",
+			files:     map[string]string{"alert.subject.tmpl": `{{.Result.Title`},
+			wantError: "parsing alert subject template failed",
+		},
+		{
+			name:      "text does not parse",
+			files:     map[string]string{"recovery.txt.tmpl": `{{if .Result.Title}}`},
+			wantError: "parsing recovery text template failed",
+		},
+		{
+			name:      "HTML does not parse",
+			files:     map[string]string{"digest.html.tmpl": `{{template "missing" .}`},
+			wantError: "parsing digest HTML template failed",
+		},
+		{
+			name:      "unknown function",
+			files:     map[string]string{"reminder.txt.tmpl": `{{shout .Result.Title}}`},
+			wantError: "parsing reminder text template failed",
+		},
+		{
+			name:      "unknown field",
+			files:     map[string]string{"alert.txt.tmpl": `{{.Result.Nope}}`},
+			wantError: "executing alert text template failed",
+		},
+		{
+			name:      "unknown partial",
+			files:     map[string]string{"stable.html.tmpl": `{{template "missing" .}}`},
+			wantError: "executing stable HTML template failed",
+		},
+		{
+			name:      "wrong argument",
+			files:     map[string]string{"escalation.subject.tmpl": `{{date .Result.Title}}`},
+			wantError: "executing escalation subject template failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeTemplates(t, tt.files)
+			defer os.RemoveAll(dir)
+
+			_, err := LoadTemplates(dir)
+			if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+				t.Fatalf("LoadTemplates returned %v, want an error containing %q", err, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestLoadTemplatesUnreadable(t *testing.T) {
+	dir := writeTemplates(t, nil)
+	defer os.RemoveAll(dir)
+	if err := os.Mkdir(filepath.Join(dir, "alert.txt.tmpl"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadTemplates(dir); err == nil || !strings.Contains(err.Error(), "reading template failed") {
+		t.Fatalf("LoadTemplates returned %v, want a read error", err)
+	}
+}
+
+// teeTransport sends every message with all of its transports.
+type teeTransport []Transport
+
+func (t teeTransport) Name() string { return "tee" }
+
+func (t teeTransport) Send(m *Message) error {
+	for _, tr := range t {
+		if err := tr.Send(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestTransportsSendSameContent(t *testing.T) {
+	mg, requests := newMailgunServer()
+	defer mg.Close()
+
+	dir, err := ioutil.TempDir("", "upmail-smtp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	smtpSrv := newSMTPServer(t, newTestCert(t, dir, "server"), nil)
+	defer smtpSrv.close()
+
+	templates := writeTemplates(t, map[string]string{
+		"alert.subject.tmpl": `{{.Result.Title}} is {{.Status}} – ünïcode`,
+		"alert.txt.tmpl":     `{{.Result.Title}} failed: {{.FirstError}}`,
+		"alert.html.tmpl":    `<p>{{.Result.Title}} failed: <b>{{.FirstError}}</b></p>`,
+	})
+	defer os.RemoveAll(templates)
+	tmpl, err := LoadTemplates(templates)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := &Notifier{
+		Transports: []Transport{teeTransport{
+			MailgunTransport{Domain: "mg.example.com", APIKey: "key-secret", APIBase: mg.URL + "/v3"},
+			SMTPTransport{Server: smtpSrv.addr(), TLS: TLSNone},
+		}},
+		Sender:    "upmail@example.com",
+		Routing:   Routing{Default: []string{"ops@example.com"}},
+		Templates: tmpl,
+	}
+	r := testResult("api", "down")
+	r.Times[0].Error = "connection refused <&>"
+	if err := n.Notify([]checkup.Result{r}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+
+	reqs := requests()
+	if len(reqs) != 1 {
+		t.Fatalf("Mailgun got %d requests, want 1", len(reqs))
+	}
+	mgSubject, mgText, mgHTML := mimeContent(t, []byte(reqs[0].mime))
+	session := smtpSrv.received(t, 1)[0]
+	smtpSubject, smtpText, smtpHTML := mimeContent(t, []byte(session.data))
+
+	want := []string{
+		"api is down – ünïcode",
+		"api failed: connection refused <&>",
+		"<p>api failed: <b>connection refused &lt;&amp;&gt;</b></p>",
+	}
+	for i, got := range [][]string{{mgSubject, mgText, mgHTML}, {smtpSubject, smtpText, smtpHTML}} {
+		transport := []string{"Mailgun", "SMTP"}[i]
+		for j := range want {
+			if got[j] != want[j] {
+				t.Errorf("%s sent %q, want %q", transport, got[j], want[j])
+			}
+		}
+	}
+}
+
+func TestMultipartContent(t *testing.T) {
+	// Force the terminal colors checkup adds to the status line, which
+	// are disabled when stdout is not a terminal.
+	noColor := color.NoColor
+	color.NoColor = false
+	defer func() { color.NoColor = noColor }()
+
+	r := testResult("api", "degraded")
+	r.ThresholdRTT = 100 * time.Millisecond
+	r.Times = checkup.Attempts{
+		{RTT: 50 * time.Millisecond},
+		{RTT: 150 * time.Millisecond, Error: "read: connection reset <by peer>"},
+		{RTT: 120 * time.Millisecond},
+	}
+	if !strings.Contains(r.String(), "\x1b[") {
+		t.Fatal("checkup did not add terminal colors, the test does not cover stripping them")
+	}
+
+	tr := &fakeTransport{}
+	n := &Notifier{
+		Transports: []Transport{tr},
+		Sender:     "upmail@example.com",
+		Routing:    Routing{Default: []string{"ops@example.com"}},
+	}
+	if err := n.Notify([]checkup.Result{r}); err != nil {
+		t.Fatalf("Notify: %v", err)
+	}
+	msgs := tr.messages()
+	if len(msgs) != 1 {
+		t.Fatalf("sent %q, want one alert", tr.subjects())
+	}
+	raw, err := msgs[0].Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, text, html := mimeContent(t, raw)
+
+	if subject != "[UPMAIL]: api degraded" {
+		t.Errorf("subject is %q", subject)
+	}
+
+	if strings.Contains(text, "\x1b") {
+		t.Errorf("text contains terminal escapes:\n%q", text)
+	}
+	for _, want := range []string{
+		"== api - https://api.example.com\n",
+		"  Threshold: 100ms\n",
+		"        Max: 150ms\n",
+		" Assessment: degraded\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("text does not contain %q:\n%s", want, text)
+		}
+	}
+
+	if strings.Contains(html, "\x1b") {
+		t.Errorf("HTML contains terminal escapes:\n%q", html)
+	}
+	for _, want := range []string{
+		// The badge has the color of the status.
+		`background-color: #dbab09;">degraded</span>`,
+		// The threshold is highlighted in the stats.
+		`<td style="font-weight: bold; background-color: #fff5b1;">100ms</td>`,
+		// One row per attempt, RTTs above the threshold are highlighted
+		// and errors are escaped and colored.
+		"<td>1</td>\n    <td>50ms</td>\n    <td>-</td>",
+		"<td>2</td>\n    <td style=\"font-weight: bold; color: #dbab09;\">150ms</td>\n    <td style=\"color: #d73a49;\">read: connection reset &lt;by peer&gt;</td>",
+		"<td>3</td>\n    <td style=\"font-weight: bold; color: #dbab09;\">120ms</td>\n    <td>-</td>",
+	} {
+		if !strings.Contains(html, want) {
+			t.Errorf("HTML does not contain %q:\n%s", want, html)
+		}
+	}
+	if n := strings.Count(html, "<td>4</td>"); n != 0 {
+		t.Errorf("HTML has more rows than attempts:\n%s", html)
+	}
+}
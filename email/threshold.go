@@ -0,0 +1,50 @@
+package email
+
+import "github.com/sourcegraph/checkup"
+
+// Threshold overrides the number of consecutive results needed before a
+// status change of the checks it matches is notified. Conditions that are
+// left empty match every check.
+type Threshold struct {
+	// Title matches the title of the check.
+	Title Pattern `json:"title,omitempty"`
+	// Endpoint matches the endpoint of the check.
+	Endpoint Pattern `json:"endpoint,omitempty"`
+	// AlertAfter is the number of consecutive unhealthy results before an
+	// alert is sent. Zero means the global setting.
+	AlertAfter int `json:"alert_after,omitempty"`
+	// RecoverAfter is the number of consecutive healthy results before a
+	// recovery is sent. Zero means the global setting.
+	RecoverAfter int `json:"recover_after,omitempty"`
+}
+
+// Match reports whether the threshold applies to r.
+func (t Threshold) Match(r checkup.Result) bool {
+	return t.Title.Match(r.Title) && t.Endpoint.Match(r.Endpoint)
+}
+
+// thresholds returns how many consecutive unhealthy and healthy results are
+// needed before r alerts or recovers. The first matching threshold wins over
+// the global settings of the notifier.
+func (n *Notifier) thresholds(r checkup.Result) (alertAfter, recoverAfter int) {
+	alertAfter, recoverAfter = n.AlertAfter, n.RecoverAfter
+	for _, t := range n.Thresholds {
+		if !t.Match(r) {
+			continue
+		}
+		if t.AlertAfter > 0 {
+			alertAfter = t.AlertAfter
+		}
+		if t.RecoverAfter > 0 {
+			recoverAfter = t.RecoverAfter
+		}
+		break
+	}
+	if alertAfter < 1 {
+		alertAfter = 1
+	}
+	if recoverAfter < 1 {
+		recoverAfter = 1
+	}
+	return alertAfter, recoverAfter
+}
@@ -0,0 +1,146 @@
+package email
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sourcegraph/checkup"
+)
+
+// testResult returns a result of the check title with the given status:
+// "up", "down" or "degraded", and a single attempt like checkup records.
+func testResult(title, status string) checkup.Result {
+	r := checkup.Result{
+		Title:    title,
+		Endpoint: "https://" + title + ".example.com",
+		Times:    checkup.Attempts{{RTT: 20 * time.Millisecond}},
+	}
+	switch status {
+	case "up":
+		r.Healthy = true
+	case "down":
+		r.Down = true
+	case "degraded":
+		r.Degraded = true
+	}
+	return r
+}
+
+func TestEvaluateThresholds(t *testing.T) {
+	api, err := ParsePattern("api*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := map[kind]string{kindAlert: "alert", kindRecovery: "recovery"}
+
+	tests := []struct {
+		name   string
+		title  string
+		global [2]int
+		runs   []string
+		want   []string
+	}{
+		{
+			name:  "global default notifies every change",
+			title: "web",
+			runs:  []string{"up", "down", "down", "up"},
+			want:  []string{"", "alert", "", "recovery"},
+		},
+		{
+			name:  "new healthy check is not notified",
+			title: "web",
+			runs:  []string{"up", "up"},
+			want:  []string{"", ""},
+		},
+		{
+			name:  "threshold delays alert and recovery",
+			title: "api",
+			runs:  []string{"up", "down", "down", "down", "up", "up", "up", "up"},
+			want:  []string{"", "", "alert", "", "", "", "recovery", ""},
+		},
+		{
+			name:  "interrupted failures do not alert",
+			title: "api",
+			runs:  []string{"down", "up", "down", "up", "down"},
+			want:  []string{"", "", "", "", ""},
+		},
+		{
+			name:  "interrupted recovery does not recover",
+			title: "api",
+			runs:  []string{"down", "down", "up", "up", "down", "up", "up", "up"},
+			want:  []string{"", "alert", "", "", "", "", "", "recovery"},
+		},
+		{
+			name:  "unhealthy status change alerts again",
+			title: "api",
+			runs:  []string{"down", "down", "degraded", "down"},
+			want:  []string{"", "alert", "alert", "alert"},
+		},
+		{
+			name:   "global settings apply without a matching threshold",
+			title:  "web",
+			global: [2]int{3, 2},
+			runs:   []string{"down", "down", "down", "up", "up"},
+			want:   []string{"", "", "alert", "", "recovery"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := &Notifier{
+				AlertAfter:   tt.global[0],
+				RecoverAfter: tt.global[1],
+				Thresholds:   []Threshold{{Title: api, AlertAfter: 2, RecoverAfter: 3}},
+				state:        &State{Checks: map[string]*CheckState{}},
+			}
+
+			now := time.Date(2026, 10, 17, 12, 0, 0, 0, time.UTC)
+			var got []string
+			for _, status := range tt.runs {
+				pending := n.evaluate([]checkup.Result{testResult(tt.title, status)}, now)
+				if len(pending) > 1 {
+					t.Fatalf("got %d notifications for one result", len(pending))
+				}
+				notified := ""
+				for _, p := range pending {
+					notified = kinds[p.kind]
+					// Like Notify after the email went out.
+					n.state.Checks[p.key] = p.next
+				}
+				got = append(got, notified)
+				now = now.Add(time.Minute)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("notified %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThresholdsFirstMatchWins(t *testing.T) {
+	api, _ := ParsePattern("api*")
+	apiV2, _ := ParsePattern("api-v2")
+	n := &Notifier{
+		AlertAfter:   2,
+		RecoverAfter: 0,
+		Thresholds: []Threshold{
+			{Title: api, AlertAfter: 5},
+			{Title: apiV2, AlertAfter: 1, RecoverAfter: 4},
+		},
+	}
+
+	tests := []struct {
+		title                    string
+		alertAfter, recoverAfter int
+	}{
+		{"web", 2, 1},
+		{"api", 5, 1},
+		{"api-v2", 5, 1},
+	}
+	for _, tt := range tests {
+		alertAfter, recoverAfter := n.thresholds(testResult(tt.title, "down"))
+		if alertAfter != tt.alertAfter || recoverAfter != tt.recoverAfter {
+			t.Errorf("%s: thresholds are %d/%d, want %d/%d", tt.title, alertAfter, recoverAfter, tt.alertAfter, tt.recoverAfter)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package email
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Transport delivers messages.
+type Transport interface {
+	// Name identifies the transport in logs and message headers.
+	Name() string
+	// Send delivers m to its recipients.
+	Send(m *Message) error
+}
+
+// TransportHeader is the header field that records which transport
+// delivered a message.
+const TransportHeader = "X-Upmail-Transport"
+
+// Chain is a Transport that tries its transports in order until one of them
+// delivers the message.
+type Chain []Transport
+
+// Name returns the names of the transports in the chain.
+func (c Chain) Name() string {
+	names := make([]string, len(c))
+	for i, t := range c {
+		names[i] = t.Name()
+	}
+	return strings.Join(names, ",")
+}
+
+// Send delivers m with the first transport that succeeds. The error lists
+// the failures of all transports if none succeeds.
+func (c Chain) Send(m *Message) error {
+	if len(c) == 0 {
+		return errors.New("no transport configured")
+	}
+
+	var errs []string
+	for i, t := range c {
+		m.SetHeader(TransportHeader, t.Name())
+		err := t.Send(m)
+		if err == nil {
+			if i > 0 {
+				logrus.Warnf("delivered %q via fallback transport %s", m.Subject, t.Name())
+			} else {
+				logrus.Infof("delivered %q via %s", m.Subject, t.Name())
+			}
+			return nil
+		}
+		if i < len(c)-1 {
+			logrus.Warnf("sending %q via %s failed, trying %s: %v", m.Subject, t.Name(), c[i+1].Name(), err)
+		}
+		errs = append(errs, fmt.Sprintf("%s: %v", t.Name(), err))
+	}
+
+	return errors.New(strings.Join(errs, "; "))
+}
@@ -0,0 +1,195 @@
+package email
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// vtimezone is a VTIMEZONE definition. It is used for TZIDs that are not
+// IANA time zones, such as the Windows names of Outlook and Exchange.
+type vtimezone struct {
+	tzid        string
+	observances []*observance
+}
+
+// observance is a STANDARD or DAYLIGHT sub-component of a VTIMEZONE.
+type observance struct {
+	daylight bool
+	// start is the DTSTART of the observance, a local time such as
+	// 19701025T030000 in the offset that applied before it.
+	start    string
+	offsetTo string
+	name     string
+	rule     string
+}
+
+// location returns the time zone defined by z. The latest STANDARD and
+// DAYLIGHT observances with a yearly rule become the daylight saving time
+// transitions of the zone. Without them the zone has the fixed offset of its
+// latest STANDARD observance.
+func (z *vtimezone) location() (*time.Location, error) {
+	var std, dst *observance
+	for _, o := range z.observances {
+		latest := &std
+		if o.daylight {
+			latest = &dst
+		}
+		if *latest == nil || o.start > (*latest).start {
+			*latest = o
+		}
+	}
+	if std == nil {
+		std, dst = dst, nil
+	}
+	if std == nil {
+		return nil, fmt.Errorf("time zone %q has no STANDARD or DAYLIGHT", z.tzid)
+	}
+
+	stdOffset, err := parseUTCOffset(std.offsetTo)
+	if err != nil {
+		return nil, fmt.Errorf("time zone %q: %v", z.tzid, err)
+	}
+	if dst == nil {
+		return time.FixedZone(z.tzid, stdOffset), nil
+	}
+	dstOffset, err := parseUTCOffset(dst.offsetTo)
+	if err != nil {
+		return nil, fmt.Errorf("time zone %q: %v", z.tzid, err)
+	}
+	dstStart, err := dst.posixRule()
+	if err != nil {
+		return time.FixedZone(z.tzid, stdOffset), nil
+	}
+	dstEnd, err := std.posixRule()
+	if err != nil {
+		return time.FixedZone(z.tzid, stdOffset), nil
+	}
+
+	// The transitions are described by a POSIX TZ string, which is how
+	// TZif files continue their rules into the future.
+	stdName := posixZoneName(std)
+	tz := fmt.Sprintf("%s%s%s%s,%s,%s", stdName, posixOffset(stdOffset), posixZoneName(dst), posixOffset(dstOffset), dstStart, dstEnd)
+	return time.LoadLocationFromTZData(z.tzid, tzif(stdName, stdOffset, tz))
+}
+
+// posixRule returns the transition of a yearly rule as a POSIX TZ rule such
+// as M10.5.0/3:00:00, the last Sunday of October at 3:00. Rules that have
+// ended or cannot be expressed as a POSIX rule are errors.
+func (o *observance) posixRule() (string, error) {
+	start, err := time.Parse("20060102T150405", o.start)
+	if err != nil {
+		return "", fmt.Errorf("invalid DTSTART %q", o.start)
+	}
+
+	var (
+		freq, byDay string
+		month       int
+		monthDay    int
+	)
+	for _, part := range strings.Split(o.rule, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return "", fmt.Errorf("invalid rule part %q", part)
+		}
+		value := strings.ToUpper(kv[1])
+		switch strings.ToUpper(kv[0]) {
+		case "FREQ":
+			freq = value
+		case "BYMONTH":
+			month, err = strconv.Atoi(value)
+		case "BYDAY":
+			byDay = value
+		case "BYMONTHDAY":
+			// Old definitions name the week with the days it spans, as
+			// in BYMONTHDAY=8,9,10,11,12,13,14;BYDAY=SU.
+			monthDay, err = strconv.Atoi(strings.Split(value, ",")[0])
+		case "UNTIL":
+			return "", fmt.Errorf("rule %q has ended", o.rule)
+		}
+		if err != nil {
+			return "", fmt.Errorf("invalid rule %q", o.rule)
+		}
+	}
+	if freq != "YEARLY" || month < 1 || month > 12 || len(byDay) < 2 {
+		return "", fmt.Errorf("unsupported rule %q", o.rule)
+	}
+
+	day, ok := icsWeekdays[byDay[len(byDay)-2:]]
+	if !ok {
+		return "", fmt.Errorf("unsupported rule %q", o.rule)
+	}
+	week := 0
+	if num := byDay[:len(byDay)-2]; num != "" {
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return "", fmt.Errorf("invalid rule %q", o.rule)
+		}
+		week = n
+	} else if monthDay > 0 && (monthDay-1)%7 == 0 {
+		week = (monthDay-1)/7 + 1
+	}
+	switch {
+	case week == -1:
+		week = 5
+	case week < 1 || week > 4:
+		return "", fmt.Errorf("unsupported rule %q", o.rule)
+	}
+
+	hh, mm, ss := start.Clock()
+	return fmt.Sprintf("M%d.%d.%d/%d:%02d:%02d", month, week, day, hh, mm, ss), nil
+}
+
+// posixZoneName returns the abbreviation of an observance for a POSIX TZ
+// string: its TZNAME if it is one, otherwise its offset, as in <+0100>.
+func posixZoneName(o *observance) string {
+	name := o.name
+	if len(name) < 3 {
+		return "<" + o.offsetTo + ">"
+	}
+	for _, c := range name {
+		if (c < 'A' || c > 'Z') && (c < 'a' || c > 'z') {
+			return "<" + o.offsetTo + ">"
+		}
+	}
+	return name
+}
+
+// posixOffset formats an offset east of UTC in seconds as a POSIX TZ
+// offset, which counts west of UTC.
+func posixOffset(offset int) string {
+	sign := "-"
+	if offset <= 0 {
+		sign = ""
+		offset = -offset
+	}
+	return fmt.Sprintf("%s%d:%02d:%02d", sign, offset/3600, offset/60%60, offset%60)
+}
+
+// tzif returns the TZif data of a time zone without transitions of its own
+// that follows the POSIX TZ string tz, starting out in the zone name with
+// the given offset.
+func tzif(name string, offset int, tz string) []byte {
+	abbrev := strings.Trim(name, "<>") + "\x00"
+
+	var b bytes.Buffer
+	// The version 1 data is followed by the version 2 data, which is the
+	// same here, and the TZ string.
+	for i := 0; i < 2; i++ {
+		b.WriteString("TZif2")
+		b.Write(make([]byte, 15))
+		// The UTC/local and standard/wall indicators, leap seconds,
+		// transitions, local time types and abbreviation characters.
+		for _, n := range []int{0, 0, 0, 0, 1, len(abbrev)} {
+			binary.Write(&b, binary.BigEndian, uint32(n))
+		}
+		binary.Write(&b, binary.BigEndian, int32(offset))
+		b.Write([]byte{0, 0})
+		b.WriteString(abbrev)
+	}
+	b.WriteString("\n" + tz + "\n")
+	return b.Bytes()
+}
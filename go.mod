@@ -1,12 +1,12 @@
 module github.com/genuinetools/upmail
 
 require (
-	github.com/aws/aws-sdk-go v1.15.41 // indirect
+	github.com/aws/aws-sdk-go v1.15.41
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/facebookgo/ensure v0.0.0-20160127193407-b4ab57deab51 // indirect
 	github.com/facebookgo/stack v0.0.0-20160209184415-751773369052 // indirect
 	github.com/facebookgo/subset v0.0.0-20150612182917-8dac2c3c4870 // indirect
-	github.com/fatih/color v1.7.0 // indirect
+	github.com/fatih/color v1.7.0
 	github.com/genuinetools/pkg v0.0.0-20180910213200-1c141f661797
 	github.com/gopherjs/gopherjs v0.0.0-20180825215210-0210a2f0f73c // indirect
 	github.com/jtolds/gls v4.2.1+incompatible // indirect
@@ -9,6 +9,7 @@ import (
 	"net/smtp"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"strings"
 	"syscall"
 	"time"
@@ -23,19 +24,62 @@ import (
 )
 
 var (
-	configFile string
-	recipient  string
-	interval   time.Duration
+	configFile  string
+	stateFile   string
+	ackFile     string
+	silenceFile string
+	outboxDir   string
+	oauth2File  string
+	recipient   string
+	interval    time.Duration
+	grouped     bool
+
+	alertAfter   int
+	recoverAfter int
+
+	remind string
+
+	flapWindow int
+	flapHigh   float64
+	flapLow    float64
+
+	outboxMaxAge time.Duration
+
+	templateDir string
 
 	ae bool
 
 	mailgunAPIKey string
 	mailgunDomain string
 
+	mailgunAPIBase  string
+	mailgunTestMode bool
+	mailgunTemplate string
+
+	bounceInterval      time.Duration
+	bounceWarn          string
+	bounceWarnTransport string
+
+	transport string
+
+	sesRegion           string
+	sesConfigurationSet string
+	sesEndpoint         string
+
+	sendmailPath string
+	lmtpSocket   string
+
 	smtpServer   string
 	smtpSender   string
 	smtpUsername string
 	smtpPassword string
+	smtpAuth     string
+
+	smtpTLS                string
+	smtpCA                 string
+	smtpCert               string
+	smtpKey                string
+	smtpInsecureSkipVerify bool
 
 	debug bool
 )
@@ -46,6 +90,14 @@ func main() {
 	p.Name = "upmail"
 	p.Description = "Email notification hook for https://github.com/sourcegraph/checkup"
 
+	// Setup the commands.
+	p.Commands = []cli.Command{
+		&ackCommand{},
+		&bouncesCommand{},
+		&oncallCommand{},
+		&silenceCommand{},
+	}
+
 	// Set the GitCommit and Version.
 	p.GitCommit = version.GITCOMMIT
 	p.Version = version.VERSION
@@ -53,18 +105,56 @@ func main() {
 	// Setup the global flags.
 	p.FlagSet = flag.NewFlagSet("global", flag.ExitOnError)
 	p.FlagSet.StringVar(&configFile, "config", "checkup.json", "config file location")
-	p.FlagSet.StringVar(&recipient, "recipient", "", "recipient for email notifications")
+	p.FlagSet.StringVar(&stateFile, "state", "", "state file location, empty means upmail.state.json next to the config file")
+	p.FlagSet.StringVar(&ackFile, "acks", "", "acknowledgments file location, empty means upmail.acks.json next to the config file")
+	p.FlagSet.StringVar(&silenceFile, "silences", "", "silences file location, empty means upmail.silences.json next to the config file")
+	p.FlagSet.StringVar(&outboxDir, "outbox", "", "directory for messages waiting to be retried, empty means upmail.outbox next to the config file")
+	p.FlagSet.DurationVar(&outboxMaxAge, "outbox-max-age", email.DefaultOutboxMaxAge, "how long failed messages are retried, 0 disables the outbox")
+	p.FlagSet.StringVar(&recipient, "recipient", "", "comma separated recipients for email notifications that no route matches")
 	p.FlagSet.DurationVar(&interval, "interval", 10*time.Minute, "check interval (ex. 5ms, 10s, 1m, 3h)")
+	p.FlagSet.StringVar(&templateDir, "template-dir", "", "directory with custom email templates, missing ones fall back to the defaults")
+	p.FlagSet.IntVar(&alertAfter, "alert-after", 1, "number of consecutive unhealthy results before an alert is sent")
+	p.FlagSet.IntVar(&recoverAfter, "recover-after", 1, "number of consecutive healthy results before a recovery is sent")
+	p.FlagSet.StringVar(&remind, "remind", "", "comma separated reminder intervals per status while a check stays unhealthy (ex. down=1h,degraded=6h)")
+	p.FlagSet.IntVar(&flapWindow, "flap-window", 0, "number of recent results flap detection looks at, 0 disables it")
+	p.FlagSet.Float64Var(&flapHigh, "flap-high", email.DefaultFlapHigh, "percentage of status changes at which a check starts flapping")
+	p.FlagSet.Float64Var(&flapLow, "flap-low", email.DefaultFlapLow, "percentage of status changes below which a flapping check is stable again")
+	p.FlagSet.BoolVar(&grouped, "grouped", false, "send a single digest email per check run instead of one email per check")
 
 	p.FlagSet.BoolVar(&ae, "appengine", false, "enable the server for running in Google App Engine")
 
 	p.FlagSet.StringVar(&mailgunAPIKey, "mailgun", "", "Mailgun API Key to use for sending email (optional)")
 	p.FlagSet.StringVar(&mailgunDomain, "mailgun-domain", "", "Mailgun Domain to use for sending email (optional)")
 
+	p.FlagSet.StringVar(&mailgunAPIBase, "mailgun-api-base", "", "Mailgun API base, empty means the US region, use "+email.MailgunAPIBaseEU+" for the EU region")
+	p.FlagSet.BoolVar(&mailgunTestMode, "mailgun-test-mode", false, "make Mailgun accept emails without delivering them")
+	p.FlagSet.StringVar(&mailgunTemplate, "mailgun-template", "", "Mailgun stored template to render emails with instead of the upmail templates (optional)")
+
+	p.FlagSet.DurationVar(&bounceInterval, "bounce-interval", 0, "how often to check the recipients against the Mailgun bounce and complaint lists, 0 disables it")
+	p.FlagSet.StringVar(&bounceWarn, "bounce-warn", "", "comma separated alternate recipients warned about recipients that cannot receive emails")
+	p.FlagSet.StringVar(&bounceWarnTransport, "bounce-warn-transport", "", "transports for the bounce warnings, empty means the regular transports")
+
+	p.FlagSet.StringVar(&transport, "transport", "", "comma separated transports to try in order (smtp, mailgun, ses, sendmail, lmtp, stdout, mbox:<path>, maildir:<dir>), empty means Mailgun if configured followed by SMTP")
+
+	p.FlagSet.StringVar(&sesRegion, "ses-region", "", "AWS region of SES, empty means the region of the AWS environment or shared config")
+	p.FlagSet.StringVar(&sesConfigurationSet, "ses-configuration-set", "", "SES configuration set to send with (optional)")
+	p.FlagSet.StringVar(&sesEndpoint, "ses-endpoint", "", "SES API endpoint override (optional)")
+
+	p.FlagSet.StringVar(&sendmailPath, "sendmail", email.DefaultSendmailPath, "sendmail binary of the sendmail transport, invoked with -t -i")
+	p.FlagSet.StringVar(&lmtpSocket, "lmtp-socket", "", "Unix socket of the LMTP server of the lmtp transport")
+
 	p.FlagSet.StringVar(&smtpServer, "server", "", "SMTP server for email notifications")
-	p.FlagSet.StringVar(&smtpSender, "sender", "", "SMTP default sender email address for email notifications")
+	p.FlagSet.StringVar(&smtpSender, "sender", "", "SMTP default sender email address for email notifications, empty means upmail@<hostname>")
 	p.FlagSet.StringVar(&smtpUsername, "username", "", "SMTP server username")
 	p.FlagSet.StringVar(&smtpPassword, "password", "", "SMTP server password")
+	p.FlagSet.StringVar(&smtpAuth, "smtp-auth", email.AuthAuto, "SMTP auth mechanism (auto, plain, login, cram-md5, xoauth2, none), no auth is used without a username")
+	p.FlagSet.StringVar(&oauth2File, "oauth2-token", "", "file a rotated xoauth2 refresh token is kept in across restarts, empty means upmail.oauth2.json next to the state file")
+
+	p.FlagSet.StringVar(&smtpTLS, "smtp-tls", string(email.TLSStartTLS), "SMTP TLS mode (implicit, starttls, require-starttls, none)")
+	p.FlagSet.StringVar(&smtpCA, "smtp-ca", "", "PEM encoded CA bundle to trust for the SMTP server")
+	p.FlagSet.StringVar(&smtpCert, "smtp-cert", "", "PEM encoded client certificate for the SMTP server")
+	p.FlagSet.StringVar(&smtpKey, "smtp-key", "", "PEM encoded client certificate key for the SMTP server")
+	p.FlagSet.BoolVar(&smtpInsecureSkipVerify, "smtp-insecure-skip-verify", false, "do not verify the certificate of the SMTP server")
 
 	p.FlagSet.BoolVar(&debug, "d", false, "enable debug logging")
 
@@ -78,11 +168,39 @@ func main() {
 		if len(configFile) < 1 {
 			return fmt.Errorf("config file cannot be empty")
 		}
-		if len(recipient) < 1 {
-			return fmt.Errorf("recipient cannot be empty")
+		if len(stateFile) < 1 {
+			stateFile = filepath.Join(filepath.Dir(configFile), "upmail.state.json")
+		}
+		if len(ackFile) < 1 {
+			ackFile = filepath.Join(filepath.Dir(configFile), "upmail.acks.json")
+		}
+		if len(silenceFile) < 1 {
+			silenceFile = filepath.Join(filepath.Dir(configFile), "upmail.silences.json")
+		}
+		if len(outboxDir) < 1 {
+			outboxDir = filepath.Join(filepath.Dir(configFile), "upmail.outbox")
+		}
+		if len(oauth2File) < 1 {
+			oauth2File = filepath.Join(filepath.Dir(stateFile), "upmail.oauth2.json")
+		}
+		if bounceInterval > 0 && (len(mailgunAPIKey) < 1 || len(mailgunDomain) < 1) {
+			return fmt.Errorf("--bounce-interval requires --mailgun and --mailgun-domain")
+		}
+		if _, err := email.ParseReminders(remind); err != nil {
+			return err
 		}
-		if len(smtpServer) < 1 && len(mailgunAPIKey) < 1 && len(mailgunDomain) < 1 {
-			return fmt.Errorf("SMTP server OR Mailgun API Key cannot be empty")
+		if _, err := email.ParseTLSMode(smtpTLS); err != nil {
+			return err
+		}
+		// Mechanisms are case insensitive, the action compares the
+		// lowercased name.
+		smtpAuth = strings.ToLower(strings.TrimSpace(smtpAuth))
+		if smtpAuth == email.AuthXOAUTH2 {
+			if len(smtpUsername) < 1 {
+				return fmt.Errorf("--smtp-auth xoauth2 requires --username")
+			}
+		} else if _, err := email.NewSMTPAuth(smtpAuth, "", "", ""); err != nil {
+			return err
 		}
 
 		return nil
@@ -90,19 +208,11 @@ func main() {
 
 	// Set the main program action.
 	p.Action = func(ctx context.Context, args []string) error {
-		ticker := time.NewTicker(interval)
-
-		// On ^C, or SIGTERM handle exit.
-		s := make(chan os.Signal, 1)
-		signal.Notify(s, os.Interrupt)
-		signal.Notify(s, syscall.SIGTERM)
-		go func() {
-			for sig := range s {
-				ticker.Stop()
-				logrus.Infof("Received %s, exiting.", sig.String())
-				os.Exit(0)
-			}
-		}()
+		// Checked here rather than in Before so that commands such as ack
+		// work without any transport settings.
+		if len(transport) < 1 && len(smtpServer) < 1 && len(mailgunAPIKey) < 1 && len(mailgunDomain) < 1 {
+			logrus.Fatal("SMTP server OR Mailgun API Key cannot be empty")
+		}
 
 		configBytes, err := ioutil.ReadFile(configFile)
 		if err != nil {
@@ -115,22 +225,135 @@ func main() {
 			logrus.Fatal(err)
 		}
 
-		n := email.Notifier{
-			MailgunAPIKey: mailgunAPIKey,
-			MailgunDomain: mailgunDomain,
-			Recipient:     recipient,
-			Server:        smtpServer,
-			Sender:        smtpSender,
-			Auth: smtp.PlainAuth(
-				"",
+		cfg, routing, err := parseConfig(configBytes)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		reminders, _ := email.ParseReminders(remind)
+
+		templates, err := email.LoadTemplates(templateDir)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		tlsMode, _ := email.ParseTLSMode(smtpTLS)
+		tlsConfig, err := email.NewTLSConfig(
+			strings.SplitN(smtpServer, ":", 2)[0],
+			smtpCA,
+			smtpCert,
+			smtpKey,
+			smtpInsecureSkipVerify,
+		)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		var auth smtp.Auth
+		if smtpAuth == email.AuthXOAUTH2 {
+			if cfg.OAuth2 == nil {
+				logrus.Fatal("the xoauth2 SMTP auth mechanism requires an oauth2 section in the upmail config")
+			}
+			tokens, err := email.NewOAuth2TokenSource(*cfg.OAuth2, oauth2File)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+			auth = email.NewXOAUTH2Auth(smtpUsername, strings.SplitN(smtpServer, ":", 2)[0], tokens)
+		} else {
+			auth, err = email.NewSMTPAuth(
+				smtpAuth,
 				smtpUsername,
 				smtpPassword,
 				strings.SplitN(smtpServer, ":", 2)[0],
-			),
+			)
+			if err != nil {
+				logrus.Fatal(err)
+			}
+		}
+
+		n := &email.Notifier{
+			Routing:      routing,
+			Sender:       smtpSender,
+			StateFile:    stateFile,
+			Templates:    templates,
+			Grouped:      grouped,
+			AlertAfter:   alertAfter,
+			RecoverAfter: recoverAfter,
+			Thresholds:   cfg.Thresholds,
+			FlapWindow:   flapWindow,
+			FlapHigh:     flapHigh,
+			FlapLow:      flapLow,
+			Reminders:    reminders,
+			Escalations:  cfg.Escalations,
+			AckFile:      ackFile,
+			Schedules:    cfg.Schedules,
+			Maintenance:  cfg.Maintenance,
+			Calendars:    cfg.Calendars,
+			SilenceFile:  silenceFile,
+		}
+		n.Transports, err = buildTransports(transport, auth, tlsMode, tlsConfig, cfg.MailgunHeaders)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+
+		if outboxMaxAge > 0 {
+			n.Outbox = &email.Outbox{
+				Dir:    outboxDir,
+				MaxAge: outboxMaxAge,
+			}
+			if err := n.Outbox.Load(); err != nil {
+				logrus.Fatal(err)
+			}
+			if depth := n.Outbox.Len(); depth > 0 {
+				logrus.Infof("Loaded %d queued messages from the outbox %s", depth, outboxDir)
+			}
 		}
 		c.Notifier = n
 
-		logrus.Infof("Starting checks that will send emails to: %s", recipient)
+		for _, cal := range cfg.Calendars {
+			if err := cal.Fetch(); err != nil {
+				logrus.Warnf("fetching calendar failed, retrying on the next refresh: %v", err)
+			}
+		}
+
+		var bounces *email.BounceMonitor
+		if bounceInterval > 0 {
+			bounces = newBounceMonitor(cfg, routing)
+			bounces.WarnTransport = email.Chain(n.Transports)
+			if len(bounceWarnTransport) > 0 {
+				warnTransports, err := buildTransports(bounceWarnTransport, auth, tlsMode, tlsConfig, cfg.MailgunHeaders)
+				if err != nil {
+					logrus.Fatal(err)
+				}
+				bounces.WarnTransport = email.Chain(warnTransports)
+			}
+		}
+
+		ticker := time.NewTicker(interval)
+		stop := make(chan struct{})
+		go n.RetryOutbox(10*time.Second, stop)
+		for _, cal := range cfg.Calendars {
+			go cal.Run(stop)
+		}
+		if bounces != nil {
+			go bounces.Run(bounceInterval, stop)
+		}
+
+		// On ^C, or SIGTERM handle exit.
+		s := make(chan os.Signal, 1)
+		signal.Notify(s, os.Interrupt)
+		signal.Notify(s, syscall.SIGTERM)
+		go func() {
+			for sig := range s {
+				ticker.Stop()
+				close(stop)
+				logrus.Infof("Received %s, exiting.", sig.String())
+				n.FlushOutbox()
+				os.Exit(0)
+			}
+		}()
+
+		logrus.Infof("Starting checks that will send emails to: %s (and %d routes)", strings.Join(routing.Default, ", "), len(routing.Routes))
 
 		if ae {
 			// setup necessary app engine health checks and listener
@@ -154,3 +377,25 @@ func main() {
 	// Run our program.
 	p.Run()
 }
+
+// parseConfig reads the upmail settings from the config file and builds the
+// routing table. Recipients given on the command line are added to the
+// default route.
+func parseConfig(configBytes []byte) (email.Config, email.Routing, error) {
+	cfg, err := email.ParseConfig(configBytes)
+	if err != nil {
+		return cfg, email.Routing{}, err
+	}
+
+	routing := cfg.Routing
+	for _, r := range strings.Split(recipient, ",") {
+		if r = strings.TrimSpace(r); len(r) > 0 {
+			routing.Default = append(routing.Default, r)
+		}
+	}
+	if len(routing.Default) < 1 && len(routing.Routes) < 1 {
+		return cfg, routing, fmt.Errorf("recipient cannot be empty")
+	}
+
+	return cfg, routing, nil
+}
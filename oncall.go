@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/genuinetools/upmail/email"
+)
+
+const oncallShortHelp = `Show who is on call.`
+
+const oncallLongHelp = `Show who is on call now and for the next shifts of the schedules in the
+config file, or only of the schedules passed as arguments.`
+
+type oncallCommand struct {
+	shifts int
+}
+
+func (cmd *oncallCommand) Name() string      { return "oncall" }
+func (cmd *oncallCommand) Args() string      { return "[OPTIONS] [SCHEDULE...]" }
+func (cmd *oncallCommand) ShortHelp() string { return oncallShortHelp }
+func (cmd *oncallCommand) LongHelp() string  { return oncallLongHelp }
+func (cmd *oncallCommand) Hidden() bool      { return false }
+
+func (cmd *oncallCommand) Register(fs *flag.FlagSet) {
+	fs.IntVar(&cmd.shifts, "shifts", 4, "number of upcoming shifts to show after the current one")
+}
+
+func (cmd *oncallCommand) Run(ctx context.Context, args []string) error {
+	configBytes, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return err
+	}
+	cfg, err := email.ParseConfig(configBytes)
+	if err != nil {
+		return err
+	}
+
+	names := args
+	if len(names) == 0 {
+		for name := range cfg.Schedules {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no schedules in %s", configFile)
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "SCHEDULE\tRECIPIENT\tSTART\tEND\t")
+	for _, name := range names {
+		s, ok := cfg.Schedules[name]
+		if !ok {
+			return fmt.Errorf("unknown schedule %q", name)
+		}
+		shifts, err := s.Shifts(now, cmd.shifts+1)
+		if err != nil {
+			return fmt.Errorf("schedule %s: %v", name, err)
+		}
+		for _, shift := range shifts {
+			var note string
+			if shift.Override {
+				note = "override"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", name, shift.Recipient, shift.Start.Format("2006-01-02 15:04 MST"), shift.End.Format("2006-01-02 15:04 MST"), note)
+		}
+	}
+	return w.Flush()
+}
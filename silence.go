@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/genuinetools/upmail/email"
+)
+
+const silenceShortHelp = `Mute notifications about checks for a while.`
+
+const silenceLongHelp = `Manage the silences that mute the notifications about the checks they
+match. The running upmail reads them on every check run.
+
+  upmail silence add --match title=~"api-.*" [--match ...] [--for 2h] [--comment TEXT]
+  upmail silence list [--all]
+  upmail silence expire ID
+
+Matchers compare the title, endpoint or status of a check with =, != or,
+for anchored regular expressions, =~ and !~. A silence applies to the checks
+that match all of its matchers.`
+
+type silenceCommand struct{}
+
+func (cmd *silenceCommand) Name() string      { return "silence" }
+func (cmd *silenceCommand) Args() string      { return "add|list|expire [OPTIONS]" }
+func (cmd *silenceCommand) ShortHelp() string { return silenceShortHelp }
+func (cmd *silenceCommand) LongHelp() string  { return silenceLongHelp }
+func (cmd *silenceCommand) Hidden() bool      { return false }
+
+func (cmd *silenceCommand) Register(fs *flag.FlagSet) {}
+
+func (cmd *silenceCommand) Run(ctx context.Context, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("pass add, list or expire")
+	}
+
+	// The flags of every action come after its name, so they are parsed
+	// here rather than registered with the command.
+	switch args[0] {
+	case "add":
+		return silenceAdd(args[1:])
+	case "list":
+		return silenceList(args[1:])
+	case "expire":
+		return silenceExpire(args[1:])
+	}
+	return fmt.Errorf("unknown silence action %q, pass add, list or expire", args[0])
+}
+
+// matchers collects repeated --match flags.
+type matchers []email.Matcher
+
+func (m *matchers) String() string {
+	var s []string
+	for _, matcher := range *m {
+		s = append(s, matcher.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (m *matchers) Set(value string) error {
+	matcher, err := email.ParseMatcher(value)
+	if err != nil {
+		return err
+	}
+	*m = append(*m, matcher)
+	return nil
+}
+
+func silenceAdd(args []string) error {
+	var (
+		match   matchers
+		dur     time.Duration
+		comment string
+		by      string
+	)
+	fs := flag.NewFlagSet("silence add", flag.ExitOnError)
+	fs.Var(&match, "match", `matcher such as title=~"api-.*", can be repeated`)
+	fs.DurationVar(&dur, "for", time.Hour, "how long the silence lasts")
+	fs.StringVar(&comment, "comment", "", "why the checks are silenced")
+	fs.StringVar(&by, "by", os.Getenv("USER"), "who creates the silence")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if len(match) == 0 {
+		return fmt.Errorf("pass at least one --match")
+	}
+
+	silences, err := email.LoadSilences(silenceFile)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	id, err := silences.Add(email.Silence{
+		Matchers:  match,
+		Start:     now,
+		End:       now.Add(dur),
+		CreatedBy: by,
+		Comment:   comment,
+	})
+	if err != nil {
+		return err
+	}
+	if err := silences.Save(silenceFile); err != nil {
+		return err
+	}
+
+	fmt.Println(id)
+	return nil
+}
+
+func silenceList(args []string) error {
+	var all bool
+	fs := flag.NewFlagSet("silence list", flag.ExitOnError)
+	fs.BoolVar(&all, "all", false, "also list expired silences")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	silences, err := email.LoadSilences(silenceFile)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 20, 1, 3, ' ', 0)
+	fmt.Fprintln(w, "ID\tMATCHERS\tENDS\tCREATED BY\tCOMMENT")
+	for _, s := range silences.Silences {
+		ends := s.End.Format(time.RFC3339)
+		if !s.End.After(now) {
+			if !all {
+				continue
+			}
+			ends += " (expired)"
+		}
+
+		var m []string
+		for _, matcher := range s.Matchers {
+			m = append(m, matcher.String())
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", s.ID, strings.Join(m, ","), ends, s.CreatedBy, s.Comment)
+	}
+	return w.Flush()
+}
+
+func silenceExpire(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("pass the ID of the silence to expire")
+	}
+
+	silences, err := email.LoadSilences(silenceFile)
+	if err != nil {
+		return err
+	}
+	s, err := silences.Expire(args[0], time.Now())
+	if err != nil {
+		return err
+	}
+	if err := silences.Save(silenceFile); err != nil {
+		return err
+	}
+
+	fmt.Printf("Expired silence %s\n", s.ID)
+	return nil
+}
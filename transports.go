@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/smtp"
+	"strings"
+
+	"github.com/genuinetools/upmail/email"
+)
+
+// buildTransports parses the comma separated, ordered list of transports
+// given with --transport. The mbox and maildir transports take their path
+// after a colon, as in "mbox:/tmp/alerts.mbox". An empty list means Mailgun
+// if configured, followed by SMTP if configured.
+func buildTransports(spec string, auth smtp.Auth, tlsMode email.TLSMode, tlsConfig *tls.Config, mailgunHeaders map[string]string) ([]email.Transport, error) {
+	if len(spec) < 1 {
+		var names []string
+		if len(mailgunAPIKey) > 0 || len(mailgunDomain) > 0 {
+			names = append(names, "mailgun")
+		}
+		if len(smtpServer) > 0 {
+			names = append(names, "smtp")
+		}
+		spec = strings.Join(names, ",")
+	}
+
+	var transports []email.Transport
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) < 1 {
+			continue
+		}
+
+		arg := ""
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, arg = name[:i], name[i+1:]
+		}
+
+		switch name {
+		case "smtp":
+			if len(smtpServer) < 1 {
+				return nil, fmt.Errorf("transport smtp requires --server")
+			}
+			transports = append(transports, email.SMTPTransport{
+				Server:    smtpServer,
+				Auth:      auth,
+				TLS:       tlsMode,
+				TLSConfig: tlsConfig,
+			})
+		case "mailgun":
+			if len(mailgunAPIKey) < 1 || len(mailgunDomain) < 1 {
+				return nil, fmt.Errorf("transport mailgun requires --mailgun and --mailgun-domain")
+			}
+			transports = append(transports, email.MailgunTransport{
+				Domain:   mailgunDomain,
+				APIKey:   mailgunAPIKey,
+				APIBase:  mailgunAPIBase,
+				TestMode: mailgunTestMode,
+				Template: mailgunTemplate,
+				Headers:  mailgunHeaders,
+			})
+		case "ses":
+			transports = append(transports, email.SESTransport{
+				Region:           sesRegion,
+				ConfigurationSet: sesConfigurationSet,
+				Endpoint:         sesEndpoint,
+			})
+		case "sendmail":
+			transports = append(transports, email.SendmailTransport{
+				Path: sendmailPath,
+			})
+		case "lmtp":
+			if len(lmtpSocket) < 1 {
+				return nil, fmt.Errorf("transport lmtp requires --lmtp-socket")
+			}
+			transports = append(transports, email.LMTPTransport{
+				Socket: lmtpSocket,
+			})
+		case "stdout":
+			transports = append(transports, email.StdoutTransport{})
+		case "mbox":
+			if len(arg) < 1 {
+				return nil, fmt.Errorf("transport mbox requires a path, as in mbox:<path>")
+			}
+			transports = append(transports, email.MboxTransport{
+				Path: arg,
+			})
+		case "maildir":
+			if len(arg) < 1 {
+				return nil, fmt.Errorf("transport maildir requires a directory, as in maildir:<dir>")
+			}
+			transports = append(transports, email.MaildirTransport{
+				Dir: arg,
+			})
+		default:
+			return nil, fmt.Errorf("unknown transport %q", name)
+		}
+	}
+
+	return transports, nil
+}